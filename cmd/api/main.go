@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
@@ -12,6 +14,8 @@ import (
 	"github.com/qhh/prjEcom/pkg/db"
 	dbinit "github.com/qhh/prjEcom/pkg/db/dbinit"
 	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/mailer"
+	"github.com/qhh/prjEcom/pkg/payment"
 	"github.com/qhh/prjEcom/pkg/utils"
 )
 
@@ -41,14 +45,41 @@ func main() {
 	// Create store
 	store := store.NewStore(pgDB)
 
-	// Create JWT maker
-	jwtMaker, err := utils.NewJWTMaker(cfg.JWTSecret)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create token maker
+	tokenMaker, err := newTokenMaker(ctx, &cfg)
+	if err != nil {
+		log.Fatalf("Failed to create token maker: %v", err)
+	}
+
+	// Create payment providers. The fake gateway approves every charge, so
+	// it is only available in development. Without PAYMENT_PROVIDER the
+	// server runs with payments disabled.
+	var providers []payment.PaymentProvider
+	if cfg.Environment == "development" {
+		providers = append(providers, payment.NewFakeProvider(cfg.PaymentWebhookSecret))
+	}
+	payments, err := payment.NewRegistry(cfg.PaymentProvider, providers...)
 	if err != nil {
-		log.Fatalf("Failed to create JWT maker: %v", err)
+		log.Fatalf("Failed to create payment providers: %v", err)
+	}
+	if cfg.PaymentProvider == "" {
+		log.Println("Warning: PAYMENT_PROVIDER is not set, payments are disabled")
+	}
+
+	// Create mailer
+	mail, err := mailer.New(cfg.Mailer, cfg.MailFrom, cfg.MailDir)
+	if err != nil {
+		log.Fatalf("Failed to create mailer: %v", err)
 	}
 
 	// Setup router
-	router := routes.SetupRouter(store, jwtMaker)
+	router, err := routes.SetupRouter(&cfg, store, tokenMaker, payments, mail)
+	if err != nil {
+		log.Fatalf("Failed to set up router: %v", err)
+	}
 
 	// Start server
 	serverAddr := fmt.Sprintf(":%s", cfg.ServerPort)
@@ -67,3 +98,34 @@ func main() {
 	<-quit
 	log.Println("Shutting down server...")
 }
+
+// newTokenMaker creates the access token maker selected by the config
+func newTokenMaker(ctx context.Context, cfg *config.Config) (utils.TokenMaker, error) {
+	switch cfg.TokenType {
+	case "paseto":
+		key, err := hex.DecodeString(cfg.PasetoKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PASETO key: %w", err)
+		}
+		return utils.NewPasetoMaker(key)
+	case "jwt":
+	default:
+		return nil, fmt.Errorf("unsupported token type: %s", cfg.TokenType)
+	}
+
+	if cfg.JWTAlgorithm == utils.AlgorithmHS256 {
+		return utils.NewJWTMaker(cfg.JWTSecret)
+	}
+
+	jwtMaker, err := utils.NewAsymmetricJWTMaker(utils.JWTKeyOptions{
+		Algorithm:   cfg.JWTAlgorithm,
+		KeysDir:     cfg.JWTKeysDir,
+		RotateEvery: cfg.JWTKeyRotation,
+		RetainFor:   cfg.JWTExpiresIn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	jwtMaker.StartKeyRotation(ctx)
+	return jwtMaker, nil
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+func TestRecordAuditWithoutAuth(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+
+	// The action must fail before anything is written
+	err := recordAuditTx(c, nil, nil, models.AuditUserBan, models.AuditTargetUser, "user", nil, nil)
+	if err == nil {
+		t.Fatal("recordAuditTx succeeded without an authenticated user")
+	}
+}
+
+func TestAuditSnapshot(t *testing.T) {
+	if snapshot, err := auditSnapshot(nil); err != nil || snapshot != nil {
+		t.Errorf("nil snapshot = %s, %v, want empty", snapshot, err)
+	}
+
+	snapshot, err := auditSnapshot(gin.H{"status": models.StatusPaid})
+	if err != nil || string(snapshot) != `{"status":"paid"}` {
+		t.Errorf("snapshot = %s, %v", snapshot, err)
+	}
+
+	// A snapshot that can't be encoded fails the action
+	if _, err := auditSnapshot(gin.H{"bad": make(chan int)}); err == nil {
+		t.Error("auditSnapshot encoded a channel")
+	}
+}
@@ -2,25 +2,39 @@ package handlers
 
 import (
 	"errors"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
 	"github.com/qhh/prjEcom/pkg/db/store"
 	"github.com/qhh/prjEcom/pkg/models"
 	"github.com/qhh/prjEcom/pkg/utils"
 )
 
 type AuthHandler struct {
-	store    *store.Store
-	jwtMaker *utils.JWTMaker
+	store           *store.Store
+	tokenMaker      utils.TokenMaker
+	verification    *VerificationHandler
+	accessDuration  time.Duration
+	refreshDuration time.Duration
+	mfaDuration     time.Duration
 }
 
-func NewAuthHandler(store *store.Store, jwtMaker *utils.JWTMaker) *AuthHandler {
+// maxMFAAttempts is how many wrong codes an MFA challenge accepts before
+// the user has to log in again
+const maxMFAAttempts = 5
+
+func NewAuthHandler(store *store.Store, tokenMaker utils.TokenMaker, verification *VerificationHandler, accessDuration, refreshDuration, mfaDuration time.Duration) *AuthHandler {
 	return &AuthHandler{
-		store:    store,
-		jwtMaker: jwtMaker,
+		store:           store,
+		tokenMaker:      tokenMaker,
+		verification:    verification,
+		accessDuration:  accessDuration,
+		refreshDuration: refreshDuration,
+		mfaDuration:     mfaDuration,
 	}
 }
 
@@ -30,11 +44,26 @@ type loginRequest struct {
 }
 
 type loginResponse struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Role     string `json:"role"`
-	Token    string `json:"token"`
+	ID                    string    `json:"id"`
+	Username              string    `json:"username"`
+	Email                 string    `json:"email"`
+	Role                  string    `json:"role"`
+	Token                 string    `json:"token"`
+	TokenExpiresAt        time.Time `json:"token_expires_at"`
+	RefreshToken          string    `json:"refresh_token"`
+	RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+	// MFAEnrollmentRequired is set when the user's role requires MFA and
+	// they haven't enabled it yet
+	MFAEnrollmentRequired bool `json:"mfa_enrollment_required,omitempty"`
+}
+
+type loginMFARequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
 type registerRequest struct {
@@ -92,11 +121,18 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
+	// Ask the user to confirm their email; they can request a new link if
+	// this one gets lost
+	if err := h.verification.sendVerification(c, user); err != nil {
+		log.Printf("Failed to send verification email to user %s: %v", user.ID, err)
+	}
+
 	c.JSON(http.StatusCreated, gin.H{
-		"id":       user.ID,
-		"username": user.Username,
-		"email":    user.Email,
-		"role":     user.Role,
+		"id":             user.ID,
+		"username":       user.Username,
+		"email":          user.Email,
+		"role":           user.Role,
+		"email_verified": false,
 	})
 }
 
@@ -128,18 +164,288 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// Generate JWT token
-	token, err := h.jwtMaker.CreateToken(user.ID, user.Username, string(user.Role), 24*time.Hour)
+	// Users with MFA get a challenge that LoginMFA exchanges for tokens
+	mfaEnabled, err := h.store.IsMFAEnabled(c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa status"})
+		return
+	}
+	if mfaEnabled {
+		token, tokenHash, err := utils.NewOpaqueToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create mfa challenge"})
+			return
+		}
+
+		challenge := &models.MFAChallenge{
+			UserID:    user.ID,
+			TokenHash: tokenHash,
+			ExpiresAt: time.Now().Add(h.mfaDuration),
+		}
+		if err := h.store.CreateMFAChallenge(c, challenge); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create mfa challenge"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required":         true,
+			"mfa_token":            token,
+			"mfa_token_expires_at": challenge.ExpiresAt,
+		})
+		return
+	}
+
+	mfaRequired, err := h.store.IsMFARequired(c, user.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa policy"})
+		return
+	}
+
+	// Start a new session
+	resp, err := h.startSession(c, user, uuid.New())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
 		return
 	}
+	resp.MFAEnrollmentRequired = mfaRequired
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// LoginMFA completes the login of a user with MFA enabled, exchanging the
+// challenge from Login and a TOTP or recovery code for tokens
+func (h *AuthHandler) LoginMFA(c *gin.Context) {
+	var req loginMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var challenge *models.MFAChallenge
+	valid := false
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		challenge, err = h.store.GetMFAChallengeForUpdateTx(c, tx, utils.HashOpaqueToken(req.MFAToken))
+		if err != nil {
+			return err
+		}
+		if challenge.UsedAt != nil || challenge.Attempts >= maxMFAAttempts || time.Now().After(challenge.ExpiresAt) {
+			return errors.New("mfa challenge not found")
+		}
+
+		valid, err = verifyMFACodeTx(c, h.store, tx, challenge.UserID, req.Code)
+		if err != nil {
+			return err
+		}
+
+		// Failed attempts are committed so they count
+		if valid {
+			now := time.Now()
+			challenge.UsedAt = &now
+		} else {
+			challenge.Attempts++
+		}
+		return h.store.UpdateMFAChallengeTx(c, tx, challenge)
+	})
+
+	if err != nil {
+		var mfaErr *mfaError
+		if errors.As(err, &mfaErr) && mfaErr.Status == http.StatusTooManyRequests {
+			c.JSON(mfaErr.Status, gin.H{"error": mfaErr.Message})
+			return
+		}
+		if err.Error() == "mfa challenge not found" || errors.As(err, &mfaErr) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token, please log in again"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return
+	}
+
+	user, err := h.store.GetUserByID(c, challenge.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		return
+	}
+
+	if user.IsBanned {
+		c.JSON(http.StatusForbidden, gin.H{"error": "your account has been banned"})
+		return
+	}
+
+	resp, err := h.startSession(c, user, uuid.New())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once; presenting a used one again
+// revokes the whole session because the token has probably been stolen.
+func (h *AuthHandler) RefreshToken(c *gin.Context) {
+	var req refreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var resp *loginResponse
+	reused, banned := false, false
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		session, err := h.store.GetSessionByTokenHashTx(c, tx, utils.HashOpaqueToken(req.RefreshToken))
+		if err != nil {
+			return err
+		}
+		if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+			return errors.New("session not found")
+		}
+
+		// Reuse of a rotated token: log out every device of this login
+		if session.RotatedAt != nil {
+			reused = true
+			return h.store.RevokeSessionFamilyTx(c, tx, session.FamilyID)
+		}
+
+		user, err := h.store.GetUserByIDTx(c, tx, session.UserID)
+		if err != nil {
+			return errors.New("session not found")
+		}
+		if user.IsBanned {
+			banned = true
+			return h.store.RevokeSessionFamilyTx(c, tx, session.FamilyID)
+		}
+
+		if err := h.store.MarkSessionRotatedTx(c, tx, session.ID); err != nil {
+			return err
+		}
+
+		// Issue the new tokens with the user's current role. The new
+		// session is stored in the same transaction, so a failure can't
+		// leave the old token rotated without a replacement.
+		resp, err = h.startSessionTx(c, tx, user, session.FamilyID)
+		return err
+	})
+
+	if err != nil {
+		if err.Error() == "session not found" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+
+	if reused {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token reuse detected, please log in again"})
+		return
+	}
+
+	if banned {
+		c.JSON(http.StatusForbidden, gin.H{"error": "your account has been banned"})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Logout revokes the session of a refresh token
+func (h *AuthHandler) Logout(c *gin.Context) {
+	var req refreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	c.JSON(http.StatusOK, loginResponse{
-		ID:       user.ID.String(),
-		Username: user.Username,
-		Email:    user.Email,
-		Role:     string(user.Role),
-		Token:    token,
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		session, err := h.store.GetSessionByTokenHashTx(c, tx, utils.HashOpaqueToken(req.RefreshToken))
+		if err != nil {
+			return err
+		}
+		return h.store.RevokeSessionFamilyTx(c, tx, session.FamilyID)
 	})
+
+	// Logging out with an unknown token is not an error
+	if err != nil && err.Error() != "session not found" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logged out successfully"})
+}
+
+// startSession stores a new refresh token in the given session family and
+// issues an access token for the user
+func (h *AuthHandler) startSession(c *gin.Context, user *models.User, familyID uuid.UUID) (*loginResponse, error) {
+	var resp *loginResponse
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		resp, err = h.startSessionTx(c, tx, user, familyID)
+		return err
+	})
+	return resp, err
+}
+
+// startSessionTx is startSession inside an existing transaction
+func (h *AuthHandler) startSessionTx(c *gin.Context, tx *pg.Tx, user *models.User, familyID uuid.UUID) (*loginResponse, error) {
+	refreshToken, refreshHash, err := utils.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &models.Session{
+		FamilyID:         familyID,
+		UserID:           user.ID,
+		RefreshTokenHash: refreshHash,
+		UserAgent:        c.Request.UserAgent(),
+		ClientIP:         c.ClientIP(),
+		ExpiresAt:        time.Now().Add(h.refreshDuration),
+	}
+	if err := h.store.CreateSessionTx(c, tx, session); err != nil {
+		return nil, err
+	}
+
+	// Generate access token
+	token, err := h.tokenMaker.CreateToken(user.ID, user.Username, string(user.Role), h.accessDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return &loginResponse{
+		ID:                    user.ID.String(),
+		Username:              user.Username,
+		Email:                 user.Email,
+		Role:                  string(user.Role),
+		Token:                 token,
+		TokenExpiresAt:        time.Now().Add(h.accessDuration),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+// JWKS publishes the public keys that verify access tokens so other services
+// can check tokens without sharing a secret. The set is empty for token
+// makers that use a shared key.
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	publisher, ok := h.tokenMaker.(utils.KeySetPublisher)
+	if !ok {
+		c.JSON(http.StatusOK, &utils.JWKSet{Keys: []utils.JWK{}})
+		return
+	}
+
+	set, err := publisher.JWKS()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get signing keys"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
 }
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+type CartHandler struct {
+	store *store.Store
+}
+
+func NewCartHandler(store *store.Store) *CartHandler {
+	return &CartHandler{
+		store: store,
+	}
+}
+
+type addCartItemRequest struct {
+	ProductID string `json:"product_id" binding:"required"`
+	Quantity  int32  `json:"quantity" binding:"required,min=1"`
+}
+
+type updateCartItemRequest struct {
+	Quantity int32 `json:"quantity" binding:"required,min=1"`
+}
+
+type checkoutCartRequest struct {
+	ShippingAddress string `json:"shipping_address" binding:"required"`
+}
+
+// cartLineResponse is a cart item enriched with live product data
+type cartLineResponse struct {
+	ProductID    uuid.UUID  `json:"product_id"`
+	ShopID       *uuid.UUID `json:"shop_id,omitempty"`
+	Name         string     `json:"name,omitempty"`
+	Quantity     int32      `json:"quantity"`
+	UnitPrice    float64    `json:"unit_price"`
+	LineTotal    float64    `json:"line_total"`
+	Stock        int32      `json:"stock"`
+	Available    bool       `json:"available"`
+	StockWarning string     `json:"stock_warning,omitempty"`
+}
+
+// GetCart returns the current user's cart with live prices and stock warnings
+func (h *CartHandler) GetCart(c *gin.Context) {
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	cart, err := h.store.GetOrCreateCart(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart"})
+		return
+	}
+
+	items, err := h.store.GetCartItems(c, cart.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items"})
+		return
+	}
+
+	lines, err := h.buildCartLines(c, items)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart products"})
+		return
+	}
+
+	var totalAmount float64
+	hasWarnings := false
+	for _, line := range lines {
+		totalAmount += line.LineTotal
+		if line.StockWarning != "" {
+			hasWarnings = true
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":           cart.ID,
+		"items":        lines,
+		"total_amount": math.Round(totalAmount*100) / 100,
+		"has_warnings": hasWarnings,
+		"updated_at":   cart.UpdatedAt,
+	})
+}
+
+// AddCartItem adds a product to the current user's cart
+func (h *CartHandler) AddCartItem(c *gin.Context) {
+	var req addCartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	productID, err := uuid.Parse(req.ProductID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product ID"})
+		return
+	}
+
+	// Check if product exists
+	_, err = h.store.GetProductByID(c, productID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		return
+	}
+
+	cart, err := h.store.GetOrCreateCart(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart"})
+		return
+	}
+
+	item, err := h.store.AddCartItem(c, cart.ID, productID, req.Quantity)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add cart item"})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// UpdateCartItem sets the quantity of a product in the current user's cart
+func (h *CartHandler) UpdateCartItem(c *gin.Context) {
+	productID, err := uuid.Parse(c.Param("product_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product ID"})
+		return
+	}
+
+	var req updateCartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	cart, err := h.store.GetOrCreateCart(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart"})
+		return
+	}
+
+	item, err := h.store.UpdateCartItemQuantity(c, cart.ID, productID, req.Quantity)
+	if err != nil {
+		if err.Error() == "cart item not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "cart item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update cart item"})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// RemoveCartItem removes a product from the current user's cart
+func (h *CartHandler) RemoveCartItem(c *gin.Context) {
+	productID, err := uuid.Parse(c.Param("product_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product ID"})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	cart, err := h.store.GetOrCreateCart(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart"})
+		return
+	}
+
+	err = h.store.RemoveCartItem(c, cart.ID, productID)
+	if err != nil {
+		if err.Error() == "cart item not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "cart item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove cart item"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "cart item removed successfully"})
+}
+
+// Checkout converts the current user's cart into orders, one per shop
+func (h *CartHandler) Checkout(c *gin.Context) {
+	var req checkoutCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	cart, err := h.store.GetOrCreateCart(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart"})
+		return
+	}
+
+	items, err := h.store.GetCartItems(c, cart.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart items"})
+		return
+	}
+
+	if len(items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cart is empty"})
+		return
+	}
+
+	lines := make([]orderLine, len(items))
+	for i, item := range items {
+		lines[i] = orderLine{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+		}
+	}
+
+	// Group cart items by shop
+	products, err := h.store.GetProductsByIDs(c, uniqueProductIDs(lines))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cart products"})
+		return
+	}
+	productShops := make(map[uuid.UUID]uuid.UUID, len(products))
+	for _, product := range products {
+		productShops[product.ID] = product.ShopID
+	}
+
+	groups, err := groupOrderLines(lines, productShops)
+	if err != nil {
+		writeOrderError(c, err)
+		return
+	}
+
+	checkout := &models.Checkout{
+		UserID:          payload.UserID,
+		ShippingAddress: req.ShippingAddress,
+	}
+
+	// Place one order per shop and empty the cart atomically
+	var orders []placedOrder
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		orders, err = placeCheckoutTx(c, tx, checkout, groups)
+		if err != nil {
+			return err
+		}
+
+		return h.store.ClearCartTx(c, tx, cart.ID)
+	})
+
+	if err != nil {
+		writeOrderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, checkoutResponse(checkout, orders))
+}
+
+// buildCartLines joins cart items with their current product data
+func (h *CartHandler) buildCartLines(c *gin.Context, items []*models.CartItem) ([]cartLineResponse, error) {
+	productIDs := make([]uuid.UUID, len(items))
+	for i, item := range items {
+		productIDs[i] = item.ProductID
+	}
+
+	products, err := h.store.GetProductsByIDs(c, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	productsByID := make(map[uuid.UUID]*models.Product, len(products))
+	for _, product := range products {
+		productsByID[product.ID] = product
+	}
+
+	lines := make([]cartLineResponse, 0, len(items))
+	for _, item := range items {
+		line := cartLineResponse{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+		}
+
+		product, ok := productsByID[item.ProductID]
+		if !ok {
+			line.StockWarning = "product is no longer available"
+			lines = append(lines, line)
+			continue
+		}
+
+		shopID := product.ShopID
+		line.ShopID = &shopID
+		line.Name = product.Name
+		line.UnitPrice = product.Price
+		line.LineTotal = math.Round(product.Price*float64(item.Quantity)*100) / 100
+		line.Stock = product.Stock
+		line.Available = product.Stock >= item.Quantity
+
+		switch {
+		case product.Stock == 0:
+			line.StockWarning = "out of stock"
+		case product.Stock < item.Quantity:
+			line.StockWarning = fmt.Sprintf("only %d left in stock", product.Stock)
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
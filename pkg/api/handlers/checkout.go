@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+type CheckoutHandler struct {
+	store *store.Store
+}
+
+func NewCheckoutHandler(store *store.Store) *CheckoutHandler {
+	return &CheckoutHandler{
+		store: store,
+	}
+}
+
+type checkoutItemRequest struct {
+	ProductID string `json:"product_id" binding:"required"`
+	// ShopID is optional; when set, the product must belong to this shop
+	ShopID   string  `json:"shop_id"`
+	Quantity int32   `json:"quantity" binding:"required,min=1"`
+	Price    float64 `json:"price" binding:"omitempty,gt=0"`
+}
+
+type createCheckoutRequest struct {
+	ShippingAddress string                `json:"shipping_address" binding:"required"`
+	Items           []checkoutItemRequest `json:"items" binding:"required,min=1"`
+}
+
+// shopOrderLines holds the lines of a checkout that belong to one shop
+type shopOrderLines struct {
+	ShopID uuid.UUID
+	Lines  []orderLine
+}
+
+// placedOrder is an order created by a checkout together with its items
+type placedOrder struct {
+	Order *models.Order
+	Items []*models.OrderItem
+}
+
+// CreateCheckout places one order per shop for items from any number of
+// shops and groups them under a single checkout
+func (h *CheckoutHandler) CreateCheckout(c *gin.Context) {
+	var req createCheckoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	// Parse checkout lines
+	lines := make([]orderLine, len(req.Items))
+	expectedShops := make(map[int]uuid.UUID)
+	for i, item := range req.Items {
+		productID, err := uuid.Parse(item.ProductID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product ID: " + item.ProductID})
+			return
+		}
+		if item.ShopID != "" {
+			shopID, err := uuid.Parse(item.ShopID)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid shop ID: " + item.ShopID})
+				return
+			}
+			expectedShops[i] = shopID
+		}
+		lines[i] = orderLine{
+			ProductID:     productID,
+			Quantity:      item.Quantity,
+			ExpectedPrice: item.Price,
+		}
+	}
+
+	// Split the lines by the shop that sells each product
+	products, err := h.store.GetProductsByIDs(c, uniqueProductIDs(lines))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get products"})
+		return
+	}
+	productShops := make(map[uuid.UUID]uuid.UUID, len(products))
+	for _, product := range products {
+		productShops[product.ID] = product.ShopID
+	}
+	for _, product := range products {
+		for i, shopID := range expectedShops {
+			if lines[i].ProductID == product.ID && product.ShopID != shopID {
+				writeOrderError(c, &productShopMismatchError{
+					ProductID:   product.ID,
+					ProductName: product.Name,
+					ShopID:      shopID,
+				})
+				return
+			}
+		}
+	}
+
+	groups, err := groupOrderLines(lines, productShops)
+	if err != nil {
+		writeOrderError(c, err)
+		return
+	}
+
+	checkout := &models.Checkout{
+		UserID:          payload.UserID,
+		ShippingAddress: req.ShippingAddress,
+	}
+
+	var orders []placedOrder
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		orders, err = placeCheckoutTx(c, tx, checkout, groups)
+		return err
+	})
+	if err != nil {
+		writeOrderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, checkoutResponse(checkout, orders))
+}
+
+// GetCheckout returns a checkout with the orders it created
+func (h *CheckoutHandler) GetCheckout(c *gin.Context) {
+	checkoutID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid checkout ID"})
+		return
+	}
+
+	checkout, err := h.store.GetCheckoutByID(c, checkoutID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "checkout not found"})
+		return
+	}
+
+	// Check if user owns the checkout or may view any order
+	if !middlewares.CanAccess(c, checkout.UserID, models.PermOrderReadAny) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to view this checkout"})
+		return
+	}
+
+	orders, err := h.store.GetOrdersByCheckoutID(c, checkoutID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get checkout orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"checkout": checkout,
+		"orders":   orders,
+	})
+}
+
+// groupOrderLines splits lines by the shop that sells each product, keeping
+// the shops in the order they first appear
+func groupOrderLines(lines []orderLine, productShops map[uuid.UUID]uuid.UUID) ([]shopOrderLines, error) {
+	var groups []shopOrderLines
+	index := make(map[uuid.UUID]int)
+	for _, line := range lines {
+		shopID, ok := productShops[line.ProductID]
+		if !ok {
+			return nil, &productNotFoundError{ProductID: line.ProductID}
+		}
+		i, seen := index[shopID]
+		if !seen {
+			i = len(groups)
+			index[shopID] = i
+			groups = append(groups, shopOrderLines{ShopID: shopID})
+		}
+		groups[i].Lines = append(groups[i].Lines, line)
+	}
+	return groups, nil
+}
+
+// placeCheckoutTx inserts the checkout and places one order per shop group
+// under it. It must run inside a transaction.
+func placeCheckoutTx(ctx context.Context, tx *pg.Tx, checkout *models.Checkout, groups []shopOrderLines) ([]placedOrder, error) {
+	if _, err := tx.ModelContext(ctx, checkout).Insert(); err != nil {
+		return nil, err
+	}
+
+	var totalAmount float64
+	orders := make([]placedOrder, 0, len(groups))
+	for _, group := range groups {
+		checkoutID := checkout.ID
+		order := &models.Order{
+			UserID:          checkout.UserID,
+			ShopID:          group.ShopID,
+			ShippingAddress: checkout.ShippingAddress,
+			Status:          models.StatusPending,
+			CheckoutID:      &checkoutID,
+		}
+		items, err := placeOrderTx(ctx, tx, order, group.Lines)
+		if err != nil {
+			return nil, err
+		}
+		totalAmount += order.TotalAmount
+		orders = append(orders, placedOrder{Order: order, Items: items})
+	}
+
+	checkout.TotalAmount = math.Round(totalAmount*100) / 100
+	if _, err := tx.ModelContext(ctx, checkout).Column("total_amount").WherePK().Update(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// uniqueProductIDs returns the distinct product IDs referenced by lines
+func uniqueProductIDs(lines []orderLine) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool, len(lines))
+	ids := make([]uuid.UUID, 0, len(lines))
+	for _, line := range lines {
+		if !seen[line.ProductID] {
+			seen[line.ProductID] = true
+			ids = append(ids, line.ProductID)
+		}
+	}
+	return ids
+}
+
+func checkoutResponse(checkout *models.Checkout, orders []placedOrder) gin.H {
+	orderResponses := make([]gin.H, 0, len(orders))
+	for _, placed := range orders {
+		orderResponses = append(orderResponses, gin.H{
+			"order_id":     placed.Order.ID,
+			"shop_id":      placed.Order.ShopID,
+			"total_amount": placed.Order.TotalAmount,
+			"status":       placed.Order.Status,
+			"items":        placed.Items,
+			"created_at":   placed.Order.CreatedAt,
+		})
+	}
+
+	return gin.H{
+		"checkout_id":  checkout.ID,
+		"total_amount": checkout.TotalAmount,
+		"orders":       orderResponses,
+		"created_at":   checkout.CreatedAt,
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/config"
+	"github.com/qhh/prjEcom/pkg/db"
+	"github.com/qhh/prjEcom/pkg/db/schema"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/payment"
+	"github.com/qhh/prjEcom/pkg/utils"
+)
+
+// Like the store tests, the handler tests that touch the database are
+// skipped unless TEST_DATABASE_URL points at a PostgreSQL database.
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+var (
+	testStore     *store.Store
+	testStoreErr  error
+	testStoreOnce sync.Once
+)
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+
+	source := os.Getenv("TEST_DATABASE_URL")
+	if source == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	testStoreOnce.Do(func() {
+		pgDB, err := db.Connect(&config.Config{DBSource: source})
+		if err != nil {
+			testStoreErr = err
+			return
+		}
+		if err := schema.InitDatabase(pgDB); err != nil {
+			testStoreErr = err
+			return
+		}
+		testStore = store.NewStore(pgDB)
+	})
+	if testStoreErr != nil {
+		t.Fatalf("failed to set up test database: %v", testStoreErr)
+	}
+	return testStore
+}
+
+// testAPI serves handlers behind the authentication middleware, like the
+// /api group of the router
+type testAPI struct {
+	tokens utils.TokenMaker
+	router *gin.Engine
+	api    *gin.RouterGroup
+}
+
+func newTestAPI(t *testing.T, s *store.Store) *testAPI {
+	t.Helper()
+
+	tokens, err := utils.NewJWTMaker("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.Use(middlewares.RequestID())
+	api := router.Group("/api")
+	api.Use(middlewares.AuthMiddleware(tokens, middlewares.NewTokenRevocations(s, 0), middlewares.NewPermissions(s, 0)))
+	return &testAPI{tokens: tokens, router: router, api: api}
+}
+
+// do sends a request as user and returns the response
+func (a *testAPI) do(t *testing.T, user *models.User, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Reset(data)
+	}
+	req := httptest.NewRequest(method, path, &reader)
+	req.Header.Set("Content-Type", "application/json")
+
+	token, err := a.tokens.CreateToken(user.ID, user.Username, string(user.Role), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	return w
+}
+
+// decode reads a JSON response body into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid response body %q: %v", w.Body.String(), err)
+	}
+}
+
+func createTestUser(t *testing.T, s *store.Store, role models.UserRole) *models.User {
+	t.Helper()
+
+	suffix := uuid.NewString()[:8]
+	user := &models.User{
+		Username:     "test-" + suffix,
+		Email:        "test-" + suffix + "@example.com",
+		PasswordHash: "unused",
+		Role:         role,
+	}
+	if err := s.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user
+}
+
+func createTestShop(t *testing.T, s *store.Store, owner *models.User) *models.Shop {
+	t.Helper()
+
+	shop := &models.Shop{UserID: owner.ID, Name: "shop-" + uuid.NewString()[:8]}
+	if err := s.CreateShop(context.Background(), shop); err != nil {
+		t.Fatalf("CreateShop: %v", err)
+	}
+	return shop
+}
+
+func createTestProduct(t *testing.T, s *store.Store, shop *models.Shop, price float64, stock int32) *models.Product {
+	t.Helper()
+
+	product := &models.Product{ShopID: shop.ID, Name: "product-" + uuid.NewString()[:8], Price: price, Stock: stock, Category: "test"}
+	if err := s.CreateProduct(context.Background(), product); err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+	return product
+}
+
+// createTestOrder places a pending order through placeOrderTx
+func createTestOrder(t *testing.T, s *store.Store, buyer *models.User, shop *models.Shop, lines ...orderLine) (*models.Order, []*models.OrderItem) {
+	t.Helper()
+
+	order := &models.Order{UserID: buyer.ID, ShopID: shop.ID, Status: models.StatusPending, ShippingAddress: "1 Test Street"}
+	var items []*models.OrderItem
+	err := s.RunInTransaction(context.Background(), func(tx *pg.Tx) error {
+		var err error
+		items, err = placeOrderTx(context.Background(), tx, order, lines)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("placeOrderTx: %v", err)
+	}
+	return order, items
+}
+
+// createPaidOrder places an order and captures its payment with the fake
+// provider
+func createPaidOrder(t *testing.T, s *store.Store, buyer *models.User, shop *models.Shop, lines ...orderLine) (*models.Order, []*models.OrderItem) {
+	t.Helper()
+	ctx := context.Background()
+
+	order, items := createTestOrder(t, s, buyer, shop, lines...)
+	pay := &models.Payment{
+		OrderID:         order.ID,
+		UserID:          buyer.ID,
+		Provider:        payment.FakeProviderName,
+		ProviderCapture: "fake_cap_" + uuid.NewString(),
+		Amount:          order.TotalAmount,
+		Currency:        "USD",
+		Status:          models.PaymentCaptured,
+	}
+	if err := s.CreatePayment(ctx, pay); err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	paid, err := s.UpdateOrderStatus(ctx, order.ID, models.StatusPaid, &buyer.ID, "paid")
+	if err != nil {
+		t.Fatalf("UpdateOrderStatus: %v", err)
+	}
+	return paid, items
+}
@@ -0,0 +1,489 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/utils"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time
+const recoveryCodeCount = 10
+
+// A user's wrong MFA codes are counted across login challenges and the MFA
+// settings endpoints. After mfaLockoutThreshold of them in a row, every code
+// is refused for mfaLockoutDuration, so starting new challenges doesn't give
+// an attacker more guesses.
+const (
+	mfaLockoutThreshold = 10
+	mfaLockoutDuration  = 15 * time.Minute
+)
+
+var totpCodePattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+type MFAHandler struct {
+	store  *store.Store
+	issuer string
+}
+
+func NewMFAHandler(store *store.Store, issuer string) *MFAHandler {
+	return &MFAHandler{
+		store:  store,
+		issuer: issuer,
+	}
+}
+
+type enrollMFARequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type disableMFARequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type mfaPolicyRequest struct {
+	Role     models.UserRole `json:"role" binding:"required"`
+	Required *bool           `json:"required" binding:"required"`
+}
+
+// GetMFAStatus tells whether the current user has MFA enabled and whether
+// their role requires it
+func (h *MFAHandler) GetMFAStatus(c *gin.Context) {
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	enabled, err := h.store.IsMFAEnabled(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa status"})
+		return
+	}
+
+	required, err := h.store.IsMFARequired(c, models.UserRole(payload.Role))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa status"})
+		return
+	}
+
+	remaining := 0
+	if enabled {
+		remaining, err = h.store.CountUnusedRecoveryCodes(c, payload.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa status"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  enabled,
+		"required":                 required,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// EnrollMFA creates a new TOTP secret for the current user. MFA is enabled
+// once the user confirms a code from their authenticator app.
+func (h *MFAHandler) EnrollMFA(c *gin.Context) {
+	var req enrollMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	user, err := h.store.GetUserByID(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	if err := utils.CheckPassword(req.Password, user.PasswordHash); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password is incorrect"})
+		return
+	}
+
+	enabled, err := h.store.IsMFAEnabled(c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa status"})
+		return
+	}
+	if enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate secret"})
+		return
+	}
+
+	mfa := &models.UserMFA{
+		UserID: user.ID,
+		Secret: secret,
+	}
+	if err := h.store.StartMFAEnrollment(c, mfa); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": utils.TOTPProvisioningURI(h.issuer, user.Username, secret),
+	})
+}
+
+// ConfirmMFA enables MFA with a code from the newly enrolled authenticator
+// and returns the user's recovery codes. They are only shown this once.
+func (h *MFAHandler) ConfirmMFA(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var codes []string
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		mfa, err := h.store.GetUserMFAForUpdateTx(c, tx, payload.UserID)
+		if err != nil {
+			return err
+		}
+		if mfa.EnabledAt != nil {
+			return &mfaError{Status: http.StatusConflict, Message: "two-factor authentication is already enabled"}
+		}
+
+		step, ok := utils.ValidateTOTP(mfa.Secret, req.Code, time.Now())
+		if !ok {
+			return &mfaError{Status: http.StatusBadRequest, Message: "invalid code"}
+		}
+
+		now := time.Now()
+		mfa.EnabledAt = &now
+		mfa.LastUsedStep = step
+		if err := h.store.UpdateUserMFATx(c, tx, mfa); err != nil {
+			return err
+		}
+
+		codes, err = replaceRecoveryCodesTx(c, h.store, tx, payload.UserID)
+		return err
+	})
+
+	if err != nil {
+		writeMFAError(c, err, "failed to enable two-factor authentication")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA turns MFA off for the current user. Users whose role requires
+// MFA can't turn it off.
+func (h *MFAHandler) DisableMFA(c *gin.Context) {
+	var req disableMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	user, err := h.store.GetUserByID(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	if err := utils.CheckPassword(req.Password, user.PasswordHash); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password is incorrect"})
+		return
+	}
+
+	required, err := h.store.IsMFARequired(c, user.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa policy"})
+		return
+	}
+	if required {
+		c.JSON(http.StatusForbidden, gin.H{"error": "two-factor authentication is required for your role"})
+		return
+	}
+
+	valid := false
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		valid, err = verifyMFACodeTx(c, h.store, tx, user.ID, req.Code)
+		if err != nil || !valid {
+			// Failed attempts are committed so they count
+			return err
+		}
+		return h.store.DeleteUserMFATx(c, tx, user.ID)
+	})
+	if err == nil && !valid {
+		err = &mfaError{Status: http.StatusBadRequest, Message: "invalid code"}
+	}
+
+	if err != nil {
+		writeMFAError(c, err, "failed to disable two-factor authentication")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes
+func (h *MFAHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var codes []string
+	valid := false
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		valid, err = verifyMFACodeTx(c, h.store, tx, payload.UserID, req.Code)
+		if err != nil || !valid {
+			// Failed attempts are committed so they count
+			return err
+		}
+
+		codes, err = replaceRecoveryCodesTx(c, h.store, tx, payload.UserID)
+		return err
+	})
+	if err == nil && !valid {
+		err = &mfaError{Status: http.StatusBadRequest, Message: "invalid code"}
+	}
+
+	if err != nil {
+		writeMFAError(c, err, "failed to generate recovery codes")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// GetMFAPolicy lists the roles that have an MFA policy (admin only)
+func (h *MFAHandler) GetMFAPolicy(c *gin.Context) {
+	policies, err := h.store.GetMFAPolicies(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policies)
+}
+
+// UpdateMFAPolicy sets whether a role must use MFA (admin only)
+func (h *MFAHandler) UpdateMFAPolicy(c *gin.Context) {
+	var req mfaPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	if _, err := h.store.GetRole(c, req.Role); err != nil {
+		if err.Error() == "role not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get role"})
+		return
+	}
+
+	// An admin requiring MFA for their own role must have it already, or
+	// they would lock themselves out of the admin routes
+	if *req.Required && models.UserRole(payload.Role) == req.Role {
+		enabled, err := h.store.IsMFAEnabled(c, payload.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get mfa status"})
+			return
+		}
+		if !enabled {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "enable two-factor authentication on your own account first"})
+			return
+		}
+	}
+
+	policy := &models.MFAPolicy{
+		Role:      req.Role,
+		Required:  *req.Required,
+		UpdatedBy: &payload.UserID,
+	}
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		// Locking the role serializes changes to its policy
+		if _, err := h.store.GetRoleForUpdateTx(c, tx, req.Role); err != nil {
+			return err
+		}
+		required, err := h.store.IsMFARequiredTx(c, tx, req.Role)
+		if err != nil {
+			return err
+		}
+
+		if err := h.store.SetMFAPolicyTx(c, tx, policy); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditMFAPolicyUpdate, models.AuditTargetRole, string(policy.Role), gin.H{"mfa_required": required}, gin.H{"mfa_required": policy.Required})
+	})
+	if err != nil {
+		if err.Error() == "role not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update mfa policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// verifyMFACodeTx checks a TOTP code or an unused recovery code for a user
+// with MFA enabled. A TOTP code is only accepted once, and a recovery code
+// is used up. Wrong codes count towards the user's lockout, so callers must
+// commit the transaction when the code is wrong.
+func verifyMFACodeTx(c *gin.Context, store *store.Store, tx *pg.Tx, userID uuid.UUID, code string) (bool, error) {
+	mfa, err := store.GetUserMFAForUpdateTx(c, tx, userID)
+	if err != nil {
+		if err.Error() == "mfa not found" {
+			return false, &mfaError{Status: http.StatusBadRequest, Message: "two-factor authentication is not enabled"}
+		}
+		return false, err
+	}
+	if mfa.EnabledAt == nil {
+		return false, &mfaError{Status: http.StatusBadRequest, Message: "two-factor authentication is not enabled"}
+	}
+
+	now := time.Now()
+	if mfa.LockedUntil != nil && now.Before(*mfa.LockedUntil) {
+		return false, &mfaError{Status: http.StatusTooManyRequests, Message: "too many invalid codes, try again later"}
+	}
+
+	var valid bool
+	if totpCodePattern.MatchString(code) {
+		step, ok := utils.ValidateTOTP(mfa.Secret, code, now)
+		if ok && step > mfa.LastUsedStep {
+			mfa.LastUsedStep = step
+			valid = true
+		}
+	} else {
+		valid, err = store.UseRecoveryCodeTx(c, tx, userID, utils.HashOpaqueToken(utils.NormalizeRecoveryCode(code)))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	recordMFAAttempt(mfa, valid, now)
+	if err := store.UpdateUserMFATx(c, tx, mfa); err != nil {
+		return false, err
+	}
+	return valid, nil
+}
+
+// recordMFAAttempt updates a user's lockout state after a code was checked.
+// A correct code clears the failures; the last of mfaLockoutThreshold wrong
+// codes in a row locks MFA until mfaLockoutDuration after now.
+func recordMFAAttempt(mfa *models.UserMFA, valid bool, now time.Time) {
+	if valid {
+		mfa.FailedAttempts = 0
+		mfa.LockedUntil = nil
+		return
+	}
+
+	mfa.FailedAttempts++
+	if mfa.FailedAttempts >= mfaLockoutThreshold {
+		lockedUntil := now.Add(mfaLockoutDuration)
+		mfa.FailedAttempts = 0
+		mfa.LockedUntil = &lockedUntil
+	}
+}
+
+// replaceRecoveryCodesTx generates a new set of recovery codes for a user
+// and returns them in plain text
+func replaceRecoveryCodesTx(c *gin.Context, store *store.Store, tx *pg.Tx, userID uuid.UUID) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := utils.GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = utils.HashOpaqueToken(code)
+	}
+
+	if err := store.ReplaceRecoveryCodesTx(c, tx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// mfaError is returned from MFA transactions to roll them back with a
+// client error
+type mfaError struct {
+	Status  int
+	Message string
+}
+
+func (e *mfaError) Error() string {
+	return e.Message
+}
+
+// writeMFAError writes the response for an error returned from an MFA
+// transaction
+func writeMFAError(c *gin.Context, err error, fallback string) {
+	var mfaErr *mfaError
+	if errors.As(err, &mfaErr) {
+		c.JSON(mfaErr.Status, gin.H{"error": mfaErr.Message})
+		return
+	}
+	if err.Error() == "mfa not found" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start enrollment first"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+}
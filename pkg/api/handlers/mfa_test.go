@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/utils"
+)
+
+func TestRecordMFAAttemptLocksAfterThreshold(t *testing.T) {
+	now := time.Now()
+	mfa := &models.UserMFA{}
+
+	for i := 1; i < mfaLockoutThreshold; i++ {
+		recordMFAAttempt(mfa, false, now)
+		if mfa.LockedUntil != nil {
+			t.Fatalf("locked after %d wrong codes, want %d", i, mfaLockoutThreshold)
+		}
+		if int(mfa.FailedAttempts) != i {
+			t.Fatalf("FailedAttempts = %d after %d wrong codes", mfa.FailedAttempts, i)
+		}
+	}
+
+	recordMFAAttempt(mfa, false, now)
+	if mfa.LockedUntil == nil {
+		t.Fatalf("not locked after %d wrong codes", mfaLockoutThreshold)
+	}
+	if want := now.Add(mfaLockoutDuration); !mfa.LockedUntil.Equal(want) {
+		t.Errorf("LockedUntil = %s, want %s", mfa.LockedUntil, want)
+	}
+	if mfa.FailedAttempts != 0 {
+		t.Errorf("FailedAttempts = %d after lockout, want 0", mfa.FailedAttempts)
+	}
+}
+
+func TestRecordMFAAttemptCorrectCodeResets(t *testing.T) {
+	now := time.Now()
+	lockedUntil := now.Add(-time.Minute)
+	mfa := &models.UserMFA{FailedAttempts: mfaLockoutThreshold - 1, LockedUntil: &lockedUntil}
+
+	recordMFAAttempt(mfa, true, now)
+	if mfa.FailedAttempts != 0 || mfa.LockedUntil != nil {
+		t.Errorf("after a correct code FailedAttempts = %d, LockedUntil = %v, want 0, nil", mfa.FailedAttempts, mfa.LockedUntil)
+	}
+}
+
+func TestVerifyMFACodeLockout(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	user := createTestUser(t, s, models.RoleSeller)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+
+	// Checks a code the way the handlers do, committing wrong codes
+	verify := func(code string) (bool, error) {
+		var valid bool
+		err := s.RunInTransaction(ctx, func(tx *pg.Tx) error {
+			var err error
+			valid, err = verifyMFACodeTx(c, s, tx, user.ID, code)
+			return err
+		})
+		return valid, err
+	}
+
+	var mfaErr *mfaError
+	if _, err := verify("123456"); !errors.As(err, &mfaErr) || mfaErr.Status != http.StatusBadRequest {
+		t.Fatalf("without MFA error = %v, want not enabled", err)
+	}
+
+	// Enable MFA with a set of recovery codes
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartMFAEnrollment(ctx, &models.UserMFA{UserID: user.ID, Secret: secret}); err != nil {
+		t.Fatalf("StartMFAEnrollment: %v", err)
+	}
+	var codes []string
+	err = s.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		mfa, err := s.GetUserMFAForUpdateTx(ctx, tx, user.ID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		mfa.EnabledAt = &now
+		if err := s.UpdateUserMFATx(ctx, tx, mfa); err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodesTx(c, s, tx, user.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("enabling MFA: %v", err)
+	}
+
+	// Recovery codes work once
+	if valid, err := verify(codes[0]); err != nil || !valid {
+		t.Fatalf("first use of a recovery code = %v, %v", valid, err)
+	}
+	if valid, err := verify(codes[0]); err != nil || valid {
+		t.Fatalf("second use of a recovery code = %v, %v", valid, err)
+	}
+
+	// Wrong codes lock every code out, including correct ones
+	for i := 0; i < mfaLockoutThreshold; i++ {
+		if valid, err := verify("wrong-code"); err != nil || valid {
+			t.Fatalf("wrong code %d = %v, %v", i+1, valid, err)
+		}
+	}
+	if _, err := verify(codes[1]); !errors.As(err, &mfaErr) || mfaErr.Status != http.StatusTooManyRequests {
+		t.Errorf("correct code while locked error = %v, want too many requests", err)
+	}
+	mfa, err := s.GetUserMFA(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mfa.LockedUntil == nil || !mfa.LockedUntil.After(time.Now()) {
+		t.Errorf("LockedUntil = %v, want in the future", mfa.LockedUntil)
+	}
+}
@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -10,6 +13,7 @@ import (
 	"github.com/qhh/prjEcom/pkg/api/middlewares"
 	"github.com/qhh/prjEcom/pkg/db/store"
 	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/utils"
 )
 
 type OrderHandler struct {
@@ -23,9 +27,12 @@ func NewOrderHandler(store *store.Store) *OrderHandler {
 }
 
 type orderItemRequest struct {
-	ProductID string  `json:"product_id" binding:"required"`
-	Quantity  int32   `json:"quantity" binding:"required,min=1"`
-	Price     float64 `json:"price" binding:"required,gt=0"`
+	ProductID string `json:"product_id" binding:"required"`
+	Quantity  int32  `json:"quantity" binding:"required,min=1"`
+	// Price is the unit price the client expects to pay. It is optional and
+	// only used to detect price changes; the charged price always comes from
+	// the product record.
+	Price float64 `json:"price" binding:"omitempty,gt=0"`
 }
 
 type createOrderRequest struct {
@@ -34,6 +41,10 @@ type createOrderRequest struct {
 	Items           []orderItemRequest `json:"items" binding:"required,min=1"`
 }
 
+// priceTolerance is the largest difference between the expected and the
+// current price that is still considered the same price
+const priceTolerance = 0.005
+
 // CreateOrder creates a new order
 func (h *OrderHandler) CreateOrder(c *gin.Context) {
 	var req createOrderRequest
@@ -49,12 +60,6 @@ func (h *OrderHandler) CreateOrder(c *gin.Context) {
 		return
 	}
 
-	// Calculate total amount
-	var totalAmount float64
-	for _, item := range req.Items {
-		totalAmount += item.Price * float64(item.Quantity)
-	}
-
 	// Parse shop ID
 	shopID, err := uuid.Parse(req.ShopID)
 	if err != nil {
@@ -62,6 +67,21 @@ func (h *OrderHandler) CreateOrder(c *gin.Context) {
 		return
 	}
 
+	// Parse order lines
+	lines := make([]orderLine, len(req.Items))
+	for i, item := range req.Items {
+		productID, err := uuid.Parse(item.ProductID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid product ID: " + item.ProductID})
+			return
+		}
+		lines[i] = orderLine{
+			ProductID:     productID,
+			Quantity:      item.Quantity,
+			ExpectedPrice: item.Price,
+		}
+	}
+
 	// Check if shop exists
 	_, err = h.store.GetShopByID(c, shopID)
 	if err != nil {
@@ -73,7 +93,6 @@ func (h *OrderHandler) CreateOrder(c *gin.Context) {
 	order := &models.Order{
 		UserID:          payload.UserID,
 		ShopID:          shopID, // Thêm ShopID
-		TotalAmount:     totalAmount,
 		ShippingAddress: req.ShippingAddress,
 		Status:          models.StatusPending,
 	}
@@ -81,65 +100,14 @@ func (h *OrderHandler) CreateOrder(c *gin.Context) {
 	// Start transaction
 	var orderItems []*models.OrderItem
 	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
-		// Create order
-		if _, err := tx.ModelContext(c, order).Insert(); err != nil {
-			return err
-		}
-
-		// Process order items
-		for _, item := range req.Items {
-			productID, err := uuid.Parse(item.ProductID)
-			if err != nil {
-				return err
-			}
-
-			// Check if product exists and has enough stock
-			product := &models.Product{ID: productID}
-			if err := tx.ModelContext(c, product).WherePK().Select(); err != nil {
-				return err
-			}
-
-			if product.Stock < item.Quantity {
-				return &stockError{
-					ProductName: product.Name,
-					Stock:       product.Stock,
-					Requested:   item.Quantity,
-				}
-			}
-
-			// Add order item
-			orderItem := &models.OrderItem{
-				OrderID:         order.ID,
-				ProductID:       productID,
-				Quantity:        item.Quantity,
-				PriceAtPurchase: item.Price,
-			}
-			if _, err := tx.ModelContext(c, orderItem).Insert(); err != nil {
-				return err
-			}
-			orderItems = append(orderItems, orderItem)
-
-			// Update product stock
-			product.Stock -= item.Quantity
-			if _, err := tx.ModelContext(c, product).WherePK().Update(); err != nil {
-				return err
-			}
-		}
-
-		return nil
+		var err error
+		orderItems, err = placeOrderTx(c, tx, order, lines)
+		return err
 	})
 
 	// Handle errors
 	if err != nil {
-		if stockErr, ok := err.(*stockError); ok {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": stockErr.Error(),
-			})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "failed to create order: " + err.Error(),
-			})
-		}
+		writeOrderError(c, err)
 		return
 	}
 
@@ -147,40 +115,165 @@ func (h *OrderHandler) CreateOrder(c *gin.Context) {
 		"order_id":     order.ID,
 		"total_amount": order.TotalAmount,
 		"status":       order.Status,
+		"items":        orderItems,
 		"created_at":   order.CreatedAt,
 	})
 }
 
-// GetOrder returns a specific order
-func (h *OrderHandler) GetOrder(c *gin.Context) {
-	orderID, err := uuid.Parse(c.Param("id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
-		return
+// orderLine is a single product line to be placed in an order
+type orderLine struct {
+	ProductID     uuid.UUID
+	Quantity      int32
+	ExpectedPrice float64 // zero when the client did not send a price
+}
+
+// priceOrderLines prices each line from its product record and takes the
+// ordered units out of the products' stock. It returns the order total,
+// rounded to cents.
+func priceOrderLines(products map[uuid.UUID]*models.Product, lines []orderLine) (float64, error) {
+	var totalAmount float64
+	for _, line := range lines {
+		product := products[line.ProductID]
+
+		if line.ExpectedPrice > 0 && math.Abs(line.ExpectedPrice-product.Price) > priceTolerance {
+			return 0, &priceChangedError{
+				ProductID:     product.ID,
+				ProductName:   product.Name,
+				ExpectedPrice: line.ExpectedPrice,
+				CurrentPrice:  product.Price,
+			}
+		}
+
+		if product.Stock < line.Quantity {
+			return 0, &stockError{
+				ProductName: product.Name,
+				Stock:       product.Stock,
+				Requested:   line.Quantity,
+			}
+		}
+		product.Stock -= line.Quantity
+
+		totalAmount += product.Price * float64(line.Quantity)
 	}
+	return math.Round(totalAmount*100) / 100, nil
+}
 
-	// Get user from auth payload
-	payload, err := middlewares.GetAuthPayload(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
+// placeOrderTx prices every line from the product records, reserves stock
+// and inserts the order with its items. It must run inside a transaction.
+func placeOrderTx(ctx context.Context, tx *pg.Tx, order *models.Order, lines []orderLine) ([]*models.OrderItem, error) {
+	// Load and lock every product so prices and stock cannot change
+	// while the order is being placed
+	products := make(map[uuid.UUID]*models.Product, len(lines))
+	for _, line := range lines {
+		if _, ok := products[line.ProductID]; ok {
+			continue
+		}
+		product := &models.Product{ID: line.ProductID}
+		if err := tx.ModelContext(ctx, product).WherePK().For("UPDATE").Select(); err != nil {
+			if err == pg.ErrNoRows {
+				return nil, &productNotFoundError{ProductID: line.ProductID}
+			}
+			return nil, err
+		}
+		if product.ShopID != order.ShopID {
+			return nil, &productShopMismatchError{
+				ProductID:   product.ID,
+				ProductName: product.Name,
+				ShopID:      order.ShopID,
+			}
+		}
+		products[line.ProductID] = product
 	}
 
-	// Get order
-	order, err := h.store.GetOrderByID(c, orderID)
+	totalAmount, err := priceOrderLines(products, lines)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
-		return
+		return nil, err
 	}
+	order.TotalAmount = totalAmount
 
-	// Check if user owns the order or is admin
-	if order.UserID != payload.UserID && payload.Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to view this order"})
+	// Create order
+	if _, err := tx.ModelContext(ctx, order).Insert(); err != nil {
+		return nil, err
+	}
+
+	// Record the initial status
+	userID := order.UserID
+	history := &models.OrderStatusHistory{
+		OrderID:   order.ID,
+		ToStatus:  order.Status,
+		ChangedBy: &userID,
+		Note:      "order placed",
+	}
+	if _, err := tx.ModelContext(ctx, history).Insert(); err != nil {
+		return nil, err
+	}
+
+	// Add order items
+	orderItems := make([]*models.OrderItem, 0, len(lines))
+	for _, line := range lines {
+		product := products[line.ProductID]
+
+		orderItem := &models.OrderItem{
+			OrderID:         order.ID,
+			ProductID:       product.ID,
+			Quantity:        line.Quantity,
+			PriceAtPurchase: product.Price,
+		}
+		if _, err := tx.ModelContext(ctx, orderItem).Insert(); err != nil {
+			return nil, err
+		}
+		orderItems = append(orderItems, orderItem)
+	}
+
+	// Update product stock
+	for _, product := range products {
+		if _, err := tx.ModelContext(ctx, product).WherePK().Update(); err != nil {
+			return nil, err
+		}
+	}
+
+	return orderItems, nil
+}
+
+// writeOrderError maps an error from placeOrderTx to an HTTP response
+func writeOrderError(c *gin.Context, err error) {
+	switch e := err.(type) {
+	case *stockError:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": e.Error(),
+		})
+	case *productNotFoundError:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": e.Error(),
+		})
+	case *productShopMismatchError:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      e.Error(),
+			"product_id": e.ProductID,
+		})
+	case *priceChangedError:
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          e.Error(),
+			"product_id":     e.ProductID,
+			"expected_price": e.ExpectedPrice,
+			"current_price":  e.CurrentPrice,
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to create order: " + err.Error(),
+		})
+	}
+}
+
+// GetOrder returns a specific order
+func (h *OrderHandler) GetOrder(c *gin.Context) {
+	order, _, ok := getUserOrder(c, h.store, "view", models.PermOrderReadAny)
+	if !ok {
 		return
 	}
 
 	// Get order items
-	items, err := h.store.GetOrderItems(c, orderID)
+	items, err := h.store.GetOrderItems(c, order.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get order items"})
 		return
@@ -203,7 +296,7 @@ func (h *OrderHandler) GetUserOrders(c *gin.Context) {
 
 	var req struct {
 		Limit  int `form:"limit" binding:"required,min=1,max=100"`
-		Offset int `form:"offset" binding:"required,min=0"`
+		Offset int `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -221,7 +314,8 @@ func (h *OrderHandler) GetUserOrders(c *gin.Context) {
 	c.JSON(http.StatusOK, orders)
 }
 
-// UpdateOrderStatus updates an order's status (admin only)
+// UpdateOrderStatus updates an order's status (users whose role grants
+// order:manage)
 func (h *OrderHandler) UpdateOrderStatus(c *gin.Context) {
 	orderID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
@@ -231,6 +325,7 @@ func (h *OrderHandler) UpdateOrderStatus(c *gin.Context) {
 
 	var req struct {
 		Status string `json:"status" binding:"required,oneof=pending paid shipped delivered canceled"`
+		Note   string `json:"note"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -238,16 +333,160 @@ func (h *OrderHandler) UpdateOrderStatus(c *gin.Context) {
 		return
 	}
 
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
 	// Update order status
-	order, err := h.store.UpdateOrderStatus(c, orderID, models.OrderStatus(req.Status))
+	var order *models.Order
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		order, err = changeOrderStatusTx(c, tx, h.store, orderID, models.OrderStatus(req.Status), payload.UserID, req.Note, nil)
+		return err
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update order status"})
+		writeStatusError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, order)
 }
 
+// CancelOrder lets the buyer cancel their own order while it is still
+// pending or paid
+func (h *OrderHandler) CancelOrder(c *gin.Context) {
+	order, payload, ok := getUserOrder(c, h.store, "cancel", models.PermOrderManage)
+	if !ok {
+		return
+	}
+	orderID := order.ID
+
+	var req struct {
+		Reason string `json:"reason" binding:"required,max=500"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if order.Status != models.StatusPending && order.Status != models.StatusPaid {
+		c.JSON(http.StatusConflict, gin.H{"error": "only pending or paid orders can be canceled"})
+		return
+	}
+
+	// Cancel order
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		order, err = changeOrderStatusTx(c, tx, h.store, orderID, models.StatusCanceled, payload.UserID, req.Reason, nil)
+		return err
+	})
+	if err != nil {
+		writeStatusError(c, err)
+		return
+	}
+
+	cancellation, err := h.store.GetOrderCancellation(c, orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get cancellation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"order":         order,
+		"refund_amount": cancellation.RefundAmount,
+		"refund_status": cancellation.RefundStatus,
+	})
+}
+
+// GetOrderHistory returns the status history of an order
+func (h *OrderHandler) GetOrderHistory(c *gin.Context) {
+	order, _, ok := getUserOrder(c, h.store, "view", models.PermOrderReadAny)
+	if !ok {
+		return
+	}
+
+	history, err := h.store.GetOrderStatusHistory(c, order.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get order history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+// getUserOrder loads the order in the :id parameter and checks that it
+// belongs to the current user or that their role grants perm. It writes the
+// error response and returns false if not.
+func getUserOrder(c *gin.Context, store *store.Store, action string, perm models.Permission) (*models.Order, *utils.Payload, bool) {
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return nil, nil, false
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return nil, nil, false
+	}
+
+	// Get order
+	order, err := store.GetOrderByID(c, orderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return nil, nil, false
+	}
+
+	// Check if user owns the order or may act on any order
+	if !middlewares.CanAccess(c, order.UserID, perm) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to " + action + " this order"})
+		return nil, nil, false
+	}
+
+	return order, payload, true
+}
+
+// changeOrderStatusTx moves an order to status and records the change in
+// the audit log. extra is added to the audit snapshot after the change.
+func changeOrderStatusTx(c *gin.Context, tx *pg.Tx, store *store.Store, orderID uuid.UUID, status models.OrderStatus, actorID uuid.UUID, note string, extra gin.H) (*models.Order, error) {
+	current, err := store.GetOrderForUpdateTx(c, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	before := gin.H{"status": current.Status}
+
+	order, err := store.UpdateOrderStatusTx(c, tx, orderID, status, &actorID, note)
+	if err != nil {
+		return nil, err
+	}
+
+	after := gin.H{"status": order.Status, "note": note}
+	for key, value := range extra {
+		after[key] = value
+	}
+	if err := recordAuditTx(c, tx, store, models.AuditOrderStatusChange, models.AuditTargetOrder, orderID.String(), before, after); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// writeStatusError maps an error from a status change to an HTTP response
+func writeStatusError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidStatusTransition):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err.Error() == "order not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update order status"})
+	}
+}
+
 // stockError is a custom error type for insufficient stock
 type stockError struct {
 	ProductName string
@@ -259,3 +498,38 @@ func (e *stockError) Error() string {
 	return fmt.Sprintf("insufficient stock for product: %s (available: %d, requested: %d)",
 		e.ProductName, e.Stock, e.Requested)
 }
+
+// priceChangedError is returned when the price a client expects to pay
+// no longer matches the current product price
+type priceChangedError struct {
+	ProductID     uuid.UUID
+	ProductName   string
+	ExpectedPrice float64
+	CurrentPrice  float64
+}
+
+func (e *priceChangedError) Error() string {
+	return fmt.Sprintf("price changed for product: %s (expected: %.2f, current: %.2f)",
+		e.ProductName, e.ExpectedPrice, e.CurrentPrice)
+}
+
+// productNotFoundError is returned when an order references a missing product
+type productNotFoundError struct {
+	ProductID uuid.UUID
+}
+
+func (e *productNotFoundError) Error() string {
+	return fmt.Sprintf("product not found: %s", e.ProductID)
+}
+
+// productShopMismatchError is returned when an order line references a
+// product that is not sold by the order's shop
+type productShopMismatchError struct {
+	ProductID   uuid.UUID
+	ProductName string
+	ShopID      uuid.UUID
+}
+
+func (e *productShopMismatchError) Error() string {
+	return fmt.Sprintf("product %s does not belong to shop %s", e.ProductName, e.ShopID)
+}
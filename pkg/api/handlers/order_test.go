@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+func TestWriteOrderError(t *testing.T) {
+	productID := uuid.New()
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&stockError{ProductName: "mug", Stock: 1, Requested: 2}, http.StatusBadRequest},
+		{&productNotFoundError{ProductID: productID}, http.StatusNotFound},
+		{&productShopMismatchError{ProductID: productID}, http.StatusBadRequest},
+		{&priceChangedError{ProductID: productID, ExpectedPrice: 9.99, CurrentPrice: 12.5}, http.StatusConflict},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeOrderError(c, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("%T: status = %d, want %d", tt.err, w.Code, tt.status)
+		}
+	}
+
+	// A price change tells the client the price it would pay now
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeOrderError(c, &priceChangedError{ProductID: productID, ExpectedPrice: 9.99, CurrentPrice: 12.5})
+	var body struct {
+		ProductID    uuid.UUID `json:"product_id"`
+		CurrentPrice float64   `json:"current_price"`
+	}
+	decode(t, w, &body)
+	if body.ProductID != productID || body.CurrentPrice != 12.5 {
+		t.Errorf("body = %+v, want product %s at 12.5", body, productID)
+	}
+}
+
+func TestPriceOrderLines(t *testing.T) {
+	newProducts := func() map[uuid.UUID]*models.Product {
+		mug := &models.Product{ID: uuid.New(), Name: "mug", Price: 19.99, Stock: 10}
+		pen := &models.Product{ID: uuid.New(), Name: "pen", Price: 0.35, Stock: 10}
+		return map[uuid.UUID]*models.Product{mug.ID: mug, pen.ID: pen}
+	}
+	find := func(products map[uuid.UUID]*models.Product, name string) *models.Product {
+		for _, product := range products {
+			if product.Name == name {
+				return product
+			}
+		}
+		t.Fatalf("no product %s", name)
+		return nil
+	}
+
+	// Prices come from the product records, whatever the client expects,
+	// and the total is rounded to cents
+	products := newProducts()
+	mug, pen := find(products, "mug"), find(products, "pen")
+	total, err := priceOrderLines(products, []orderLine{
+		{ProductID: mug.ID, Quantity: 3},
+		{ProductID: pen.ID, Quantity: 7, ExpectedPrice: 0.351},
+	})
+	if err != nil || total != 62.42 {
+		t.Errorf("total = %.2f, %v, want 62.42", total, err)
+	}
+	if mug.Stock != 7 || pen.Stock != 3 {
+		t.Errorf("stock = %d and %d, want 7 and 3", mug.Stock, pen.Stock)
+	}
+
+	// The same product on two lines draws from the same stock
+	products = newProducts()
+	mug = find(products, "mug")
+	_, err = priceOrderLines(products, []orderLine{{ProductID: mug.ID, Quantity: 6}, {ProductID: mug.ID, Quantity: 6}})
+	if e, ok := err.(*stockError); !ok || e.Stock != 4 || e.Requested != 6 {
+		t.Errorf("two lines over stock error = %v, want 4 left for 6 requested", err)
+	}
+
+	// A price that moved by more than the tolerance is rejected
+	products = newProducts()
+	mug = find(products, "mug")
+	_, err = priceOrderLines(products, []orderLine{{ProductID: mug.ID, Quantity: 1, ExpectedPrice: 17.99}})
+	if e, ok := err.(*priceChangedError); !ok || e.ProductID != mug.ID || e.CurrentPrice != 19.99 {
+		t.Errorf("price changed error = %v, want current price 19.99", err)
+	}
+}
+
+func TestWriteStatusError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{models.StatusPending.ValidateTransition(models.StatusShipped), http.StatusConflict},
+		{fmt.Errorf("cancel: %w", models.ErrInvalidStatusTransition), http.StatusConflict},
+		{errors.New("order not found"), http.StatusNotFound},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeStatusError(c, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("%v: status = %d, want %d", tt.err, w.Code, tt.status)
+		}
+	}
+}
+
+func TestPlaceOrderPricing(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	seller := createTestUser(t, s, models.RoleSeller)
+	buyer := createTestUser(t, s, models.RoleBuyer)
+	shop := createTestShop(t, s, seller)
+	mug := createTestProduct(t, s, shop, 19.99, 10)
+	pen := createTestProduct(t, s, shop, 0.35, 10)
+
+	// Prices come from the product records, whatever the client expects
+	order, items := createTestOrder(t, s, buyer, shop,
+		orderLine{ProductID: mug.ID, Quantity: 3},
+		orderLine{ProductID: pen.ID, Quantity: 7, ExpectedPrice: 0.351},
+	)
+	if order.TotalAmount != 62.42 {
+		t.Errorf("TotalAmount = %.2f, want 62.42", order.TotalAmount)
+	}
+	if len(items) != 2 || items[0].PriceAtPurchase != 19.99 || items[1].PriceAtPurchase != 0.35 {
+		t.Errorf("items = %+v, want prices 19.99 and 0.35", items)
+	}
+	if stored, err := s.GetProductByID(ctx, mug.ID); err != nil || stored.Stock != 7 {
+		t.Errorf("mug stock after order = %v, err = %v, want 7", stored, err)
+	}
+
+	// A bad line fails the whole order and reserves nothing
+	otherShop := createTestShop(t, s, seller)
+	elsewhere := createTestProduct(t, s, otherShop, 5, 10)
+	tests := []struct {
+		name  string
+		lines []orderLine
+		check func(error) bool
+	}{
+		{"price changed", []orderLine{{ProductID: pen.ID, Quantity: 1}, {ProductID: mug.ID, Quantity: 1, ExpectedPrice: 17.99}}, func(err error) bool {
+			e, ok := err.(*priceChangedError)
+			return ok && e.ProductID == mug.ID && e.CurrentPrice == 19.99
+		}},
+		{"out of stock", []orderLine{{ProductID: pen.ID, Quantity: 1}, {ProductID: mug.ID, Quantity: 8}}, func(err error) bool {
+			_, ok := err.(*stockError)
+			return ok
+		}},
+		{"other shop", []orderLine{{ProductID: pen.ID, Quantity: 1}, {ProductID: elsewhere.ID, Quantity: 1}}, func(err error) bool {
+			_, ok := err.(*productShopMismatchError)
+			return ok
+		}},
+		{"unknown product", []orderLine{{ProductID: pen.ID, Quantity: 1}, {ProductID: uuid.New(), Quantity: 1}}, func(err error) bool {
+			_, ok := err.(*productNotFoundError)
+			return ok
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				order := &models.Order{UserID: buyer.ID, ShopID: shop.ID, Status: models.StatusPending, ShippingAddress: "1 Test Street"}
+				_, err := placeOrderTx(ctx, tx, order, tt.lines)
+				return err
+			})
+			if !tt.check(err) {
+				t.Errorf("placeOrderTx error = %v (%T)", err, err)
+			}
+			if stored, err := s.GetProductByID(ctx, pen.ID); err != nil || stored.Stock != 3 {
+				t.Errorf("pen stock after failed order = %v, err = %v, want 3", stored, err)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	admin := createTestUser(t, s, models.RoleAdmin)
+	seller := createTestUser(t, s, models.RoleSeller)
+	buyer := createTestUser(t, s, models.RoleBuyer)
+	shop := createTestShop(t, s, seller)
+	product := createTestProduct(t, s, shop, 10, 5)
+	order, _ := createTestOrder(t, s, buyer, shop, orderLine{ProductID: product.ID, Quantity: 2})
+
+	a := newTestAPI(t, s)
+	a.api.PUT("/orders/:id/status", middlewares.RequirePermission(models.PermOrderManage), NewOrderHandler(s).UpdateOrderStatus)
+	path := "/api/orders/" + order.ID.String() + "/status"
+
+	steps := []struct {
+		status string
+		code   int
+	}{
+		{"shipped", http.StatusConflict}, // not paid yet
+		{"paid", http.StatusOK},
+		{"paid", http.StatusConflict},
+		{"shipped", http.StatusOK},
+		{"canceled", http.StatusConflict}, // too late to cancel
+		{"delivered", http.StatusOK},
+		{"pending", http.StatusConflict},
+	}
+	for _, step := range steps {
+		w := a.do(t, admin, http.MethodPut, path, gin.H{"status": step.status})
+		if w.Code != step.code {
+			t.Fatalf("move to %s: status = %d, want %d: %s", step.status, w.Code, step.code, w.Body.String())
+		}
+	}
+
+	history, err := s.GetOrderStatusHistory(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.OrderStatus{models.StatusPending, models.StatusPaid, models.StatusShipped, models.StatusDelivered}
+	if len(history) != len(want) {
+		t.Fatalf("history has %d entries, want %d", len(history), len(want))
+	}
+	for i, entry := range history {
+		if entry.ToStatus != want[i] {
+			t.Errorf("history[%d] = %s, want %s", i, entry.ToStatus, want[i])
+		}
+	}
+
+	// Only the changes that happened are audited
+	events, err := s.ListAuditEvents(ctx, store.AuditFilter{
+		Action:   models.AuditOrderStatusChange,
+		TargetID: order.ID.String(),
+	}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Errorf("%d status change events, want 3", len(events))
+	}
+	for _, event := range events {
+		if event.ActorID != admin.ID || event.RequestID == "" {
+			t.Errorf("event actor = %s, request ID = %q, want %s and an ID", event.ActorID, event.RequestID, admin.ID)
+		}
+	}
+
+	// Only users whose role may manage orders can move them
+	if w := a.do(t, buyer, http.MethodPut, path, gin.H{"status": "canceled"}); w.Code != http.StatusForbidden {
+		t.Errorf("buyer: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := a.do(t, admin, http.MethodPut, "/api/orders/"+uuid.NewString()+"/status", gin.H{"status": "paid"}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown order: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/mailer"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/utils"
+)
+
+type PasswordHandler struct {
+	store         *store.Store
+	mailer        mailer.Mailer
+	revocations   *middlewares.TokenRevocations
+	baseURL       string
+	resetDuration time.Duration
+}
+
+func NewPasswordHandler(store *store.Store, mailer mailer.Mailer, revocations *middlewares.TokenRevocations, baseURL string, resetDuration time.Duration) *PasswordHandler {
+	return &PasswordHandler{
+		store:         store,
+		mailer:        mailer,
+		revocations:   revocations,
+		baseURL:       baseURL,
+		resetDuration: resetDuration,
+	}
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// ForgotPassword emails a password reset link. The response is the same
+// whether or not the email belongs to an account, so it can't be used to
+// find out who is registered.
+func (h *PasswordHandler) ForgotPassword(c *gin.Context) {
+	var req forgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "if an account with this email exists, a password reset link has been sent"}
+
+	user, err := h.store.GetUserByEmail(c, req.Email)
+	if err != nil {
+		if err.Error() != "user not found" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+			return
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	if user.IsBanned {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	token, hash, err := utils.NewOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create reset token"})
+		return
+	}
+
+	resetToken := &models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(h.resetDuration),
+	}
+	if err := h.store.CreatePasswordResetToken(c, resetToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create reset token"})
+		return
+	}
+
+	link := h.baseURL + "/reset-password?token=" + url.QueryEscape(token)
+	err = h.mailer.Send(c, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s and works once.\n\n%s\n\nYour reset code: %s\n\nIf you didn't ask to reset your password, you can ignore this email.\n",
+			user.Username, h.resetDuration, link, token),
+	})
+	if err != nil {
+		// Don't reveal that the account exists
+		log.Printf("Failed to send password reset email to user %s: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword and
+// logs the user out of all sessions
+func (h *PasswordHandler) ResetPassword(c *gin.Context) {
+	var req resetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Hash password
+	hashedPassword, err := utils.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	var userID uuid.UUID
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		token, err := h.store.GetPasswordResetTokenForUpdateTx(c, tx, utils.HashOpaqueToken(req.Token))
+		if err != nil {
+			return err
+		}
+		if token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+			return errors.New("password reset token not found")
+		}
+		userID = token.UserID
+
+		if err := h.store.UpdateUserPasswordTx(c, tx, token.UserID, hashedPassword); err != nil {
+			return err
+		}
+		return h.store.MarkPasswordResetTokenUsedTx(c, tx, token.ID)
+	})
+
+	if err != nil {
+		if err.Error() == "password reset token not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired reset token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+	h.revocations.Forget(userID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "password has been reset, please log in again"})
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/payment"
+)
+
+type PaymentHandler struct {
+	store    *store.Store
+	payments *payment.Registry
+	currency string
+}
+
+func NewPaymentHandler(store *store.Store, payments *payment.Registry, currency string) *PaymentHandler {
+	return &PaymentHandler{
+		store:    store,
+		payments: payments,
+		currency: currency,
+	}
+}
+
+type payOrderRequest struct {
+	PaymentMethod string `json:"payment_method" binding:"required"`
+}
+
+// PayOrder charges the buyer for a pending order and marks it paid once the
+// payment has been captured
+func (h *PaymentHandler) PayOrder(c *gin.Context) {
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	var req payOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	// Get order
+	order, err := h.store.GetOrderByID(c, orderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+
+	// Check if user owns the order
+	if order.UserID != payload.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to pay for this order"})
+		return
+	}
+
+	if order.Status != models.StatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "only pending orders can be paid"})
+		return
+	}
+
+	// Buyers can't choose the provider; it is set by PAYMENT_PROVIDER
+	provider, err := h.payments.Default()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	pay := &models.Payment{
+		OrderID:  order.ID,
+		UserID:   payload.UserID,
+		Provider: provider.Name(),
+		Amount:   order.TotalAmount,
+		Currency: h.currency,
+	}
+
+	// Authorize the full order amount
+	authorization, err := provider.Authorize(c, payment.AuthorizeRequest{
+		OrderID:       order.ID.String(),
+		Amount:        order.TotalAmount,
+		Currency:      h.currency,
+		PaymentMethod: req.PaymentMethod,
+	})
+	if err != nil {
+		pay.Status = models.PaymentFailed
+		pay.FailureReason = err.Error()
+		if err := h.store.CreatePayment(c, pay); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record payment"})
+			return
+		}
+		writePaymentError(c, err, pay)
+		return
+	}
+
+	pay.ProviderAuthorization = authorization.TransactionID
+	pay.Status = models.PaymentAuthorized
+	if err := h.store.CreatePayment(c, pay); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record payment"})
+		return
+	}
+
+	// Capture the authorized amount
+	capture, err := provider.Capture(c, authorization.TransactionID, pay.Amount)
+	if err != nil {
+		pay.Status = models.PaymentFailed
+		pay.FailureReason = err.Error()
+		if err := h.store.UpdatePayment(c, pay); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record payment"})
+			return
+		}
+		writePaymentError(c, err, pay)
+		return
+	}
+
+	pay.ProviderCapture = capture.TransactionID
+	order, err = h.store.CapturePayment(c, pay, &payload.UserID)
+	if err != nil {
+		// The money was taken but the order could not be marked paid, most
+		// likely because it changed status meanwhile. Give the money back.
+		pay.Status = models.PaymentFailed
+		pay.FailureReason = err.Error()
+		if _, refundErr := provider.Refund(c, capture.TransactionID, pay.Amount, pay.ID.String()); refundErr != nil {
+			pay.FailureReason += "; refund failed: " + refundErr.Error()
+		}
+		_ = h.store.UpdatePayment(c, pay)
+		writeStatusError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"payment": pay,
+		"order":   order,
+	})
+}
+
+// GetOrderPayments returns the payment attempts for an order
+func (h *PaymentHandler) GetOrderPayments(c *gin.Context) {
+	order, _, ok := getUserOrder(c, h.store, "view", models.PermOrderReadAny)
+	if !ok {
+		return
+	}
+
+	payments, err := h.store.GetPaymentsByOrderID(c, order.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get payments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, payments)
+}
+
+// writePaymentError maps a provider error to an HTTP response
+func writePaymentError(c *gin.Context, err error, pay *models.Payment) {
+	if errors.Is(err, payment.ErrPaymentDeclined) {
+		c.JSON(http.StatusPaymentRequired, gin.H{
+			"error":      "payment declined",
+			"payment_id": pay.ID,
+		})
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{
+		"error":      "payment provider error: " + err.Error(),
+		"payment_id": pay.ID,
+	})
+}
@@ -5,8 +5,8 @@ import (
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
-	"github.com/qhh/prjEcom/pkg/api/middlewares"
 	"github.com/qhh/prjEcom/pkg/db/store"
 	"github.com/qhh/prjEcom/pkg/models"
 )
@@ -39,13 +39,6 @@ func (h *ProductHandler) CreateProduct(c *gin.Context) {
 		return
 	}
 
-	// Get user from auth payload
-	payload, err := middlewares.GetAuthPayload(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
-	}
-
 	// Parse shop ID
 	shopID, err := uuid.Parse(req.ShopID)
 	if err != nil {
@@ -53,15 +46,16 @@ func (h *ProductHandler) CreateProduct(c *gin.Context) {
 		return
 	}
 
-	// Check if shop exists and belongs to user
+	// Check if shop exists
 	shop, err := h.store.GetShopByID(c, shopID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "shop not found"})
 		return
 	}
 
-	// Check if user owns the shop or is admin
-	if shop.UserID != payload.UserID && payload.Role != "admin" {
+	// Check if user's shop role allows managing products or they may manage
+	// any catalog
+	if !canAccessShop(c, h.store, shop.ID, models.PermProductWrite, models.PermProductWriteAny) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to create products in this shop"})
 		return
 	}
@@ -107,7 +101,7 @@ func (h *ProductHandler) GetProduct(c *gin.Context) {
 func (h *ProductHandler) ListProducts(c *gin.Context) {
 	var req struct {
 		Limit  int `form:"limit" binding:"required,min=1,max=100"`
-		Offset int `form:"offset" binding:"required,min=0"`
+		Offset int `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -129,7 +123,7 @@ func (h *ProductHandler) SearchProducts(c *gin.Context) {
 	var req struct {
 		Query  string `form:"q" binding:"required,min=1"`
 		Limit  int    `form:"limit" binding:"required,min=1,max=100"`
-		Offset int    `form:"offset" binding:"required,min=0"`
+		Offset int    `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -156,7 +150,7 @@ func (h *ProductHandler) ListProductsByShop(c *gin.Context) {
 
 	var req struct {
 		Limit  int `form:"limit" binding:"required,min=1,max=100"`
-		Offset int `form:"offset" binding:"required,min=0"`
+		Offset int `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -183,7 +177,7 @@ func (h *ProductHandler) FilterProductsByCategory(c *gin.Context) {
 
 	var req struct {
 		Limit  int `form:"limit" binding:"required,min=1,max=100"`
-		Offset int `form:"offset" binding:"required,min=0"`
+		Offset int `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -229,7 +223,7 @@ func (h *ProductHandler) FilterProductsByPrice(c *gin.Context) {
 
 	var req struct {
 		Limit  int `form:"limit" binding:"required,min=1,max=100"`
-		Offset int `form:"offset" binding:"required,min=0"`
+		Offset int `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -260,13 +254,6 @@ func (h *ProductHandler) UpdateProduct(c *gin.Context) {
 		return
 	}
 
-	// Get user from auth payload
-	payload, err := middlewares.GetAuthPayload(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
-	}
-
 	// Get product to check ownership
 	product, err := h.store.GetProductByID(c, productID)
 	if err != nil {
@@ -274,15 +261,9 @@ func (h *ProductHandler) UpdateProduct(c *gin.Context) {
 		return
 	}
 
-	// Get shop to check ownership
-	shop, err := h.store.GetShopByID(c, product.ShopID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shop"})
-		return
-	}
-
-	// Check if user owns the shop or is admin
-	if shop.UserID != payload.UserID && payload.Role != "admin" {
+	// Check if user's shop role allows managing products or they may manage
+	// any catalog
+	if !canAccessShop(c, h.store, product.ShopID, models.PermProductWrite, models.PermProductWriteAny) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to update this product"})
 		return
 	}
@@ -312,13 +293,6 @@ func (h *ProductHandler) DeleteProduct(c *gin.Context) {
 		return
 	}
 
-	// Get user from auth payload
-	payload, err := middlewares.GetAuthPayload(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
-	}
-
 	// Get product to check ownership
 	product, err := h.store.GetProductByID(c, productID)
 	if err != nil {
@@ -326,22 +300,29 @@ func (h *ProductHandler) DeleteProduct(c *gin.Context) {
 		return
 	}
 
-	// Get shop to check ownership
-	shop, err := h.store.GetShopByID(c, product.ShopID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shop"})
-		return
-	}
-
-	// Check if user owns the shop or is admin
-	if shop.UserID != payload.UserID && payload.Role != "admin" {
+	// Check if user's shop role allows managing products or they may manage
+	// any catalog
+	if !canAccessShop(c, h.store, product.ShopID, models.PermProductWrite, models.PermProductWriteAny) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to delete this product"})
 		return
 	}
 
 	// Delete product
-	err = h.store.DeleteProduct(c, productID)
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		product, err := h.store.GetProductForUpdateTx(c, tx, productID)
+		if err != nil {
+			return err
+		}
+		if err := h.store.DeleteProductTx(c, tx, productID); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditProductDelete, models.AuditTargetProduct, productID.String(), product, nil)
+	})
 	if err != nil {
+		if err.Error() == "product not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete product"})
 		return
 	}
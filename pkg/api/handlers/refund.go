@@ -0,0 +1,493 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/payment"
+)
+
+type RefundHandler struct {
+	store    *store.Store
+	payments *payment.Registry
+}
+
+func NewRefundHandler(store *store.Store, payments *payment.Registry) *RefundHandler {
+	return &RefundHandler{
+		store:    store,
+		payments: payments,
+	}
+}
+
+type refundItemRequest struct {
+	OrderItemID string `json:"order_item_id" binding:"required"`
+	Quantity    int32  `json:"quantity" binding:"required,min=1"`
+	Restock     bool   `json:"restock"`
+}
+
+type createRefundRequest struct {
+	// Amount is optional when items are given; it defaults to the value of
+	// the refunded items
+	Amount float64             `json:"amount" binding:"omitempty,gt=0"`
+	Reason string              `json:"reason" binding:"required,max=500"`
+	Items  []refundItemRequest `json:"items" binding:"omitempty,dive"`
+}
+
+// refundLine is a parsed refund item request
+type refundLine struct {
+	OrderItemID uuid.UUID
+	Quantity    int32
+	Restock     bool
+}
+
+// refundableStatuses are the order statuses that allow a refund
+var refundableStatuses = map[models.OrderStatus]bool{
+	models.StatusPaid:      true,
+	models.StatusShipped:   true,
+	models.StatusDelivered: true,
+	models.StatusCanceled:  true,
+}
+
+// CreateRefund returns money to the buyer for a whole order, some of its
+// items, or an arbitrary amount (staff of the order's shop whose shop role
+// allows refunds, or users who may refund any order)
+func (h *RefundHandler) CreateRefund(c *gin.Context) {
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	var req createRefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	lines := make([]refundLine, len(req.Items))
+	for i, item := range req.Items {
+		itemID, err := uuid.Parse(item.OrderItemID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order item ID: " + item.OrderItemID})
+			return
+		}
+		lines[i] = refundLine{OrderItemID: itemID, Quantity: item.Quantity, Restock: item.Restock}
+	}
+
+	if req.Amount == 0 && len(lines) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "amount or items are required"})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	// Get order
+	order, err := h.store.GetOrderByID(c, orderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+
+	// Check if user's shop role allows refunds or they may refund any order
+	if !canAccessShop(c, h.store, order.ShopID, models.PermOrderRefund, models.PermOrderRefundAny) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to refund this order"})
+		return
+	}
+
+	// Reserve the refund, return the money, then record the outcome
+	var refund *models.Refund
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		refund, err = h.prepareRefundTx(c, tx, orderID, req.Amount, req.Reason, lines, &payload.UserID)
+		return err
+	})
+	if err == nil {
+		err = h.finishRefund(c, refund, &payload.UserID)
+	}
+
+	if err != nil {
+		writeRefundError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, refund)
+}
+
+// ResumeRefund finishes a refund left pending, for instance because the
+// server stopped after the payment provider returned the money but before
+// the refund was recorded (same permissions as CreateRefund)
+func (h *RefundHandler) ResumeRefund(c *gin.Context) {
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+	refundID, err := uuid.Parse(c.Param("refund_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid refund ID"})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	// Get order
+	order, err := h.store.GetOrderByID(c, orderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+
+	// Check if user's shop role allows refunds or they may refund any order
+	if !canAccessShop(c, h.store, order.ShopID, models.PermOrderRefund, models.PermOrderRefundAny) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to refund this order"})
+		return
+	}
+
+	refund, err := h.store.GetRefundByID(c, refundID)
+	if err != nil || refund.OrderID != orderID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "refund not found"})
+		return
+	}
+	if refund.Status != models.RefundPending {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("refund is already %s", refund.Status)})
+		return
+	}
+
+	if err := h.finishRefund(c, refund, &payload.UserID); err != nil {
+		writeRefundError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, refund)
+}
+
+// GetOrderRefunds lists the refunds of an order
+func (h *RefundHandler) GetOrderRefunds(c *gin.Context) {
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return
+	}
+
+	// Get order
+	order, err := h.store.GetOrderByID(c, orderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+
+	// Buyers, the shop's fulfillment staff and users who may view any order
+	// can see refunds
+	if !middlewares.CanAccess(c, order.UserID, models.PermOrderReadAny) &&
+		!canAccessShop(c, h.store, order.ShopID, models.PermOrderFulfill, models.PermShopManageAny) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to view this order"})
+		return
+	}
+
+	refunds, err := h.store.GetRefundsByOrderID(c, orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get refunds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, refunds)
+}
+
+// prepareRefundTx validates a refund and records it as pending, which
+// reserves its amount and items so that concurrent refunds can't exceed the
+// order. The money is returned by sendRefund once the transaction has
+// committed. It must run inside a transaction.
+func (h *RefundHandler) prepareRefundTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID, amount float64, reason string, lines []refundLine, actor *uuid.UUID) (*models.Refund, error) {
+	order, err := h.store.GetOrderForUpdateTx(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !refundableStatuses[order.Status] {
+		return nil, &refundError{Status: http.StatusConflict, Message: fmt.Sprintf("orders in status %s cannot be refunded", order.Status)}
+	}
+
+	// Canceled orders can only be refunded if they were paid
+	if order.Status == models.StatusCanceled {
+		cancellation, err := h.store.GetOrderCancellation(ctx, orderID)
+		if err != nil {
+			return nil, err
+		}
+		if cancellation.RefundStatus != models.RefundPending {
+			return nil, &refundError{Status: http.StatusConflict, Message: "this canceled order has no pending refund"}
+		}
+	}
+
+	items, err := h.store.GetOrderItemsTx(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	refundedQuantities, err := h.store.GetRefundedQuantitiesTx(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	refundedAmount, err := h.store.GetRefundedAmountTx(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	refund := &models.Refund{
+		OrderID:   orderID,
+		Reason:    reason,
+		Status:    models.RefundPending,
+		CreatedBy: actor,
+	}
+	if err := priceRefund(refund, order, items, refundedQuantities, refundedAmount, amount, lines); err != nil {
+		return nil, err
+	}
+
+	// The money goes back through the provider that captured it
+	pay, err := h.store.GetCapturedPaymentTx(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if pay != nil {
+		paymentID := pay.ID
+		refund.PaymentID = &paymentID
+	}
+
+	if err := h.store.CreateRefundTx(ctx, tx, refund); err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// priceRefund checks the refunded lines and amount against what is left to
+// refund of the order, given the quantities and amount of its earlier
+// refunds, and sets the refund's items and amount. Without an amount, the
+// refund is the value of its items.
+func priceRefund(refund *models.Refund, order *models.Order, items []*models.OrderItem, refundedQuantities map[uuid.UUID]int32, refundedAmount, amount float64, lines []refundLine) error {
+	itemsByID := make(map[uuid.UUID]*models.OrderItem, len(items))
+	for _, item := range items {
+		itemsByID[item.ID] = item
+	}
+
+	// Validate the refunded lines
+	var itemsAmount float64
+	for _, line := range lines {
+		item, ok := itemsByID[line.OrderItemID]
+		if !ok {
+			return &refundError{Status: http.StatusBadRequest, Message: "order item not found: " + line.OrderItemID.String()}
+		}
+
+		remaining := item.Quantity - refundedQuantities[item.ID]
+		if line.Quantity > remaining {
+			return &refundError{Status: http.StatusBadRequest, Message: fmt.Sprintf("cannot refund %d units of order item %s (refundable: %d)", line.Quantity, item.ID, remaining)}
+		}
+		refundedQuantities[item.ID] += line.Quantity
+
+		// Stock of canceled orders has already been returned
+		if line.Restock && order.Status == models.StatusCanceled {
+			return &refundError{Status: http.StatusBadRequest, Message: "items of a canceled order have already been restocked"}
+		}
+
+		lineAmount := math.Round(float64(line.Quantity)*item.PriceAtPurchase*100) / 100
+		itemsAmount += lineAmount
+		refund.Items = append(refund.Items, &models.RefundItem{
+			OrderItemID: item.ID,
+			Quantity:    line.Quantity,
+			Amount:      lineAmount,
+			Restocked:   line.Restock,
+		})
+	}
+
+	if amount == 0 {
+		amount = itemsAmount
+	}
+	refund.Amount = math.Round(amount*100) / 100
+
+	refundable := math.Round((order.TotalAmount-refundedAmount)*100) / 100
+	if refund.Amount > refundable+priceTolerance {
+		return &refundError{Status: http.StatusBadRequest, Message: fmt.Sprintf("refund amount %.2f exceeds refundable amount %.2f", refund.Amount, refundable)}
+	}
+	return nil
+}
+
+// finishRefund sends a pending refund and records it as completed
+func (h *RefundHandler) finishRefund(c *gin.Context, refund *models.Refund, actor *uuid.UUID) error {
+	if err := h.sendRefund(c, refund); err != nil {
+		return err
+	}
+	return h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		return h.completeRefundTx(c, tx, refund, actor)
+	})
+}
+
+// sendRefund returns the money of a pending refund through the payment
+// provider. It runs outside any transaction so that no locks are held while
+// waiting for the provider. The provider's refund ID is saved as soon as it
+// accepts the refund, and a refund that already has one is not sent again;
+// otherwise the refund ID is the idempotency key, so a refund left pending
+// can be sent again without paying twice. If the provider rejects the
+// refund, it is marked failed.
+func (h *RefundHandler) sendRefund(ctx context.Context, refund *models.Refund) error {
+	if refund.PaymentID == nil || refund.ProviderRefundID != "" {
+		return nil
+	}
+
+	pay, err := h.store.GetPaymentByID(ctx, *refund.PaymentID)
+	if err != nil {
+		return err
+	}
+	provider, err := h.payments.Get(pay.Provider)
+	if err != nil {
+		return err
+	}
+
+	result, err := provider.Refund(ctx, pay.ProviderCapture, refund.Amount, refund.ID.String())
+	if err != nil {
+		if failErr := h.store.FailRefund(ctx, refund.ID); failErr != nil {
+			return failErr
+		}
+		refund.Status = models.RefundFailed
+		return &providerError{Err: err}
+	}
+	refund.ProviderRefundID = result.TransactionID
+	return h.store.SetRefundProviderID(ctx, refund)
+}
+
+// completeRefundTx marks a sent refund completed, restocks the requested
+// lines and adds the amount to the order's refunded total. Orders that have
+// been refunded in full move to refunded; partial refunds keep the
+// fulfillment status so the order can still ship. The refund is recorded in
+// the audit log. It must run inside a transaction.
+func (h *RefundHandler) completeRefundTx(c *gin.Context, tx *pg.Tx, refund *models.Refund, actor *uuid.UUID) error {
+	order, err := h.store.GetOrderForUpdateTx(c, tx, refund.OrderID)
+	if err != nil {
+		return err
+	}
+	before := gin.H{"status": order.Status, "refunded_amount": order.RefundedAmount}
+
+	stored, err := h.store.GetRefundTx(c, tx, refund.ID)
+	if err != nil {
+		return err
+	}
+	if stored.Status != models.RefundPending {
+		return &refundError{Status: http.StatusConflict, Message: fmt.Sprintf("refund is already %s", stored.Status)}
+	}
+
+	refund.Status = models.RefundCompleted
+	if err := h.store.UpdateRefundTx(c, tx, refund); err != nil {
+		return err
+	}
+
+	order.RefundedAmount = math.Round((order.RefundedAmount+refund.Amount)*100) / 100
+	if err := h.store.UpdateOrderRefundedAmountTx(c, tx, order); err != nil {
+		return err
+	}
+
+	if refund.PaymentID != nil {
+		pay, err := h.store.GetPaymentForUpdateTx(c, tx, *refund.PaymentID)
+		if err != nil {
+			return err
+		}
+		pay.Status = models.PaymentPartiallyRefunded
+		if order.RefundedAmount >= pay.Amount-priceTolerance {
+			pay.Status = models.PaymentRefunded
+		}
+		if err := h.store.UpdatePaymentTx(c, tx, pay); err != nil {
+			return err
+		}
+	}
+
+	// Put refunded items back on sale, unless the order was canceled while
+	// the refund was sent, which has already returned its stock
+	items, err := h.store.GetOrderItemsTx(c, tx, order.ID)
+	if err != nil {
+		return err
+	}
+	productIDs := make(map[uuid.UUID]uuid.UUID, len(items))
+	for _, item := range items {
+		productIDs[item.ID] = item.ProductID
+	}
+	for _, refundItem := range refund.Items {
+		if !refundItem.Restocked || order.Status == models.StatusCanceled {
+			continue
+		}
+		if err := h.store.RestockProductTx(c, tx, productIDs[refundItem.OrderItemID], &order.ID, refundItem.Quantity, models.StockReasonRefund); err != nil {
+			return err
+		}
+	}
+
+	// Update the order status
+	if order.RefundedAmount >= order.TotalAmount-priceTolerance {
+		if order.Status == models.StatusCanceled {
+			err = h.store.CompleteCancellationRefundTx(c, tx, order.ID)
+		} else {
+			order, err = h.store.UpdateOrderStatusTx(c, tx, order.ID, models.StatusRefunded, actor, refund.Reason)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	after := gin.H{"status": order.Status, "refunded_amount": order.RefundedAmount, "refund": refund}
+	return recordAuditTx(c, tx, h.store, models.AuditOrderRefund, models.AuditTargetOrder, order.ID.String(), before, after)
+}
+
+// refundError is returned when a refund request is not acceptable
+type refundError struct {
+	Status  int
+	Message string
+}
+
+func (e *refundError) Error() string {
+	return e.Message
+}
+
+// providerError wraps a failure reported by a payment provider
+type providerError struct {
+	Err error
+}
+
+func (e *providerError) Error() string {
+	return "payment provider error: " + e.Err.Error()
+}
+
+func (e *providerError) Unwrap() error {
+	return e.Err
+}
+
+// writeRefundError maps an error from the refund flow to an HTTP response
+func writeRefundError(c *gin.Context, err error) {
+	var refundErr *refundError
+	var provErr *providerError
+	switch {
+	case errors.As(err, &refundErr):
+		c.JSON(refundErr.Status, gin.H{"error": refundErr.Message})
+	case errors.As(err, &provErr):
+		c.JSON(http.StatusBadGateway, gin.H{"error": provErr.Error()})
+	case errors.Is(err, models.ErrInvalidStatusTransition):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err.Error() == "order not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refund"})
+	}
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/payment"
+)
+
+func TestWriteRefundError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&refundError{Status: http.StatusBadRequest, Message: "too much"}, http.StatusBadRequest},
+		{&providerError{Err: errors.New("card expired")}, http.StatusBadGateway},
+		{fmt.Errorf("refund: %w", models.ErrInvalidStatusTransition), http.StatusConflict},
+		{errors.New("order not found"), http.StatusNotFound},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeRefundError(c, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("%v: status = %d, want %d", tt.err, w.Code, tt.status)
+		}
+	}
+}
+
+func TestPriceRefund(t *testing.T) {
+	order := &models.Order{TotalAmount: 40, Status: models.StatusDelivered}
+	mug := &models.OrderItem{ID: uuid.New(), Quantity: 3, PriceAtPurchase: 9.99}
+	pen := &models.OrderItem{ID: uuid.New(), Quantity: 2, PriceAtPurchase: 5.01}
+	items := []*models.OrderItem{mug, pen}
+
+	tests := []struct {
+		name     string
+		status   models.OrderStatus
+		refunded map[uuid.UUID]int32
+		previous float64 // amount already refunded
+		amount   float64 // requested amount, zero for the items' value
+		lines    []refundLine
+		want     float64 // zero when the refund is rejected
+	}{
+		{"items", models.StatusDelivered, nil, 0, 0, []refundLine{{OrderItemID: mug.ID, Quantity: 2}, {OrderItemID: pen.ID, Quantity: 1}}, 24.99},
+		{"amount", models.StatusDelivered, nil, 0, 12.345, nil, 12.35},
+		{"amount and items", models.StatusDelivered, nil, 0, 5, []refundLine{{OrderItemID: mug.ID, Quantity: 1}}, 5},
+		{"whole rest", models.StatusDelivered, nil, 15, 25, nil, 25},
+		{"beyond the rest", models.StatusDelivered, nil, 15, 25.01, nil, 0},
+		{"units left", models.StatusDelivered, map[uuid.UUID]int32{mug.ID: 2}, 0, 0, []refundLine{{OrderItemID: mug.ID, Quantity: 1}}, 9.99},
+		{"units already refunded", models.StatusDelivered, map[uuid.UUID]int32{mug.ID: 2}, 0, 0, []refundLine{{OrderItemID: mug.ID, Quantity: 2}}, 0},
+		{"same item twice", models.StatusDelivered, nil, 0, 0, []refundLine{{OrderItemID: pen.ID, Quantity: 2}, {OrderItemID: pen.ID, Quantity: 1}}, 0},
+		{"unknown item", models.StatusDelivered, nil, 0, 0, []refundLine{{OrderItemID: uuid.New(), Quantity: 1}}, 0},
+		{"restock canceled", models.StatusCanceled, nil, 0, 0, []refundLine{{OrderItemID: mug.ID, Quantity: 1, Restock: true}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order.Status = tt.status
+			refunded := tt.refunded
+			if refunded == nil {
+				refunded = map[uuid.UUID]int32{}
+			}
+			refund := &models.Refund{}
+			err := priceRefund(refund, order, items, refunded, tt.previous, tt.amount, tt.lines)
+			if tt.want == 0 {
+				var refundErr *refundError
+				if !errors.As(err, &refundErr) || refundErr.Status != http.StatusBadRequest {
+					t.Errorf("error = %v, want a bad request", err)
+				}
+				return
+			}
+			if err != nil || refund.Amount != tt.want {
+				t.Errorf("amount = %.2f, %v, want %.2f", refund.Amount, err, tt.want)
+			}
+			if len(refund.Items) != len(tt.lines) {
+				t.Errorf("%d refund items, want %d", len(refund.Items), len(tt.lines))
+			}
+		})
+	}
+}
+
+func TestCreateRefund(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	seller := createTestUser(t, s, models.RoleSeller)
+	buyer := createTestUser(t, s, models.RoleBuyer)
+	shop := createTestShop(t, s, seller)
+	product := createTestProduct(t, s, shop, 12.5, 4)
+	order, items := createPaidOrder(t, s, buyer, shop, orderLine{ProductID: product.ID, Quantity: 2})
+
+	payments, err := payment.NewRegistry(payment.FakeProviderName, payment.NewFakeProvider(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAPI(t, s)
+	a.api.POST("/orders/:id/refunds", middlewares.RequirePermission(models.PermOrderRefund, models.PermOrderRefundAny), NewRefundHandler(s, payments).CreateRefund)
+	path := "/api/orders/" + order.ID.String() + "/refunds"
+
+	// Buyers can't refund their own orders, nor sellers other shops' orders
+	otherSeller := createTestUser(t, s, models.RoleSeller)
+	createTestShop(t, s, otherSeller)
+	for _, user := range []*models.User{buyer, otherSeller} {
+		if w := a.do(t, user, http.MethodPost, path, gin.H{"amount": 1, "reason": "test"}); w.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want %d", user.Role, w.Code, http.StatusForbidden)
+		}
+	}
+
+	// Refund one unit and put it back on sale
+	w := a.do(t, seller, http.MethodPost, path, gin.H{
+		"reason": "damaged",
+		"items":  []gin.H{{"order_item_id": items[0].ID, "quantity": 1, "restock": true}},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("item refund: status = %d: %s", w.Code, w.Body.String())
+	}
+	var refund models.Refund
+	decode(t, w, &refund)
+	if refund.Amount != 12.5 || refund.Status != models.RefundCompleted || refund.ProviderRefundID == "" {
+		t.Errorf("refund = %+v, want 12.50 completed by the provider", refund)
+	}
+
+	// A partial refund keeps the order moving
+	stored, err := s.GetOrderByID(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefundedAmount != 12.5 || stored.Status != models.StatusPaid {
+		t.Errorf("order refunded %.2f in status %s, want 12.50 in paid", stored.RefundedAmount, stored.Status)
+	}
+	if stored, err := s.GetProductByID(ctx, product.ID); err != nil || stored.Stock != 3 {
+		t.Errorf("stock after restock = %v, err = %v, want 3", stored, err)
+	}
+
+	// Nothing beyond what is left can be refunded
+	bad := []gin.H{
+		{"amount": 12.51, "reason": "too much"},
+		{"reason": "twice", "items": []gin.H{{"order_item_id": items[0].ID, "quantity": 2}}},
+		{"reason": "unknown", "items": []gin.H{{"order_item_id": uuid.New(), "quantity": 1}}},
+	}
+	for _, body := range bad {
+		if w := a.do(t, seller, http.MethodPost, path, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Refunding the rest refunds the order
+	if w := a.do(t, seller, http.MethodPost, path, gin.H{"amount": 12.5, "reason": "goodwill"}); w.Code != http.StatusCreated {
+		t.Fatalf("amount refund: status = %d: %s", w.Code, w.Body.String())
+	}
+	stored, err = s.GetOrderByID(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefundedAmount != 25 || stored.Status != models.StatusRefunded {
+		t.Errorf("order refunded %.2f in status %s, want 25.00 in refunded", stored.RefundedAmount, stored.Status)
+	}
+	if w := a.do(t, seller, http.MethodPost, path, gin.H{"amount": 1, "reason": "again"}); w.Code != http.StatusConflict {
+		t.Errorf("refund of a refunded order: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	events, err := s.ListAuditEvents(ctx, store.AuditFilter{
+		Action:   models.AuditOrderRefund,
+		TargetID: order.ID.String(),
+	}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("%d refund events, want 2", len(events))
+	}
+}
+
+func TestResumeRefund(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	seller := createTestUser(t, s, models.RoleSeller)
+	buyer := createTestUser(t, s, models.RoleBuyer)
+	shop := createTestShop(t, s, seller)
+	product := createTestProduct(t, s, shop, 8, 4)
+	order, _ := createPaidOrder(t, s, buyer, shop, orderLine{ProductID: product.ID, Quantity: 1})
+
+	payments, err := payment.NewRegistry(payment.FakeProviderName, payment.NewFakeProvider(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewRefundHandler(s, payments)
+	a := newTestAPI(t, s)
+	a.api.POST("/orders/:id/refunds/:refund_id/resume", middlewares.RequirePermission(models.PermOrderRefund, models.PermOrderRefundAny), handler.ResumeRefund)
+
+	// The provider returned the money, but the refund was never completed
+	var refund *models.Refund
+	err = s.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
+		refund, err = handler.prepareRefundTx(ctx, tx, order.ID, 8, "lost", nil, &seller.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("prepareRefundTx: %v", err)
+	}
+	if err := handler.sendRefund(ctx, refund); err != nil {
+		t.Fatalf("sendRefund: %v", err)
+	}
+	pending, err := s.GetRefundByID(ctx, refund.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Status != models.RefundPending || pending.ProviderRefundID != refund.ProviderRefundID {
+		t.Fatalf("stored refund = %s %q, want pending with provider ID %q", pending.Status, pending.ProviderRefundID, refund.ProviderRefundID)
+	}
+
+	path := "/api/orders/" + order.ID.String() + "/refunds/" + refund.ID.String() + "/resume"
+	if w := a.do(t, buyer, http.MethodPost, path, nil); w.Code != http.StatusForbidden {
+		t.Errorf("buyer: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	w := a.do(t, seller, http.MethodPost, path, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("resume: status = %d: %s", w.Code, w.Body.String())
+	}
+	var resumed models.Refund
+	decode(t, w, &resumed)
+	if resumed.Status != models.RefundCompleted || resumed.ProviderRefundID != refund.ProviderRefundID {
+		t.Errorf("resumed refund = %s %q, want completed with provider ID %q", resumed.Status, resumed.ProviderRefundID, refund.ProviderRefundID)
+	}
+	stored, err := s.GetOrderByID(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefundedAmount != 8 || stored.Status != models.StatusRefunded {
+		t.Errorf("order refunded %.2f in status %s, want 8.00 in refunded", stored.RefundedAmount, stored.Status)
+	}
+
+	// A completed refund can't be resumed
+	if w := a.do(t, seller, http.MethodPost, path, nil); w.Code != http.StatusConflict {
+		t.Errorf("second resume: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
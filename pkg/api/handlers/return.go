@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+type ReturnHandler struct {
+	store   *store.Store
+	refunds *RefundHandler
+}
+
+func NewReturnHandler(store *store.Store, refunds *RefundHandler) *ReturnHandler {
+	return &ReturnHandler{
+		store:   store,
+		refunds: refunds,
+	}
+}
+
+type returnItemRequest struct {
+	OrderItemID string `json:"order_item_id" binding:"required"`
+	Quantity    int32  `json:"quantity" binding:"required,min=1"`
+}
+
+type createReturnRequest struct {
+	Reason    string              `json:"reason" binding:"required,max=500"`
+	PhotoURLs []string            `json:"photo_urls" binding:"max=10,dive,url"`
+	Items     []returnItemRequest `json:"items" binding:"required,min=1,dive"`
+}
+
+type shipReturnRequest struct {
+	Carrier        string `json:"carrier" binding:"required,max=100"`
+	TrackingNumber string `json:"tracking_number" binding:"required,max=100"`
+}
+
+type resolveReturnRequest struct {
+	Note string `json:"note" binding:"max=500"`
+}
+
+type receiveReturnRequest struct {
+	// Restock puts the returned items back on sale
+	Restock bool `json:"restock"`
+}
+
+// returnableStatuses are the order statuses that allow a return request
+var returnableStatuses = map[models.OrderStatus]bool{
+	models.StatusDelivered: true,
+}
+
+// CreateReturn lets the buyer of a delivered order ask to send items back
+func (h *ReturnHandler) CreateReturn(c *gin.Context) {
+	order, payload, ok := getUserOrder(c, h.store, "return", models.PermOrderManage)
+	if !ok {
+		return
+	}
+
+	// Only the buyer can request a return
+	if order.UserID != payload.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to return this order"})
+		return
+	}
+
+	var req createReturnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request := &models.ReturnRequest{
+		OrderID:   order.ID,
+		UserID:    order.UserID,
+		ShopID:    order.ShopID,
+		Reason:    req.Reason,
+		PhotoURLs: req.PhotoURLs,
+		Status:    models.ReturnRequested,
+	}
+	for _, item := range req.Items {
+		itemID, err := uuid.Parse(item.OrderItemID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order item ID: " + item.OrderItemID})
+			return
+		}
+		request.Items = append(request.Items, &models.ReturnItem{
+			OrderItemID: itemID,
+			Quantity:    item.Quantity,
+		})
+	}
+
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		return h.createReturnTx(c, tx, request)
+	})
+
+	if err != nil {
+		writeReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, request)
+}
+
+// GetOrderReturns lists the return requests of an order
+func (h *ReturnHandler) GetOrderReturns(c *gin.Context) {
+	order, _, ok := getUserOrder(c, h.store, "view", models.PermOrderReadAny)
+	if !ok {
+		return
+	}
+
+	requests, err := h.store.GetReturnRequestsByOrderID(c, order.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get return requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// ShipReturn records the carrier and tracking number of an approved return
+func (h *ReturnHandler) ShipReturn(c *gin.Context) {
+	returnID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid return request ID"})
+		return
+	}
+
+	var req shipReturnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user from auth payload
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var request *models.ReturnRequest
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		request, err = h.store.GetReturnRequestForUpdateTx(c, tx, returnID)
+		if err != nil {
+			return err
+		}
+
+		// Check if user made the return request
+		if request.UserID != payload.UserID {
+			return &returnError{Status: http.StatusForbidden, Message: "you don't have permission to ship this return"}
+		}
+
+		if request.Status != models.ReturnApproved {
+			return &returnError{Status: http.StatusConflict, Message: "only approved returns can be shipped"}
+		}
+
+		now := time.Now()
+		request.Status = models.ReturnInTransit
+		request.Carrier = req.Carrier
+		request.TrackingNumber = req.TrackingNumber
+		request.ShippedAt = &now
+		return h.store.UpdateReturnRequestTx(c, tx, request)
+	})
+
+	if err != nil {
+		writeReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// ListShopReturns returns the return requests of a shop the user works for
+func (h *ReturnHandler) ListShopReturns(c *gin.Context) {
+	shop, ok := getFulfillmentShop(c, h.store)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Status string `form:"status" binding:"omitempty,oneof=requested approved rejected in_transit received"`
+		Limit  int    `form:"limit" binding:"required,min=1,max=100"`
+		Offset int    `form:"offset" binding:"min=0"`
+	}
+
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	requests, err := h.store.GetReturnRequestsByShopID(c, shop.ID, models.ReturnStatus(req.Status), req.Limit, req.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get return requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// ApproveReturn accepts a return request so the buyer can ship the items
+func (h *ReturnHandler) ApproveReturn(c *gin.Context) {
+	h.resolveReturn(c, models.ReturnApproved)
+}
+
+// RejectReturn declines a return request
+func (h *ReturnHandler) RejectReturn(c *gin.Context) {
+	h.resolveReturn(c, models.ReturnRejected)
+}
+
+// ReceiveReturn marks the returned items as received, refunds them to the
+// buyer and optionally puts them back in stock
+func (h *ReturnHandler) ReceiveReturn(c *gin.Context) {
+	shop, returnID, ok := h.getShopReturnID(c)
+	if !ok {
+		return
+	}
+
+	var req receiveReturnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	// Reserve the refund of the returned items, return the money, then
+	// record the outcome
+	var request *models.ReturnRequest
+	var refund *models.Refund
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		request, err = h.getReceivableReturnTx(c, tx, shop.ID, returnID)
+		if err != nil {
+			return err
+		}
+
+		// A refund left pending is resumed, and one that failed at the
+		// provider is replaced by a new one
+		if request.RefundID != nil {
+			previous, err := h.store.GetRefundTx(c, tx, *request.RefundID)
+			if err != nil {
+				return err
+			}
+			switch previous.Status {
+			case models.RefundPending:
+				refund = previous
+				return nil
+			case models.RefundCompleted:
+				return &returnError{Status: http.StatusConflict, Message: "the refund of this return has already been completed"}
+			}
+		}
+
+		lines := make([]refundLine, len(request.Items))
+		for i, item := range request.Items {
+			lines[i] = refundLine{OrderItemID: item.OrderItemID, Quantity: item.Quantity, Restock: req.Restock}
+		}
+		refund, err = h.refunds.prepareRefundTx(c, tx, request.OrderID, 0, "return: "+request.Reason, lines, &payload.UserID)
+		if err != nil {
+			return err
+		}
+
+		refundID := refund.ID
+		request.RefundID = &refundID
+		return h.store.UpdateReturnRequestTx(c, tx, request)
+	})
+	if err == nil {
+		err = h.refunds.sendRefund(c, refund)
+	}
+	if err == nil {
+		err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+			var err error
+			request, err = h.getReceivableReturnTx(c, tx, shop.ID, returnID)
+			if err != nil {
+				return err
+			}
+			if err := h.refunds.completeRefundTx(c, tx, refund, &payload.UserID); err != nil {
+				return err
+			}
+
+			before := gin.H{"status": request.Status}
+			now := time.Now()
+			request.Status = models.ReturnReceived
+			request.ResolvedAt = &now
+			if err := h.store.UpdateReturnRequestTx(c, tx, request); err != nil {
+				return err
+			}
+			// A resumed refund keeps the restock choice it was created with
+			restock := false
+			for _, item := range refund.Items {
+				restock = restock || item.Restocked
+			}
+			return recordAuditTx(c, tx, h.store, models.AuditReturnReceive, models.AuditTargetReturn, request.ID.String(), before,
+				gin.H{"status": request.Status, "refund_id": refund.ID, "restock": restock})
+		})
+	}
+
+	if err != nil {
+		writeReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"return": request,
+		"refund": refund,
+	})
+}
+
+// resolveReturn approves or rejects a pending return request
+func (h *ReturnHandler) resolveReturn(c *gin.Context, status models.ReturnStatus) {
+	shop, returnID, ok := h.getShopReturnID(c)
+	if !ok {
+		return
+	}
+
+	var req resolveReturnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var request *models.ReturnRequest
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		request, err = h.store.GetReturnRequestForUpdateTx(c, tx, returnID)
+		if err != nil {
+			return err
+		}
+		if request.ShopID != shop.ID {
+			return errors.New("return request not found")
+		}
+
+		if request.Status != models.ReturnRequested {
+			return &returnError{Status: http.StatusConflict, Message: "this return request has already been handled"}
+		}
+
+		before := gin.H{"status": request.Status}
+		request.Status = status
+		request.SellerNote = req.Note
+		if status == models.ReturnRejected {
+			now := time.Now()
+			request.ResolvedAt = &now
+		}
+		if err := h.store.UpdateReturnRequestTx(c, tx, request); err != nil {
+			return err
+		}
+
+		action := models.AuditReturnReject
+		if status == models.ReturnApproved {
+			action = models.AuditReturnApprove
+		}
+		return recordAuditTx(c, tx, h.store, action, models.AuditTargetReturn, request.ID.String(), before, gin.H{"status": request.Status, "seller_note": request.SellerNote})
+	})
+
+	if err != nil {
+		writeReturnError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// getReceivableReturnTx loads and locks a shop's return request that is
+// waiting to be received
+func (h *ReturnHandler) getReceivableReturnTx(ctx context.Context, tx *pg.Tx, shopID, returnID uuid.UUID) (*models.ReturnRequest, error) {
+	request, err := h.store.GetReturnRequestForUpdateTx(ctx, tx, returnID)
+	if err != nil {
+		return nil, err
+	}
+	if request.ShopID != shopID {
+		return nil, errors.New("return request not found")
+	}
+
+	if request.Status != models.ReturnApproved && request.Status != models.ReturnInTransit {
+		return nil, &returnError{Status: http.StatusConflict, Message: fmt.Sprintf("returns in status %s cannot be received", request.Status)}
+	}
+	return request, nil
+}
+
+// createReturnTx checks that the requested items were delivered and are not
+// already refunded or part of another return, then stores the request. It
+// must run inside a transaction.
+func (h *ReturnHandler) createReturnTx(ctx context.Context, tx *pg.Tx, request *models.ReturnRequest) error {
+	order, err := h.store.GetOrderForUpdateTx(ctx, tx, request.OrderID)
+	if err != nil {
+		return err
+	}
+
+	if !returnableStatuses[order.Status] {
+		return &returnError{Status: http.StatusConflict, Message: "only delivered orders can be returned"}
+	}
+
+	items, err := h.store.GetOrderItemsTx(ctx, tx, order.ID)
+	if err != nil {
+		return err
+	}
+	itemsByID := make(map[uuid.UUID]*models.OrderItem, len(items))
+	for _, item := range items {
+		itemsByID[item.ID] = item
+	}
+
+	refundedQuantities, err := h.store.GetRefundedQuantitiesTx(ctx, tx, order.ID)
+	if err != nil {
+		return err
+	}
+
+	openQuantities, err := h.store.GetOpenReturnQuantitiesTx(ctx, tx, order.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range request.Items {
+		item, ok := itemsByID[line.OrderItemID]
+		if !ok {
+			return &returnError{Status: http.StatusBadRequest, Message: "order item not found: " + line.OrderItemID.String()}
+		}
+
+		remaining := item.Quantity - refundedQuantities[item.ID] - openQuantities[item.ID]
+		if line.Quantity > remaining {
+			return &returnError{Status: http.StatusBadRequest, Message: fmt.Sprintf("cannot return %d units of order item %s (returnable: %d)", line.Quantity, item.ID, remaining)}
+		}
+		openQuantities[item.ID] += line.Quantity
+	}
+
+	return h.store.CreateReturnRequestTx(ctx, tx, request)
+}
+
+// getShopReturnID checks that the current user may handle returns of the
+// shop in the :id parameter and parses the :return_id parameter
+func (h *ReturnHandler) getShopReturnID(c *gin.Context) (*models.Shop, uuid.UUID, bool) {
+	shop, ok := getFulfillmentShop(c, h.store)
+	if !ok {
+		return nil, uuid.Nil, false
+	}
+
+	returnID, err := uuid.Parse(c.Param("return_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid return request ID"})
+		return nil, uuid.Nil, false
+	}
+
+	return shop, returnID, true
+}
+
+// returnError is returned when a return request or a step of its workflow
+// is not acceptable
+type returnError struct {
+	Status  int
+	Message string
+}
+
+func (e *returnError) Error() string {
+	return e.Message
+}
+
+// writeReturnError maps an error from a return workflow step to an HTTP response
+func writeReturnError(c *gin.Context, err error) {
+	var returnErr *returnError
+	var refundErr *refundError
+	var provErr *providerError
+	switch {
+	case errors.As(err, &returnErr):
+		c.JSON(returnErr.Status, gin.H{"error": returnErr.Message})
+	case errors.As(err, &refundErr), errors.As(err, &provErr), errors.Is(err, models.ErrInvalidStatusTransition):
+		writeRefundError(c, err)
+	case err.Error() == "return request not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "return request not found"})
+	case err.Error() == "order not found":
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process return request"})
+	}
+}
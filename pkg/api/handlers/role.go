@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,49}$`)
+
+type RoleHandler struct {
+	store       *store.Store
+	permissions *middlewares.Permissions
+}
+
+func NewRoleHandler(store *store.Store, permissions *middlewares.Permissions) *RoleHandler {
+	return &RoleHandler{
+		store:       store,
+		permissions: permissions,
+	}
+}
+
+type createRoleRequest struct {
+	Name        string              `json:"name" binding:"required"`
+	Description string              `json:"description" binding:"max=500"`
+	Permissions []models.Permission `json:"permissions" binding:"required"`
+}
+
+type updateRoleRequest struct {
+	Description string              `json:"description" binding:"max=500"`
+	Permissions []models.Permission `json:"permissions" binding:"required"`
+}
+
+// ListPermissions lists every permission a role can be granted
+func (h *RoleHandler) ListPermissions(c *gin.Context) {
+	c.JSON(http.StatusOK, models.AllPermissions)
+}
+
+// ListRoles lists the roles with their permissions
+func (h *RoleHandler) ListRoles(c *gin.Context) {
+	roles, err := h.store.GetRoles(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, roles)
+}
+
+// CreateRole creates a custom role
+func (h *RoleHandler) CreateRole(c *gin.Context) {
+	var req createRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !roleNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role name must be 2 to 50 lowercase letters, digits or underscores, starting with a letter"})
+		return
+	}
+
+	if !validPermissions(c, req.Permissions) {
+		return
+	}
+
+	role := &models.Role{
+		Name:        models.UserRole(req.Name),
+		Description: req.Description,
+		Permissions: req.Permissions,
+	}
+
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		if err := h.store.CreateRoleTx(c, tx, role); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditRoleCreate, models.AuditTargetRole, string(role.Name), nil, roleAuditSnapshot(role))
+	})
+	if err != nil {
+		if err.Error() == "role already exists" {
+			c.JSON(http.StatusConflict, gin.H{"error": "role already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create role"})
+		return
+	}
+	h.permissions.Forget(role.Name)
+
+	c.JSON(http.StatusCreated, role)
+}
+
+// UpdateRole changes a role's description and permissions. The admin role
+// always has every permission and can't be changed.
+func (h *RoleHandler) UpdateRole(c *gin.Context) {
+	var req updateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := models.UserRole(c.Param("name"))
+	if name == models.RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the admin role cannot be changed"})
+		return
+	}
+
+	if !validPermissions(c, req.Permissions) {
+		return
+	}
+
+	var role *models.Role
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		role, err = h.store.GetRoleForUpdateTx(c, tx, name)
+		if err != nil {
+			return err
+		}
+
+		before := roleAuditSnapshot(role)
+		role.Description = req.Description
+		role.Permissions = req.Permissions
+		if err := h.store.UpdateRoleTx(c, tx, role); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditRoleUpdate, models.AuditTargetRole, string(role.Name), before, roleAuditSnapshot(role))
+	})
+	if err != nil {
+		if err.Error() == "role not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update role"})
+		return
+	}
+	h.permissions.Forget(role.Name)
+
+	c.JSON(http.StatusOK, role)
+}
+
+// DeleteRole deletes a custom role that no user has
+func (h *RoleHandler) DeleteRole(c *gin.Context) {
+	var role *models.Role
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		role, err = h.store.GetRoleForUpdateTx(c, tx, models.UserRole(c.Param("name")))
+		if err != nil {
+			return err
+		}
+		if role.BuiltIn {
+			return errors.New("built-in role")
+		}
+
+		if err := h.store.DeleteRoleTx(c, tx, role.Name); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditRoleDelete, models.AuditTargetRole, string(role.Name), roleAuditSnapshot(role), nil)
+	})
+	if err != nil {
+		switch err.Error() {
+		case "role not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+		case "built-in role":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "built-in roles cannot be deleted"})
+		case "role in use":
+			c.JSON(http.StatusConflict, gin.H{"error": "role is still assigned to users"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete role"})
+		}
+		return
+	}
+	h.permissions.Forget(role.Name)
+
+	c.JSON(http.StatusOK, gin.H{"message": "role deleted successfully"})
+}
+
+// validPermissions checks that every permission is known. It writes the
+// error response and returns false if not.
+func validPermissions(c *gin.Context, permissions []models.Permission) bool {
+	for _, perm := range permissions {
+		if !perm.IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown permission: " + string(perm)})
+			return false
+		}
+	}
+	return true
+}
+
+// roleAuditSnapshot is the state of a role for the audit log
+func roleAuditSnapshot(role *models.Role) gin.H {
+	return gin.H{
+		"description": role.Description,
+		"permissions": role.Permissions,
+	}
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+type SellerHandler struct {
+	store *store.Store
+}
+
+func NewSellerHandler(store *store.Store) *SellerHandler {
+	return &SellerHandler{
+		store: store,
+	}
+}
+
+type shipOrderRequest struct {
+	Carrier        string `json:"carrier" binding:"required,max=100"`
+	TrackingNumber string `json:"tracking_number" binding:"required,max=100"`
+}
+
+type updateShopOrderStatusRequest struct {
+	Status string `json:"status" binding:"required,oneof=delivered canceled"`
+	Note   string `json:"note"`
+}
+
+// ListShopOrders returns the orders placed at a shop the user works for
+func (h *SellerHandler) ListShopOrders(c *gin.Context) {
+	shop, ok := h.getFulfillmentShop(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Status string    `form:"status" binding:"omitempty,oneof=pending paid shipped delivered canceled"`
+		From   time.Time `form:"from" time_format:"2006-01-02"`
+		To     time.Time `form:"to" time_format:"2006-01-02"`
+		Limit  int       `form:"limit" binding:"required,min=1,max=100"`
+		Offset int       `form:"offset" binding:"min=0"`
+	}
+
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := store.OrderFilter{
+		Status: models.OrderStatus(req.Status),
+		From:   req.From,
+	}
+	// Make the end date inclusive
+	if !req.To.IsZero() {
+		filter.To = req.To.AddDate(0, 0, 1)
+	}
+
+	orders, err := h.store.GetOrdersByShopID(c, shop.ID, filter, req.Limit, req.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shop orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, orders)
+}
+
+// GetShopOrder returns an order placed at the seller's shop with its items
+func (h *SellerHandler) GetShopOrder(c *gin.Context) {
+	order, ok := h.getShopOrder(c)
+	if !ok {
+		return
+	}
+
+	// Get order items
+	items, err := h.store.GetOrderItems(c, order.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get order items"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"order": order,
+		"items": items,
+	})
+}
+
+// ShipOrder marks a paid order as shipped with carrier and tracking number
+func (h *SellerHandler) ShipOrder(c *gin.Context) {
+	order, ok := h.getShopOrder(c)
+	if !ok {
+		return
+	}
+
+	var req shipOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		order, err = changeOrderStatusTx(c, tx, h.store, order.ID, models.StatusShipped, payload.UserID, "shipped via "+req.Carrier,
+			gin.H{"carrier": req.Carrier, "tracking_number": req.TrackingNumber})
+		if err != nil {
+			return err
+		}
+		return h.store.SetOrderShipmentTx(c, tx, order, req.Carrier, req.TrackingNumber)
+	})
+	if err != nil {
+		writeStatusError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// UpdateShopOrderStatus marks an order delivered or cancels it on behalf of the seller
+func (h *SellerHandler) UpdateShopOrderStatus(c *gin.Context) {
+	order, ok := h.getShopOrder(c)
+	if !ok {
+		return
+	}
+
+	var req updateShopOrderStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		order, err = changeOrderStatusTx(c, tx, h.store, order.ID, models.OrderStatus(req.Status), payload.UserID, req.Note, nil)
+		return err
+	})
+	if err != nil {
+		writeStatusError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// GetShopStats returns sales analytics for the seller's shop, bucketed by
+// day, week or month
+func (h *SellerHandler) GetShopStats(c *gin.Context) {
+	shop, ok := h.getFulfillmentShop(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		From   time.Time `form:"from" time_format:"2006-01-02"`
+		To     time.Time `form:"to" time_format:"2006-01-02"`
+		Bucket string    `form:"bucket" binding:"omitempty,oneof=day week month"`
+		Top    int       `form:"top" binding:"omitempty,min=1,max=50"`
+	}
+
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Default to the last 30 days, by day, with the top 5 products
+	if req.To.IsZero() {
+		now := time.Now().UTC()
+		req.To = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	if req.From.IsZero() {
+		req.From = req.To.AddDate(0, 0, -29)
+	}
+	if req.Bucket == "" {
+		req.Bucket = "day"
+	}
+	if req.Top == 0 {
+		req.Top = 5
+	}
+
+	if req.To.Before(req.From) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date range"})
+		return
+	}
+
+	// Make the end date inclusive
+	startDate, endDate := req.From, req.To.AddDate(0, 0, 1)
+
+	summary, err := h.store.GetShopOrderStatistics(c, shop.ID, startDate, endDate)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shop statistics"})
+		return
+	}
+
+	buckets, err := h.store.GetShopSalesBuckets(c, shop.ID, req.Bucket, startDate, endDate)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shop statistics"})
+		return
+	}
+
+	topProducts, err := h.store.GetShopTopProducts(c, shop.ID, startDate, endDate, req.Top)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get top products"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"shop_id":      shop.ID,
+		"from":         req.From.Format("2006-01-02"),
+		"to":           req.To.Format("2006-01-02"),
+		"bucket":       req.Bucket,
+		"summary":      summary,
+		"buckets":      buckets,
+		"top_products": topProducts,
+	})
+}
+
+// getFulfillmentShop loads the shop in the :id parameter and checks that the
+// current user may handle its orders. It writes the error response and
+// returns false if not.
+func (h *SellerHandler) getFulfillmentShop(c *gin.Context) (*models.Shop, bool) {
+	return getFulfillmentShop(c, h.store)
+}
+
+// getShopOrder loads the order in the :order_id parameter and checks that it
+// was placed at a shop the current user works for
+func (h *SellerHandler) getShopOrder(c *gin.Context) (*models.Order, bool) {
+	shop, ok := h.getFulfillmentShop(c)
+	if !ok {
+		return nil, false
+	}
+
+	orderID, err := uuid.Parse(c.Param("order_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order ID"})
+		return nil, false
+	}
+
+	order, err := h.store.GetOrderByID(c, orderID)
+	if err != nil || order.ShopID != shop.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return nil, false
+	}
+
+	return order, true
+}
+
+// getFulfillmentShop loads the shop in the :id parameter and checks that the
+// current user may handle its orders: staff whose shop role allows it, or
+// users who may manage any shop. It writes the error response and returns
+// false if not.
+func getFulfillmentShop(c *gin.Context, store *store.Store) (*models.Shop, bool) {
+	shop, ok := getShopParam(c, store)
+	if !ok {
+		return nil, false
+	}
+
+	if !canAccessShop(c, store, shop.ID, models.PermOrderFulfill, models.PermShopManageAny) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to manage this shop"})
+		return nil, false
+	}
+
+	return shop, true
+}
+
+// getShopParam loads the shop in the :id parameter. It writes the error
+// response and returns false if there is none.
+func getShopParam(c *gin.Context, store *store.Store) (*models.Shop, bool) {
+	shopID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid shop ID"})
+		return nil, false
+	}
+
+	shop, err := store.GetShopByID(c, shopID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shop not found"})
+		return nil, false
+	}
+
+	return shop, true
+}
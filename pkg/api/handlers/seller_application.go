@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/mailer"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+type SellerApplicationHandler struct {
+	store       *store.Store
+	mailer      mailer.Mailer
+	revocations *middlewares.TokenRevocations
+}
+
+func NewSellerApplicationHandler(store *store.Store, mailer mailer.Mailer, revocations *middlewares.TokenRevocations) *SellerApplicationHandler {
+	return &SellerApplicationHandler{
+		store:       store,
+		mailer:      mailer,
+		revocations: revocations,
+	}
+}
+
+type createSellerApplicationRequest struct {
+	BusinessName string `json:"business_name" binding:"required,min=2,max=200"`
+	TaxID        string `json:"tax_id" binding:"required,max=50"`
+	ContactName  string `json:"contact_name" binding:"required,max=100"`
+	ContactEmail string `json:"contact_email" binding:"required,email"`
+	ContactPhone string `json:"contact_phone" binding:"omitempty,max=30"`
+}
+
+type reviewSellerApplicationRequest struct {
+	Note string `json:"note" binding:"max=1000"`
+}
+
+// CreateSellerApplication lets a buyer apply to become a seller
+func (h *SellerApplicationHandler) CreateSellerApplication(c *gin.Context) {
+	var req createSellerApplicationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	user, err := h.store.GetUserByID(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	if user.Role != models.RoleBuyer && user.Role != models.RoleStaff {
+		c.JSON(http.StatusConflict, gin.H{"error": "only buyers and shop staff can apply to become sellers"})
+		return
+	}
+
+	pending, err := h.store.HasPendingSellerApplication(c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check applications"})
+		return
+	}
+	if pending {
+		c.JSON(http.StatusConflict, gin.H{"error": "you already have an application waiting for review"})
+		return
+	}
+
+	application := &models.SellerApplication{
+		UserID:       user.ID,
+		BusinessName: req.BusinessName,
+		TaxID:        req.TaxID,
+		ContactName:  req.ContactName,
+		ContactEmail: req.ContactEmail,
+		ContactPhone: req.ContactPhone,
+		Status:       models.ApplicationPending,
+	}
+
+	if err := h.store.CreateSellerApplication(c, application); err != nil {
+		if err.Error() == "pending seller application exists" {
+			c.JSON(http.StatusConflict, gin.H{"error": "you already have an application waiting for review"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create application"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, application)
+}
+
+// GetUserSellerApplications lists the current user's applications
+func (h *SellerApplicationHandler) GetUserSellerApplications(c *gin.Context) {
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	applications, err := h.store.GetSellerApplicationsByUserID(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get applications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, applications)
+}
+
+// ListSellerApplications lists applications for review (admin only)
+func (h *SellerApplicationHandler) ListSellerApplications(c *gin.Context) {
+	var req struct {
+		Status string `form:"status" binding:"omitempty,oneof=pending approved rejected"`
+		Limit  int    `form:"limit" binding:"required,min=1,max=100"`
+		Offset int    `form:"offset" binding:"min=0"`
+	}
+
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	applications, err := h.store.ListSellerApplications(c, models.SellerApplicationStatus(req.Status), req.Limit, req.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list applications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, applications)
+}
+
+// GetSellerApplication returns one application (admin only)
+func (h *SellerApplicationHandler) GetSellerApplication(c *gin.Context) {
+	applicationID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid application ID"})
+		return
+	}
+
+	application, err := h.store.GetSellerApplicationByID(c, applicationID)
+	if err != nil {
+		if err.Error() == "seller application not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "seller application not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get application"})
+		return
+	}
+
+	c.JSON(http.StatusOK, application)
+}
+
+// ApproveSellerApplication approves an application and makes the applicant
+// a seller (admin only)
+func (h *SellerApplicationHandler) ApproveSellerApplication(c *gin.Context) {
+	h.reviewSellerApplication(c, models.ApplicationApproved)
+}
+
+// RejectSellerApplication rejects an application (admin only)
+func (h *SellerApplicationHandler) RejectSellerApplication(c *gin.Context) {
+	h.reviewSellerApplication(c, models.ApplicationRejected)
+}
+
+// reviewSellerApplication records the admin's decision on a pending
+// application and emails the applicant
+func (h *SellerApplicationHandler) reviewSellerApplication(c *gin.Context, status models.SellerApplicationStatus) {
+	applicationID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid application ID"})
+		return
+	}
+
+	var req reviewSellerApplicationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var application *models.SellerApplication
+	var user *models.User
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		application, err = h.store.GetSellerApplicationForUpdateTx(c, tx, applicationID)
+		if err != nil {
+			return err
+		}
+		if application.Status != models.ApplicationPending {
+			return errors.New("seller application already reviewed")
+		}
+
+		now := time.Now()
+		application.Status = status
+		application.ReviewNote = req.Note
+		application.ReviewedBy = &payload.UserID
+		application.ReviewedAt = &now
+		if err := h.store.UpdateSellerApplicationTx(c, tx, application); err != nil {
+			return err
+		}
+
+		// Lock the applicant so a concurrent role change can't be
+		// overwritten or make the upgrade decision stale
+		user, err = h.store.GetUserForUpdateTx(c, tx, application.UserID)
+		if err != nil {
+			return err
+		}
+
+		// Only buyers and staff are upgraded; users with other roles keep
+		// theirs
+		upgradable := user.Role == models.RoleBuyer || user.Role == models.RoleStaff
+		if status == models.ApplicationApproved && upgradable {
+			user, err = h.store.UpdateUserRoleTx(c, tx, user.ID, models.RoleSeller)
+			if err != nil {
+				return err
+			}
+		}
+
+		action := models.AuditSellerApplicationReject
+		if status == models.ApplicationApproved {
+			action = models.AuditSellerApplicationApprove
+		}
+		return recordAuditTx(c, tx, h.store, action, models.AuditTargetSellerApplication, application.ID.String(),
+			gin.H{"status": models.ApplicationPending},
+			gin.H{"status": application.Status, "review_note": application.ReviewNote, "user_id": user.ID, "user_role": user.Role})
+	})
+
+	if err != nil {
+		switch err.Error() {
+		case "seller application not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "seller application not found"})
+		case "seller application already reviewed":
+			c.JSON(http.StatusConflict, gin.H{"error": "this application has already been reviewed"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to review application"})
+		}
+		return
+	}
+	h.revocations.Forget(user.ID)
+
+	if err := h.notifyApplicant(c, user, application); err != nil {
+		log.Printf("Failed to notify user %s about seller application %s: %v", user.ID, application.ID, err)
+	}
+
+	c.JSON(http.StatusOK, application)
+}
+
+// notifyApplicant emails the outcome of a review to the applicant
+func (h *SellerApplicationHandler) notifyApplicant(c *gin.Context, user *models.User, application *models.SellerApplication) error {
+	var msg mailer.Message
+	if application.Status == models.ApplicationApproved {
+		msg = mailer.Message{
+			To:      user.Email,
+			Subject: "Your seller application was approved",
+			Body: fmt.Sprintf("Hi %s,\n\nYour application to sell as %s was approved. Log in again to open your shop and start listing products.\n",
+				user.Username, application.BusinessName),
+		}
+	} else {
+		msg = mailer.Message{
+			To:      user.Email,
+			Subject: "Your seller application was not approved",
+			Body: fmt.Sprintf("Hi %s,\n\nYour application to sell as %s was not approved.\n",
+				user.Username, application.BusinessName),
+		}
+	}
+
+	if application.ReviewNote != "" {
+		msg.Body += "\nNote from our team: " + application.ReviewNote + "\n"
+	}
+
+	return h.mailer.Send(c, msg)
+}
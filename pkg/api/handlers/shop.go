@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
 	"github.com/qhh/prjEcom/pkg/api/middlewares"
 	"github.com/qhh/prjEcom/pkg/db/store"
@@ -26,7 +27,8 @@ type createShopRequest struct {
 	LogoURL     string `json:"logo_url"`
 }
 
-// CreateShop creates a new shop for the authenticated user
+// CreateShop creates a new shop for the authenticated seller. Buyers become
+// sellers through an approved seller application.
 func (h *ShopHandler) CreateShop(c *gin.Context) {
 	var req createShopRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -55,19 +57,6 @@ func (h *ShopHandler) CreateShop(c *gin.Context) {
 		return
 	}
 
-	// Update user's role to seller
-	_, err = h.store.GetUserByID(c, payload.UserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
-		return
-	}
-
-	_, err = h.store.UpdateUserRole(c, payload.UserID, models.RoleSeller)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user role"})
-		return
-	}
-
 	c.JSON(http.StatusCreated, shop)
 }
 
@@ -88,7 +77,7 @@ func (h *ShopHandler) GetShop(c *gin.Context) {
 	c.JSON(http.StatusOK, shop)
 }
 
-// GetUserShops returns all shops owned by the authenticated user
+// GetUserShops returns all shops the authenticated user owns or works for
 func (h *ShopHandler) GetUserShops(c *gin.Context) {
 	// Get user from auth payload
 	payload, err := middlewares.GetAuthPayload(c)
@@ -97,7 +86,7 @@ func (h *ShopHandler) GetUserShops(c *gin.Context) {
 		return
 	}
 
-	shops, err := h.store.GetShopsByUserID(c, payload.UserID)
+	shops, err := h.store.GetShopsByMemberID(c, payload.UserID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shops"})
 		return
@@ -110,7 +99,7 @@ func (h *ShopHandler) GetUserShops(c *gin.Context) {
 func (h *ShopHandler) ListShops(c *gin.Context) {
 	var req struct {
 		Limit  int `form:"limit" binding:"required,min=1,max=100"`
-		Offset int `form:"offset" binding:"required,min=0"`
+		Offset int `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -132,7 +121,7 @@ func (h *ShopHandler) SearchShops(c *gin.Context) {
 	var req struct {
 		Query  string `form:"q" binding:"required,min=1"`
 		Limit  int    `form:"limit" binding:"required,min=1,max=100"`
-		Offset int    `form:"offset" binding:"required,min=0"`
+		Offset int    `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -163,32 +152,37 @@ func (h *ShopHandler) UpdateShop(c *gin.Context) {
 		return
 	}
 
-	// Get user from auth payload
-	payload, err := middlewares.GetAuthPayload(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
-	}
-
-	// Check if shop exists and belongs to user
+	// Check if shop exists
 	shop, err := h.store.GetShopByID(c, shopID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "shop not found"})
 		return
 	}
 
-	// Check if user owns the shop or is admin
-	if shop.UserID != payload.UserID && payload.Role != "admin" {
+	// Check if user's shop role allows editing the shop or they may manage
+	// any shop
+	if !canAccessShop(c, h.store, shop.ID, models.PermShopUpdate, models.PermShopManageAny) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to update this shop"})
 		return
 	}
 
 	// Update shop
-	shop.Name = req.Name
-	shop.Description = req.Description
-	shop.LogoURL = req.LogoURL
-
-	err = h.store.UpdateShop(c, shop)
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		shop, err = h.store.GetShopForUpdateTx(c, tx, shopID)
+		if err != nil {
+			return err
+		}
+
+		before := shopAuditSnapshot(shop)
+		shop.Name = req.Name
+		shop.Description = req.Description
+		shop.LogoURL = req.LogoURL
+		if err := h.store.UpdateShopTx(c, tx, shop); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditShopUpdate, models.AuditTargetShop, shop.ID.String(), before, shopAuditSnapshot(shop))
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update shop"})
 		return
@@ -196,3 +190,12 @@ func (h *ShopHandler) UpdateShop(c *gin.Context) {
 
 	c.JSON(http.StatusOK, shop)
 }
+
+// shopAuditSnapshot is the editable state of a shop for the audit log
+func shopAuditSnapshot(shop *models.Shop) gin.H {
+	return gin.H{
+		"name":        shop.Name,
+		"description": shop.Description,
+		"logo_url":    shop.LogoURL,
+	}
+}
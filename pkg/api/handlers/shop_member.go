@@ -0,0 +1,508 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/mailer"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/utils"
+)
+
+type ShopMemberHandler struct {
+	store              *store.Store
+	mailer             mailer.Mailer
+	revocations        *middlewares.TokenRevocations
+	baseURL            string
+	invitationDuration time.Duration
+}
+
+func NewShopMemberHandler(store *store.Store, mailer mailer.Mailer, revocations *middlewares.TokenRevocations, baseURL string, invitationDuration time.Duration) *ShopMemberHandler {
+	return &ShopMemberHandler{
+		store:              store,
+		mailer:             mailer,
+		revocations:        revocations,
+		baseURL:            baseURL,
+		invitationDuration: invitationDuration,
+	}
+}
+
+type inviteShopMemberRequest struct {
+	Email string          `json:"email" binding:"required,email"`
+	Role  models.ShopRole `json:"role" binding:"required"`
+}
+
+type updateShopMemberRequest struct {
+	Role models.ShopRole `json:"role" binding:"required"`
+}
+
+type acceptShopInvitationRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ListShopMembers lists the people working for a shop (its members, or
+// users who may manage any shop)
+func (h *ShopMemberHandler) ListShopMembers(c *gin.Context) {
+	shop, ok := h.getMemberShop(c)
+	if !ok {
+		return
+	}
+
+	members, err := h.store.GetShopMembers(c, shop.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shop members"})
+		return
+	}
+
+	response := make([]gin.H, len(members))
+	for i, member := range members {
+		response[i] = shopMemberResponse(member)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// InviteShopMember emails an invitation to join the shop with a shop role
+// (shop owner, or users who may manage any shop)
+func (h *ShopMemberHandler) InviteShopMember(c *gin.Context) {
+	var req inviteShopMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !validStaffRole(c, req.Role) {
+		return
+	}
+
+	shop, ok := h.getManagedShop(c)
+	if !ok {
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	// Don't invite people who already work for the shop
+	user, err := h.store.GetUserByEmail(c, req.Email)
+	if err != nil && err.Error() != "user not found" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+	if user != nil {
+		_, err := h.store.GetShopMember(c, shop.ID, user.ID)
+		if err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "this user is already a member of the shop"})
+			return
+		}
+		if err.Error() != "shop member not found" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shop member"})
+			return
+		}
+	}
+
+	token, hash, err := utils.NewOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create invitation"})
+		return
+	}
+
+	invitation := &models.ShopInvitation{
+		ShopID:    shop.ID,
+		Email:     req.Email,
+		Role:      req.Role,
+		TokenHash: hash,
+		InvitedBy: payload.UserID,
+		ExpiresAt: time.Now().Add(h.invitationDuration),
+	}
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		if err := h.store.CreateShopInvitationTx(c, tx, invitation); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditShopMemberInvite, models.AuditTargetShop, shop.ID.String(), nil, shopInvitationResponse(invitation))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create invitation"})
+		return
+	}
+
+	link := h.baseURL + "/shop-invitations/accept?token=" + url.QueryEscape(token)
+	err = h.mailer.Send(c, mailer.Message{
+		To:      invitation.Email,
+		Subject: fmt.Sprintf("You're invited to work for %s", shop.Name),
+		Body: fmt.Sprintf("Hi,\n\nYou have been invited to join the shop %s as %s. Log in with this email address and use the link below to accept. It expires in %s and works once.\n\n%s\n\nYour invitation code: %s\n\nIf you weren't expecting this, you can ignore this email.\n",
+			shop.Name, invitation.Role, h.invitationDuration, link, token),
+	})
+	if err != nil {
+		log.Printf("Failed to send shop invitation %s: %v", invitation.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to send invitation email"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, shopInvitationResponse(invitation))
+}
+
+// ListShopInvitations lists a shop's pending invitations (shop owner, or
+// users who may manage any shop)
+func (h *ShopMemberHandler) ListShopInvitations(c *gin.Context) {
+	shop, ok := h.getManagedShop(c)
+	if !ok {
+		return
+	}
+
+	invitations, err := h.store.GetPendingShopInvitations(c, shop.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get invitations"})
+		return
+	}
+
+	response := make([]gin.H, len(invitations))
+	for i, invitation := range invitations {
+		response[i] = shopInvitationResponse(invitation)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// RevokeShopInvitation withdraws a pending invitation (shop owner, or users
+// who may manage any shop)
+func (h *ShopMemberHandler) RevokeShopInvitation(c *gin.Context) {
+	invitationID, err := uuid.Parse(c.Param("invitation_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid invitation ID"})
+		return
+	}
+
+	shop, ok := h.getManagedShop(c)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.store.DeleteShopInvitation(c, shop.ID, invitationID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke invitation"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shop invitation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "invitation revoked successfully"})
+}
+
+// AcceptShopInvitation makes the current user a member of the shop that
+// invited them. The invitation must have been sent to their email address.
+// Buyers become staff so that their user role lets them reach the seller
+// routes; their tokens are revoked and refreshing picks up the new role.
+func (h *ShopMemberHandler) AcceptShopInvitation(c *gin.Context) {
+	var req acceptShopInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var member *models.ShopMember
+	roleChanged := false
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		invitation, err := h.store.GetShopInvitationForUpdateTx(c, tx, utils.HashOpaqueToken(req.Token))
+		if err != nil {
+			return err
+		}
+		// Lock the user so a concurrent role change can't be overwritten
+		user, err := h.store.GetUserForUpdateTx(c, tx, payload.UserID)
+		if err != nil {
+			return err
+		}
+		if invitation.AcceptedAt != nil || time.Now().After(invitation.ExpiresAt) {
+			return errors.New("shop invitation not found")
+		}
+		if !strings.EqualFold(invitation.Email, user.Email) {
+			return errors.New("invitation email mismatch")
+		}
+
+		now := time.Now()
+		invitation.AcceptedBy = &user.ID
+		invitation.AcceptedAt = &now
+		if err := h.store.UpdateShopInvitationTx(c, tx, invitation); err != nil {
+			return err
+		}
+
+		member = &models.ShopMember{
+			ShopID: invitation.ShopID,
+			UserID: user.ID,
+			Role:   invitation.Role,
+		}
+		if err := h.store.AddShopMemberTx(c, tx, member); err != nil {
+			return err
+		}
+
+		if user.Role != models.RoleBuyer {
+			return nil
+		}
+		roleChanged = true
+		_, err = h.store.UpdateUserRoleTx(c, tx, user.ID, models.RoleStaff)
+		return err
+	})
+
+	if err != nil {
+		switch err.Error() {
+		case "shop invitation not found":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired invitation"})
+		case "invitation email mismatch":
+			c.JSON(http.StatusForbidden, gin.H{"error": "this invitation was sent to a different email address"})
+		case "already a shop member":
+			c.JSON(http.StatusConflict, gin.H{"error": "you are already a member of this shop"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to accept invitation"})
+		}
+		return
+	}
+	if roleChanged {
+		h.revocations.Forget(payload.UserID)
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+// UpdateShopMember changes a member's shop role (shop owner, or users who
+// may manage any shop). The owner's role can't be changed.
+func (h *ShopMemberHandler) UpdateShopMember(c *gin.Context) {
+	var req updateShopMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !validStaffRole(c, req.Role) {
+		return
+	}
+
+	shop, ok := h.getManagedShop(c)
+	if !ok {
+		return
+	}
+
+	userID, ok := getMemberUserID(c)
+	if !ok {
+		return
+	}
+
+	var member *models.ShopMember
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		member, err = h.store.GetShopMemberForUpdateTx(c, tx, shop.ID, userID)
+		if err != nil {
+			return err
+		}
+		if member.Role == models.ShopRoleOwner {
+			return errors.New("shop owner")
+		}
+
+		before := gin.H{"user_id": member.UserID, "role": member.Role}
+		member.Role = req.Role
+		if err := h.store.UpdateShopMemberRoleTx(c, tx, member); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditShopMemberRoleChange, models.AuditTargetShop, shop.ID.String(), before, gin.H{"user_id": member.UserID, "role": member.Role})
+	})
+	if err != nil {
+		switch err.Error() {
+		case "shop member not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "shop member not found"})
+		case "shop owner":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the shop owner's role cannot be changed"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update shop member"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+// RemoveShopMember removes a member from the shop (shop owner, users who
+// may manage any shop, or members leaving the shop themselves). The owner
+// can't be removed.
+func (h *ShopMemberHandler) RemoveShopMember(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var shop *models.Shop
+	var ok bool
+	if userID == payload.UserID {
+		shop, ok = h.getMemberShop(c)
+	} else {
+		shop, ok = h.getManagedShop(c)
+	}
+	if !ok {
+		return
+	}
+
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		member, err := h.store.GetShopMemberForUpdateTx(c, tx, shop.ID, userID)
+		if err != nil {
+			return err
+		}
+		if member.Role == models.ShopRoleOwner {
+			return errors.New("shop owner")
+		}
+
+		if err := h.store.DeleteShopMemberTx(c, tx, shop.ID, member.UserID); err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditShopMemberRemove, models.AuditTargetShop, shop.ID.String(), gin.H{"user_id": member.UserID, "role": member.Role}, nil)
+	})
+	if err != nil {
+		switch err.Error() {
+		case "shop member not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "shop member not found"})
+		case "shop owner":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the shop owner cannot be removed"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove shop member"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "shop member removed successfully"})
+}
+
+// getMemberShop loads the shop in the :id parameter and checks that the
+// user is one of its members or may manage any shop
+func (h *ShopMemberHandler) getMemberShop(c *gin.Context) (*models.Shop, bool) {
+	shop, ok := getShopParam(c, h.store)
+	if !ok {
+		return nil, false
+	}
+
+	if !middlewares.HasPermission(c, models.PermShopManageAny) {
+		payload, err := middlewares.GetAuthPayload(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return nil, false
+		}
+		if _, err := h.store.GetShopMember(c, shop.ID, payload.UserID); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "you are not a member of this shop"})
+			return nil, false
+		}
+	}
+
+	return shop, true
+}
+
+// getManagedShop loads the shop in the :id parameter and checks that the
+// user may manage its members
+func (h *ShopMemberHandler) getManagedShop(c *gin.Context) (*models.Shop, bool) {
+	shop, ok := getShopParam(c, h.store)
+	if !ok {
+		return nil, false
+	}
+
+	if !canAccessShop(c, h.store, shop.ID, models.PermShopMembers, models.PermShopManageAny) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you don't have permission to manage this shop's members"})
+		return nil, false
+	}
+
+	return shop, true
+}
+
+// getMemberUserID parses the :user_id parameter. It writes the error
+// response and returns false if it is invalid.
+func getMemberUserID(c *gin.Context) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// canAccessShop is the shop policy: users can act on a shop if their shop
+// role there grants perm, and on any shop if their user role grants anyPerm.
+// Routes check separately that the user role grants perm where it can.
+func canAccessShop(c *gin.Context, store *store.Store, shopID uuid.UUID, perm, anyPerm models.Permission) bool {
+	if middlewares.HasPermission(c, anyPerm) {
+		return true
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		return false
+	}
+
+	member, err := store.GetShopMember(c, shopID, payload.UserID)
+	if err != nil {
+		if err.Error() != "shop member not found" {
+			log.Printf("Failed to get membership of user %s in shop %s: %v", payload.UserID, shopID, err)
+		}
+		return false
+	}
+
+	return member.Role.Allows(perm)
+}
+
+// validStaffRole checks that role can be given to staff. There is only one
+// owner per shop. It writes the error response and returns false if not.
+func validStaffRole(c *gin.Context, role models.ShopRole) bool {
+	if !role.IsValid() || role == models.ShopRoleOwner {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be manager or fulfillment"})
+		return false
+	}
+	return true
+}
+
+// shopMemberResponse is a member with the public details of their user
+func shopMemberResponse(member *models.ShopMember) gin.H {
+	response := gin.H{
+		"user_id":    member.UserID,
+		"role":       member.Role,
+		"created_at": member.CreatedAt,
+	}
+	if member.User != nil {
+		response["username"] = member.User.Username
+		response["email"] = member.User.Email
+	}
+	return response
+}
+
+// shopInvitationResponse is an invitation without its token hash
+func shopInvitationResponse(invitation *models.ShopInvitation) gin.H {
+	return gin.H{
+		"id":         invitation.ID,
+		"shop_id":    invitation.ShopID,
+		"email":      invitation.Email,
+		"role":       invitation.Role,
+		"invited_by": invitation.InvitedBy,
+		"expires_at": invitation.ExpiresAt,
+		"created_at": invitation.CreatedAt,
+	}
+}
@@ -1,24 +1,47 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
 	"github.com/qhh/prjEcom/pkg/api/middlewares"
 	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/utils"
 )
 
 type UserHandler struct {
-	store *store.Store
+	store        *store.Store
+	revocations  *middlewares.TokenRevocations
+	verification *VerificationHandler
 }
 
-func NewUserHandler(store *store.Store) *UserHandler {
+func NewUserHandler(store *store.Store, revocations *middlewares.TokenRevocations, verification *VerificationHandler) *UserHandler {
 	return &UserHandler{
-		store: store,
+		store:        store,
+		revocations:  revocations,
+		verification: verification,
 	}
 }
 
+type updateProfileRequest struct {
+	Username string `json:"username" binding:"omitempty,min=3,max=50"`
+	Email    string `json:"email" binding:"omitempty,email"`
+}
+
+type updateUserRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
 // GetProfile returns the user's profile
 func (h *UserHandler) GetProfile(c *gin.Context) {
 	payload, err := middlewares.GetAuthPayload(c)
@@ -34,19 +57,140 @@ func (h *UserHandler) GetProfile(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"id":         user.ID,
-		"username":   user.Username,
-		"email":      user.Email,
-		"role":       user.Role,
-		"created_at": user.CreatedAt,
+		"id":                user.ID,
+		"username":          user.Username,
+		"email":             user.Email,
+		"role":              user.Role,
+		"created_at":        user.CreatedAt,
+		"email_verified_at": user.EmailVerifiedAt,
 	})
 }
 
-// ListUsers returns a paginated list of users (admin only)
+// UpdateProfile changes the current user's username and/or email. A new
+// email has to be verified again.
+func (h *UserHandler) UpdateProfile(c *gin.Context) {
+	var req updateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	user, err := h.store.GetUserByID(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	// Check if username is taken by someone else
+	if req.Username != "" && req.Username != user.Username {
+		existing, err := h.store.GetUserByUsername(c, req.Username)
+		if err == nil && existing.ID != user.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "username already exists"})
+			return
+		} else if err != nil && err.Error() != "user not found" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check username"})
+			return
+		}
+		user.Username = req.Username
+	}
+
+	// Check if email is taken by someone else
+	emailChanged := false
+	if req.Email != "" && req.Email != user.Email {
+		existing, err := h.store.GetUserByEmail(c, req.Email)
+		if err == nil && existing.ID != user.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "email already exists"})
+			return
+		} else if err != nil && err.Error() != "user not found" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check email"})
+			return
+		}
+		user.Email = req.Email
+		user.EmailVerifiedAt = nil
+		emailChanged = true
+	}
+
+	if err := h.store.UpdateUserProfile(c, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update profile"})
+		return
+	}
+
+	if emailChanged {
+		if err := h.verification.sendVerification(c, user); err != nil {
+			log.Printf("Failed to send verification email to user %s: %v", user.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":                user.ID,
+		"username":          user.Username,
+		"email":             user.Email,
+		"role":              user.Role,
+		"created_at":        user.CreatedAt,
+		"email_verified_at": user.EmailVerifiedAt,
+	})
+}
+
+// ChangePassword sets a new password after checking the current one. All
+// of the user's tokens and sessions are revoked, so they log in again.
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	var req changePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	user, err := h.store.GetUserByID(c, payload.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return
+	}
+
+	// Verify current password
+	if err := utils.CheckPassword(req.CurrentPassword, user.PasswordHash); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "current password is incorrect"})
+		return
+	}
+
+	// Hash password
+	hashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	if err := h.store.UpdateUserPassword(c, user.ID, hashedPassword); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change password"})
+		return
+	}
+	h.revocations.Forget(user.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "password changed successfully, please log in again"})
+}
+
+// ListUsers returns a paginated list of users, optionally filtered (admin
+// only)
 func (h *UserHandler) ListUsers(c *gin.Context) {
 	var req struct {
-		Limit  int `form:"limit" binding:"required,min=1,max=100"`
-		Offset int `form:"offset" binding:"required,min=0"`
+		Email          string `form:"email"`
+		Username       string `form:"username"`
+		Role           string `form:"role"`
+		Banned         *bool  `form:"banned"`
+		IncludeDeleted bool   `form:"include_deleted"`
+		Limit          int    `form:"limit" binding:"required,min=1,max=100"`
+		Offset         int    `form:"offset" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindQuery(&req); err != nil {
@@ -54,68 +198,244 @@ func (h *UserHandler) ListUsers(c *gin.Context) {
 		return
 	}
 
-	users, err := h.store.ListUsers(c, req.Limit, req.Offset)
+	filter := store.UserFilter{
+		Email:          req.Email,
+		Username:       req.Username,
+		Role:           models.UserRole(req.Role),
+		Banned:         req.Banned,
+		IncludeDeleted: req.IncludeDeleted,
+	}
+
+	users, err := h.store.ListUsers(c, filter, req.Limit, req.Offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list users"})
 		return
 	}
 
-	c.JSON(http.StatusOK, users)
+	resp := make([]gin.H, len(users))
+	for i, user := range users {
+		resp[i] = adminUserResponse(user)
+	}
+
+	c.JSON(http.StatusOK, resp)
 }
 
-// BanUser bans a user (admin only)
-func (h *UserHandler) BanUser(c *gin.Context) {
+// GetUser returns a user's account details (admin only)
+func (h *UserHandler) GetUser(c *gin.Context) {
+	user, ok := h.getUserParam(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, adminUserResponse(user))
+}
+
+// GetUserShops lists the shops a user owns (admin only)
+func (h *UserHandler) GetUserShops(c *gin.Context) {
+	user, ok := h.getUserParam(c)
+	if !ok {
+		return
+	}
+
+	shops, err := h.store.GetShopsByUserID(c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get shops"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shops)
+}
+
+// GetUserOrders lists the orders a user placed (admin only)
+func (h *UserHandler) GetUserOrders(c *gin.Context) {
+	var req struct {
+		Limit  int `form:"limit" binding:"required,min=1,max=100"`
+		Offset int `form:"offset" binding:"min=0"`
+	}
+
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := h.getUserParam(c)
+	if !ok {
+		return
+	}
+
+	orders, err := h.store.GetOrdersByUserID(c, user.ID, req.Limit, req.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, orders)
+}
+
+// UpdateUserRole changes a user's role (admin only). The user's current
+// tokens are revoked so the new role applies right away.
+func (h *UserHandler) UpdateUserRole(c *gin.Context) {
+	var req updateUserRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload, err := middlewares.GetAuthPayload(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
 	userID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
 		return
 	}
 
-	// Check if user exists
-	_, err = h.store.GetUserByID(c, userID)
+	// Keep at least the acting admin able to manage roles
+	if userID == payload.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot change your own role"})
+		return
+	}
+
+	if _, err := h.store.GetRole(c, models.UserRole(req.Role)); err != nil {
+		if err.Error() == "role not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get role"})
+		return
+	}
+
+	var user *models.User
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		before, err := h.store.GetUserForUpdateTx(c, tx, userID)
+		if err != nil {
+			return err
+		}
+		if before.DeletedAt != nil {
+			return errors.New("user already deleted")
+		}
+
+		user, err = h.store.UpdateUserRoleTx(c, tx, userID, models.UserRole(req.Role))
+		if err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, models.AuditUserRoleChange, models.AuditTargetUser, userID.String(), adminUserResponse(before), adminUserResponse(user))
+	})
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		switch err.Error() {
+		case "user not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		case "user already deleted":
+			c.JSON(http.StatusConflict, gin.H{"error": "user has been deleted"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user role"})
+		}
 		return
 	}
+	h.revocations.Forget(user.ID)
 
-	// Ban user
-	user, err := h.store.BanUser(c, userID)
+	c.JSON(http.StatusOK, adminUserResponse(user))
+}
+
+// DeleteUser soft-deletes a user and anonymizes their personal data (admin
+// only). Their orders and shops are kept.
+func (h *UserHandler) DeleteUser(c *gin.Context) {
+	payload, err := middlewares.GetAuthPayload(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to ban user"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"id":         user.ID,
-		"username":   user.Username,
-		"email":      user.Email,
-		"role":       user.Role,
-		"is_banned":  user.IsBanned,
-		"updated_at": user.UpdatedAt,
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return
+	}
+
+	if userID == payload.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot delete your own account"})
+		return
+	}
+
+	var user *models.User
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		var err error
+		user, err = h.store.DeleteUserTx(c, tx, userID)
+		if err != nil {
+			return err
+		}
+		// The audit log keeps no personal data of deleted users, only
+		// which fields were scrubbed
+		return recordAuditTx(c, tx, h.store, models.AuditUserDelete, models.AuditTargetUser, userID.String(),
+			gin.H{"id": userID, "deleted_at": nil},
+			gin.H{"id": userID, "deleted_at": user.DeletedAt, "changed": store.DeletedUserColumns})
 	})
+	if err != nil {
+		switch err.Error() {
+		case "user not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		case "user already deleted":
+			c.JSON(http.StatusConflict, gin.H{"error": "user has already been deleted"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete user"})
+		}
+		return
+	}
+	h.revocations.Forget(userID)
+
+	c.JSON(http.StatusOK, adminUserResponse(user))
+}
+
+// BanUser bans a user (admin only)
+func (h *UserHandler) BanUser(c *gin.Context) {
+	h.setBanned(c, true)
 }
 
 // UnbanUser unbans a user (admin only)
 func (h *UserHandler) UnbanUser(c *gin.Context) {
+	h.setBanned(c, false)
+}
+
+// setBanned bans or unbans the user in the path and records it in the
+// audit log
+func (h *UserHandler) setBanned(c *gin.Context, banned bool) {
 	userID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
 		return
 	}
 
-	// Check if user exists
-	_, err = h.store.GetUserByID(c, userID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
-		return
+	action, update, failure := models.AuditUserBan, h.store.BanUserTx, "failed to ban user"
+	if !banned {
+		action, update, failure = models.AuditUserUnban, h.store.UnbanUserTx, "failed to unban user"
 	}
 
-	// Unban user
-	user, err := h.store.UnbanUser(c, userID)
+	var user *models.User
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		before, err := h.store.GetUserForUpdateTx(c, tx, userID)
+		if err != nil {
+			return err
+		}
+		snapshot := adminUserResponse(before)
+
+		user, err = update(c, tx, userID)
+		if err != nil {
+			return err
+		}
+		return recordAuditTx(c, tx, h.store, action, models.AuditTargetUser, userID.String(), snapshot, adminUserResponse(user))
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unban user"})
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": failure})
 		return
 	}
+	h.revocations.Forget(userID)
 
 	c.JSON(http.StatusOK, gin.H{
 		"id":         user.ID,
@@ -126,3 +446,41 @@ func (h *UserHandler) UnbanUser(c *gin.Context) {
 		"updated_at": user.UpdatedAt,
 	})
 }
+
+// getUserParam loads the user in the :id route parameter. It writes the
+// error response and returns false if there is none.
+func (h *UserHandler) getUserParam(c *gin.Context) (*models.User, bool) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return nil, false
+	}
+
+	user, err := h.store.GetUserByID(c, userID)
+	if err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+		return nil, false
+	}
+
+	return user, true
+}
+
+// adminUserResponse is the account data admins see. It leaves out the
+// password hash.
+func adminUserResponse(user *models.User) gin.H {
+	return gin.H{
+		"id":                user.ID,
+		"username":          user.Username,
+		"email":             user.Email,
+		"role":              user.Role,
+		"is_banned":         user.IsBanned,
+		"email_verified_at": user.EmailVerifiedAt,
+		"created_at":        user.CreatedAt,
+		"updated_at":        user.UpdatedAt,
+		"deleted_at":        user.DeletedAt,
+	}
+}
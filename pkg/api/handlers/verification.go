@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/mailer"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/utils"
+)
+
+type VerificationHandler struct {
+	store      *store.Store
+	mailer     mailer.Mailer
+	apiBaseURL string
+	duration   time.Duration
+}
+
+func NewVerificationHandler(store *store.Store, mailer mailer.Mailer, apiBaseURL string, duration time.Duration) *VerificationHandler {
+	return &VerificationHandler{
+		store:      store,
+		mailer:     mailer,
+		apiBaseURL: apiBaseURL,
+		duration:   duration,
+	}
+}
+
+type resendVerificationRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// VerifyEmail confirms an email address with the token from the
+// verification email
+func (h *VerificationHandler) VerifyEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	err := h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		verification, err := h.store.GetEmailVerificationTokenForUpdateTx(c, tx, utils.HashOpaqueToken(token))
+		if err != nil {
+			return err
+		}
+		if verification.UsedAt != nil || time.Now().After(verification.ExpiresAt) {
+			return errors.New("verification token not found")
+		}
+
+		// The user may have changed their email since the token was sent
+		verified, err := h.store.MarkEmailVerifiedTx(c, tx, verification.UserID, verification.Email)
+		if err != nil {
+			return err
+		}
+		if !verified {
+			return errors.New("verification token not found")
+		}
+
+		return h.store.MarkEmailVerificationTokenUsedTx(c, tx, verification.ID)
+	})
+
+	if err != nil {
+		if err.Error() == "verification token not found" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired verification token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "email verified successfully"})
+}
+
+// ResendVerification sends a new verification email. Like ForgotPassword,
+// the response doesn't reveal whether the email is registered.
+func (h *VerificationHandler) ResendVerification(c *gin.Context) {
+	var req resendVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "if an unverified account with this email exists, a verification link has been sent"}
+
+	user, err := h.store.GetUserByEmail(c, req.Email)
+	if err != nil {
+		if err.Error() != "user not found" {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get user"})
+			return
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	if user.EmailVerifiedAt == nil && !user.IsBanned {
+		if err := h.sendVerification(c, user); err != nil {
+			log.Printf("Failed to send verification email to user %s: %v", user.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// sendVerification creates a verification token for the user's current
+// email and emails the verification link
+func (h *VerificationHandler) sendVerification(c *gin.Context, user *models.User) error {
+	token, hash, err := utils.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	verification := &models.EmailVerificationToken{
+		UserID:    user.ID,
+		Email:     user.Email,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(h.duration),
+	}
+	if err := h.store.CreateEmailVerificationToken(c, verification); err != nil {
+		return err
+	}
+
+	link := h.apiBaseURL + "/api/auth/verify?token=" + url.QueryEscape(token)
+	return h.mailer.Send(c, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below. It expires in %s.\n\n%s\n\nIf you didn't create an account, you can ignore this email.\n",
+			user.Username, h.duration, link),
+	})
+}
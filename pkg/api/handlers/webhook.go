@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-pg/pg/v10"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/payment"
+)
+
+type WebhookHandler struct {
+	store    *store.Store
+	payments *payment.Registry
+}
+
+func NewWebhookHandler(store *store.Store, payments *payment.Registry) *WebhookHandler {
+	return &WebhookHandler{
+		store:    store,
+		payments: payments,
+	}
+}
+
+// PaymentWebhook receives events pushed by a payment provider. Every event
+// is stored, redeliveries of an already handled event are acknowledged
+// without side effects, and order updates go through the regular status
+// transition path.
+func (h *WebhookHandler) PaymentWebhook(c *gin.Context) {
+	provider, err := h.payments.Get(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown payment provider"})
+		return
+	}
+
+	parser, ok := provider.(payment.WebhookParser)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "payment provider does not support webhooks"})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+
+	// Verify the signature before trusting anything in the body
+	event, err := parser.ParseWebhook(c.Request.Header, body)
+	if err != nil {
+		if errors.Is(err, payment.ErrInvalidSignature) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Store the raw event, detecting redeliveries
+	record := &models.PaymentWebhookEvent{
+		Provider:  provider.Name(),
+		EventID:   event.ID,
+		EventType: event.Type,
+		Payload:   string(body),
+		Status:    models.WebhookReceived,
+	}
+	created, err := h.store.SaveWebhookEvent(c, record)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store webhook event"})
+		return
+	}
+	if !created && isWebhookHandled(record.Status) {
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		return
+	}
+
+	duplicate := false
+	err = h.store.RunInTransaction(c, func(tx *pg.Tx) error {
+		// Another delivery of the same event may have been handled meanwhile
+		if err := h.store.LockWebhookEventTx(c, tx, record); err != nil {
+			return err
+		}
+		if isWebhookHandled(record.Status) {
+			duplicate = true
+			return nil
+		}
+
+		status, note, err := h.applyPaymentEvent(c, tx, provider.Name(), event)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		record.Status = status
+		record.Error = note
+		record.ProcessedAt = &now
+		return h.store.UpdateWebhookEventTx(c, tx, record)
+	})
+
+	if err != nil {
+		// Keep the event so it can be inspected; the provider will retry
+		record.Status = models.WebhookFailed
+		record.Error = err.Error()
+		_ = h.store.UpdateWebhookEvent(c, record)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process webhook event"})
+		return
+	}
+
+	if duplicate {
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": record.Status})
+}
+
+// applyPaymentEvent updates the payment and order an event refers to. It
+// returns the status to store on the event and an optional note explaining
+// why an event was ignored.
+func (h *WebhookHandler) applyPaymentEvent(ctx context.Context, tx *pg.Tx, provider string, event *payment.WebhookEvent) (models.WebhookEventStatus, string, error) {
+	switch event.Type {
+	case payment.EventPaymentCaptured, payment.EventPaymentFailed:
+	default:
+		return models.WebhookIgnored, "unsupported event type", nil
+	}
+
+	pay, err := h.store.GetPaymentByAuthorizationTx(ctx, tx, provider, event.TransactionID)
+	if err != nil {
+		if err.Error() == "payment not found" {
+			return models.WebhookIgnored, "unknown transaction", nil
+		}
+		return "", "", err
+	}
+
+	// Late and replayed events must not undo a capture or a refund
+	if status, note := skipPaymentEvent(event.Type, pay.Status); status != "" {
+		return status, note, nil
+	}
+
+	switch event.Type {
+	case payment.EventPaymentCaptured:
+		// CapturePaymentTx checks the order transition before writing, so
+		// an ignored event leaves nothing behind
+		_, err := h.store.CapturePaymentTx(ctx, tx, pay, nil)
+		if errors.Is(err, models.ErrInvalidStatusTransition) {
+			return models.WebhookIgnored, err.Error(), nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+
+	case payment.EventPaymentFailed:
+		pay.Status = models.PaymentFailed
+		pay.FailureReason = event.Reason
+		if err := h.store.UpdatePaymentTx(ctx, tx, pay); err != nil {
+			return "", "", err
+		}
+	}
+
+	return models.WebhookProcessed, "", nil
+}
+
+// skipPaymentEvent tells whether an event no longer applies to a payment in
+// status. Only authorized payments can be captured or fail; anything else
+// was settled by an earlier event or request. It returns the status to store
+// on the event and a note, or an empty status if the event applies.
+func skipPaymentEvent(eventType string, status models.PaymentStatus) (models.WebhookEventStatus, string) {
+	if status == models.PaymentAuthorized {
+		return "", ""
+	}
+
+	switch {
+	case eventType == payment.EventPaymentCaptured && status != models.PaymentFailed,
+		eventType == payment.EventPaymentFailed && status == models.PaymentFailed:
+		return models.WebhookProcessed, "payment already " + string(status)
+	default:
+		return models.WebhookIgnored, "payment already " + string(status)
+	}
+}
+
+// isWebhookHandled reports whether an event no longer needs processing
+func isWebhookHandled(status models.WebhookEventStatus) bool {
+	return status == models.WebhookProcessed || status == models.WebhookIgnored
+}
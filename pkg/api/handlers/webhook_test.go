@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/payment"
+)
+
+func TestSkipPaymentEvent(t *testing.T) {
+	tests := []struct {
+		event   string
+		payment models.PaymentStatus
+		want    models.WebhookEventStatus
+	}{
+		{payment.EventPaymentCaptured, models.PaymentAuthorized, ""},
+		{payment.EventPaymentCaptured, models.PaymentCaptured, models.WebhookProcessed},
+		{payment.EventPaymentCaptured, models.PaymentPartiallyRefunded, models.WebhookProcessed},
+		{payment.EventPaymentCaptured, models.PaymentRefunded, models.WebhookProcessed},
+		{payment.EventPaymentCaptured, models.PaymentFailed, models.WebhookIgnored},
+		{payment.EventPaymentFailed, models.PaymentAuthorized, ""},
+		{payment.EventPaymentFailed, models.PaymentFailed, models.WebhookProcessed},
+		{payment.EventPaymentFailed, models.PaymentCaptured, models.WebhookIgnored},
+		{payment.EventPaymentFailed, models.PaymentPartiallyRefunded, models.WebhookIgnored},
+		{payment.EventPaymentFailed, models.PaymentRefunded, models.WebhookIgnored},
+	}
+
+	for _, tt := range tests {
+		got, note := skipPaymentEvent(tt.event, tt.payment)
+		if got != tt.want {
+			t.Errorf("%s on a %s payment = %q (%s), want %q", tt.event, tt.payment, got, note, tt.want)
+		}
+		if got != "" && note == "" {
+			t.Errorf("%s on a %s payment has no note", tt.event, tt.payment)
+		}
+	}
+}
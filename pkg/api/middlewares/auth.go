@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/qhh/prjEcom/pkg/models"
 	"github.com/qhh/prjEcom/pkg/utils"
 )
 
@@ -15,8 +16,10 @@ const (
 	authorizationPayloadKey = "authorization_payload"
 )
 
-// AuthMiddleware creates a middleware for authorization
-func AuthMiddleware(jwtMaker *utils.JWTMaker) gin.HandlerFunc {
+// AuthMiddleware creates a middleware for authorization. Tokens of banned
+// users and tokens issued before a revocation are rejected. The permissions
+// of the user's role are loaded for RequirePermission and CanAccess.
+func AuthMiddleware(tokenMaker utils.TokenMaker, revocations *TokenRevocations, permissions *Permissions) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authorizationHeader := c.GetHeader(authorizationHeaderKey)
 		if len(authorizationHeader) == 0 {
@@ -37,46 +40,30 @@ func AuthMiddleware(jwtMaker *utils.JWTMaker) gin.HandlerFunc {
 		}
 
 		accessToken := fields[1]
-		payload, err := jwtMaker.VerifyToken(accessToken)
+		payload, err := tokenMaker.VerifyToken(accessToken)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.Set(authorizationPayloadKey, payload)
-		c.Next()
-	}
-}
-
-// RoleMiddleware creates a middleware for role-based authorization
-func RoleMiddleware(roles ...string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		payload, exists := c.Get(authorizationPayloadKey)
-		if !exists {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		revoked, err := revocations.IsRevoked(c, payload)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check token"})
 			return
 		}
-
-		userPayload, ok := payload.(*utils.Payload)
-		if !ok {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "invalid token payload"})
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token has been revoked"})
 			return
 		}
 
-		// Check if the user has the required role
-		roleMatch := false
-		for _, role := range roles {
-			if userPayload.Role == role {
-				roleMatch = true
-				break
-			}
-		}
-
-		if !roleMatch {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "access denied: required role not found"})
+		set, err := permissions.ForRole(c, models.UserRole(payload.Role))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to load permissions"})
 			return
 		}
 
+		c.Set(authorizationPayloadKey, payload)
+		c.Set(authorizationPermissionsKey, set)
 		c.Next()
 	}
 }
@@ -0,0 +1,43 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// RequireMFA creates a middleware that blocks users whose role must use
+// two-factor authentication until they have enabled it
+func RequireMFA(store *store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		payload, err := GetAuthPayload(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+
+		required, err := store.IsMFARequired(c, models.UserRole(payload.Role))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check mfa policy"})
+			return
+		}
+		if !required {
+			c.Next()
+			return
+		}
+
+		enabled, err := store.IsMFAEnabled(c, payload.UserID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check mfa status"})
+			return
+		}
+		if !enabled {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "two-factor authentication is required for your role, enable it first"})
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,115 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+const authorizationPermissionsKey = "authorization_permissions"
+
+// PermissionSet is the set of permissions a role grants
+type PermissionSet map[models.Permission]bool
+
+// Permissions looks up the permissions of roles. They are cached for a
+// short time; handlers that change a role call Forget so the change
+// applies immediately on this server.
+type Permissions struct {
+	store *store.Store
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	roles map[models.UserRole]rolePermissions
+}
+
+// rolePermissions is the cached permission set of a role
+type rolePermissions struct {
+	set      PermissionSet
+	loadedAt time.Time
+}
+
+// NewPermissions creates a permission lookup that caches roles for ttl
+func NewPermissions(store *store.Store, ttl time.Duration) *Permissions {
+	return &Permissions{
+		store: store,
+		ttl:   ttl,
+		roles: make(map[models.UserRole]rolePermissions),
+	}
+}
+
+// ForRole returns the permissions granted to a role. Unknown roles have
+// none.
+func (p *Permissions) ForRole(ctx context.Context, role models.UserRole) (PermissionSet, error) {
+	p.mu.Lock()
+	cached, ok := p.roles[role]
+	p.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < p.ttl {
+		return cached.set, nil
+	}
+
+	permissions, err := p.store.GetRolePermissions(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(PermissionSet, len(permissions))
+	for _, perm := range permissions {
+		set[perm] = true
+	}
+
+	p.mu.Lock()
+	p.roles[role] = rolePermissions{set: set, loadedAt: time.Now()}
+	p.mu.Unlock()
+	return set, nil
+}
+
+// Forget drops the cached permissions of a role so the next request
+// reloads them
+func (p *Permissions) Forget(role models.UserRole) {
+	p.mu.Lock()
+	delete(p.roles, role)
+	p.mu.Unlock()
+}
+
+// RequirePermission creates a middleware that only lets users whose role
+// grants at least one of perms through
+func RequirePermission(perms ...models.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, perm := range perms {
+			if HasPermission(c, perm) {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "access denied: missing permission " + string(perms[0])})
+	}
+}
+
+// HasPermission reports whether the current user's role grants perm
+func HasPermission(c *gin.Context, perm models.Permission) bool {
+	value, exists := c.Get(authorizationPermissionsKey)
+	if !exists {
+		return false
+	}
+
+	set, ok := value.(PermissionSet)
+	return ok && set[perm]
+}
+
+// CanAccess is the ownership policy: users can act on resources they own,
+// and on other users' resources only if their role grants perm
+func CanAccess(c *gin.Context, ownerID uuid.UUID, perm models.Permission) bool {
+	payload, err := GetAuthPayload(c)
+	if err != nil {
+		return false
+	}
+
+	return payload.UserID == ownerID || HasPermission(c, perm)
+}
@@ -0,0 +1,91 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/utils"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newAuthorizedContext returns a context as AuthMiddleware leaves it for a
+// user whose role grants perms
+func newAuthorizedContext(userID uuid.UUID, perms ...models.Permission) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set(authorizationPayloadKey, &utils.Payload{UserID: userID, Role: "test"})
+	c.Set(authorizationPermissionsKey, newPermissionSet(perms...))
+	return c
+}
+
+func newPermissionSet(perms ...models.Permission) PermissionSet {
+	set := make(PermissionSet, len(perms))
+	for _, perm := range perms {
+		set[perm] = true
+	}
+	return set
+}
+
+func TestRequirePermission(t *testing.T) {
+	tests := []struct {
+		name   string
+		perms  []models.Permission
+		status int
+	}{
+		{"granted", []models.Permission{models.PermOrderRefund}, http.StatusOK},
+		{"any of several", []models.Permission{models.PermOrderRefundAny}, http.StatusOK},
+		{"missing", []models.Permission{models.PermOrderFulfill}, http.StatusForbidden},
+		{"none", nil, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				c.Set(authorizationPermissionsKey, newPermissionSet(tt.perms...))
+			})
+			router.GET("/", RequirePermission(models.PermOrderRefund, models.PermOrderRefundAny), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestHasPermissionWithoutAuth(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if HasPermission(c, models.PermUserRead) {
+		t.Error("HasPermission is true without a permission set")
+	}
+	if CanAccess(c, uuid.New(), models.PermUserRead) {
+		t.Error("CanAccess is true without an auth payload")
+	}
+}
+
+func TestCanAccess(t *testing.T) {
+	owner := uuid.New()
+
+	if !CanAccess(newAuthorizedContext(owner), owner, models.PermOrderReadAny) {
+		t.Error("owner cannot access their own resource")
+	}
+	if CanAccess(newAuthorizedContext(uuid.New()), owner, models.PermOrderReadAny) {
+		t.Error("another user can access the resource without the permission")
+	}
+	if !CanAccess(newAuthorizedContext(uuid.New(), models.PermOrderReadAny), owner, models.PermOrderReadAny) {
+		t.Error("user with the permission cannot access the resource")
+	}
+	if CanAccess(newAuthorizedContext(uuid.New(), models.PermOrderRefundAny), owner, models.PermOrderReadAny) {
+		t.Error("an unrelated permission grants access")
+	}
+}
@@ -0,0 +1,44 @@
+package middlewares
+
+import (
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeaderKey = "X-Request-ID"
+	requestIDKey       = "request_id"
+	clientRequestIDKey = "client_request_id"
+)
+
+// requestIDPattern limits the request IDs accepted from clients and proxies
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID creates a middleware that gives every request a new ID, echoed
+// in the response headers. Clients choose their X-Request-ID, so an ID
+// they send is kept separately for correlation and never used as ours.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id := c.GetHeader(requestIDHeaderKey); requestIDPattern.MatchString(id) {
+			c.Set(clientRequestIDKey, id)
+		}
+
+		id := uuid.NewString()
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeaderKey, id)
+		c.Next()
+	}
+}
+
+// GetRequestID returns the ID of the current request
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// GetClientRequestID returns the X-Request-ID sent by the client or a proxy,
+// if any
+func GetClientRequestID(c *gin.Context) string {
+	return c.GetString(clientRequestIDKey)
+}
@@ -0,0 +1,96 @@
+package middlewares
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/utils"
+)
+
+// TokenRevocations tells whether a correctly signed token must still be
+// rejected because its user was banned or had their tokens revoked after it
+// was issued. User state is cached for a short time so that most requests
+// don't hit the database; handlers that change it call Forget so the change
+// applies immediately on this server.
+type TokenRevocations struct {
+	store *store.Store
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	users map[uuid.UUID]tokenState
+}
+
+// tokenState is the cached revocation state of a user
+type tokenState struct {
+	missing   bool
+	banned    bool
+	revokedAt *time.Time
+	loadedAt  time.Time
+}
+
+// NewTokenRevocations creates a revocation checker that caches user state
+// for ttl
+func NewTokenRevocations(store *store.Store, ttl time.Duration) *TokenRevocations {
+	return &TokenRevocations{
+		store: store,
+		ttl:   ttl,
+		users: make(map[uuid.UUID]tokenState),
+	}
+}
+
+// IsRevoked reports whether the token described by payload is no longer valid
+func (r *TokenRevocations) IsRevoked(ctx context.Context, payload *utils.Payload) (bool, error) {
+	state, err := r.get(ctx, payload.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	if state.missing || state.banned {
+		return true, nil
+	}
+
+	// JWT times have one second precision, so a token issued in the same
+	// second as the revocation is treated as revoked
+	if state.revokedAt != nil && !payload.IssuedAt.After(state.revokedAt.Truncate(time.Second)) {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Forget drops the cached state of a user so the next request reloads it
+func (r *TokenRevocations) Forget(userID uuid.UUID) {
+	r.mu.Lock()
+	delete(r.users, userID)
+	r.mu.Unlock()
+}
+
+func (r *TokenRevocations) get(ctx context.Context, userID uuid.UUID) (tokenState, error) {
+	r.mu.Lock()
+	state, ok := r.users[userID]
+	r.mu.Unlock()
+	if ok && time.Since(state.loadedAt) < r.ttl {
+		return state, nil
+	}
+
+	state = tokenState{loadedAt: time.Now()}
+	user, err := r.store.GetUserByID(ctx, userID)
+	if err != nil {
+		if err.Error() != "user not found" {
+			return tokenState{}, err
+		}
+		state.missing = true
+	} else {
+		state.missing = user.DeletedAt != nil
+		state.banned = user.IsBanned
+		state.revokedAt = user.TokensRevokedAt
+	}
+
+	r.mu.Lock()
+	r.users[userID] = state
+	r.mu.Unlock()
+	return state, nil
+}
@@ -0,0 +1,38 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qhh/prjEcom/pkg/db/store"
+)
+
+// RequireVerifiedEmail creates a middleware that only lets users with a
+// verified email through. When enabled is false it allows every request.
+func RequireVerifiedEmail(store *store.Store, enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !enabled {
+			c.Next()
+			return
+		}
+
+		payload, err := GetAuthPayload(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+
+		user, err := store.GetUserByID(c, payload.UserID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+
+		if user.EmailVerifiedAt == nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "please verify your email address first"})
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -4,43 +4,115 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/qhh/prjEcom/pkg/api/handlers"
 	"github.com/qhh/prjEcom/pkg/api/middlewares"
+	"github.com/qhh/prjEcom/pkg/config"
 	"github.com/qhh/prjEcom/pkg/db/store"
+	"github.com/qhh/prjEcom/pkg/mailer"
+	"github.com/qhh/prjEcom/pkg/models"
+	"github.com/qhh/prjEcom/pkg/payment"
 	"github.com/qhh/prjEcom/pkg/utils"
 )
 
 // SetupRouter sets up all the routes for the API
-func SetupRouter(store *store.Store, jwtMaker *utils.JWTMaker) *gin.Engine {
+func SetupRouter(cfg *config.Config, store *store.Store, tokenMaker utils.TokenMaker, payments *payment.Registry, mail mailer.Mailer) (*gin.Engine, error) {
 	router := gin.Default()
+	// Client IPs come from X-Forwarded-For only behind these proxies
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	// Every request gets an ID, which the audit log records
+	router.Use(middlewares.RequestID())
+
+	// Revoked tokens are looked up per user and cached briefly
+	revocations := middlewares.NewTokenRevocations(store, cfg.TokenRevocationCacheTTL)
+	// So are the permissions of each role
+	permissions := middlewares.NewPermissions(store, cfg.PermissionCacheTTL)
 
 	// Create handlers
-	authHandler := handlers.NewAuthHandler(store, jwtMaker)
-	userHandler := handlers.NewUserHandler(store)
+	verificationHandler := handlers.NewVerificationHandler(store, mail, cfg.APIBaseURL, cfg.EmailVerificationExpiresIn)
+	authHandler := handlers.NewAuthHandler(store, tokenMaker, verificationHandler, cfg.JWTExpiresIn, cfg.RefreshTokenExpiresIn, cfg.MFAChallengeExpiresIn)
+	passwordHandler := handlers.NewPasswordHandler(store, mail, revocations, cfg.AppBaseURL, cfg.PasswordResetExpiresIn)
+	userHandler := handlers.NewUserHandler(store, revocations, verificationHandler)
+	mfaHandler := handlers.NewMFAHandler(store, cfg.MFAIssuer)
+	sellerApplicationHandler := handlers.NewSellerApplicationHandler(store, mail, revocations)
+	roleHandler := handlers.NewRoleHandler(store, permissions)
+	auditHandler := handlers.NewAuditHandler(store)
 	shopHandler := handlers.NewShopHandler(store)
+	shopMemberHandler := handlers.NewShopMemberHandler(store, mail, revocations, cfg.AppBaseURL, cfg.ShopInvitationExpiresIn)
 	productHandler := handlers.NewProductHandler(store)
 	orderHandler := handlers.NewOrderHandler(store)
+	cartHandler := handlers.NewCartHandler(store)
+	checkoutHandler := handlers.NewCheckoutHandler(store)
+	sellerHandler := handlers.NewSellerHandler(store)
+	paymentHandler := handlers.NewPaymentHandler(store, payments, cfg.Currency)
+	webhookHandler := handlers.NewWebhookHandler(store, payments)
+	refundHandler := handlers.NewRefundHandler(store, payments)
+	returnHandler := handlers.NewReturnHandler(store, refundHandler)
+
+	// Public keys for verifying access tokens
+	router.GET("/.well-known/jwks.json", authHandler.JWKS)
 
 	// Auth routes (no authentication required)
 	auth := router.Group("/api/auth")
 	{
 		auth.POST("/register", authHandler.Register)
 		auth.POST("/login", authHandler.Login)
+		auth.POST("/login/mfa", authHandler.LoginMFA)
+		auth.POST("/refresh", authHandler.RefreshToken)
+		auth.POST("/logout", authHandler.Logout)
+		auth.POST("/forgot-password", passwordHandler.ForgotPassword)
+		auth.POST("/reset-password", passwordHandler.ResetPassword)
+		auth.GET("/verify", verificationHandler.VerifyEmail)
+		auth.POST("/verify/resend", verificationHandler.ResendVerification)
+	}
+
+	// Webhook routes (authenticated by provider signature)
+	webhooks := router.Group("/api/webhooks")
+	{
+		webhooks.POST("/payments/:provider", webhookHandler.PaymentWebhook)
 	}
 
 	// Routes requiring authentication
 	api := router.Group("/api")
-	api.Use(middlewares.AuthMiddleware(jwtMaker))
+	api.Use(middlewares.AuthMiddleware(tokenMaker, revocations, permissions))
 	{
+		// Ordering and opening a shop may require a verified email
+		requireVerified := middlewares.RequireVerifiedEmail(store, cfg.RequireEmailVerification)
+		// Roles handling money and inventory may be required to use MFA
+		requireMFA := middlewares.RequireMFA(store)
+
 		// User routes
 		api.GET("/profile", userHandler.GetProfile)
+		api.PUT("/profile", userHandler.UpdateProfile)
+		api.POST("/profile/password", userHandler.ChangePassword)
+
+		// Two-factor authentication
+		api.GET("/profile/mfa", mfaHandler.GetMFAStatus)
+		api.POST("/profile/mfa/enroll", mfaHandler.EnrollMFA)
+		api.POST("/profile/mfa/confirm", mfaHandler.ConfirmMFA)
+		api.POST("/profile/mfa/disable", mfaHandler.DisableMFA)
+		api.POST("/profile/mfa/recovery-codes", mfaHandler.RegenerateRecoveryCodes)
+
+		// Seller onboarding
+		api.POST("/seller-applications", requireVerified, sellerApplicationHandler.CreateSellerApplication)
+		api.GET("/seller-applications", sellerApplicationHandler.GetUserSellerApplications)
 
 		// Shop routes
-		api.POST("/shops", shopHandler.CreateShop)
+		api.POST("/shops", middlewares.RequirePermission(models.PermShopCreate), requireMFA, requireVerified, shopHandler.CreateShop)
 		api.GET("/shops/user", shopHandler.GetUserShops)
 		api.GET("/shops", shopHandler.ListShops)
 		api.GET("/shops/search", shopHandler.SearchShops)
 		api.GET("/shops/:id", shopHandler.GetShop)
 		api.PUT("/shops/:id", shopHandler.UpdateShop)
 
+		// Shop staff
+		api.GET("/shops/:id/members", shopMemberHandler.ListShopMembers)
+		api.PUT("/shops/:id/members/:user_id", shopMemberHandler.UpdateShopMember)
+		api.DELETE("/shops/:id/members/:user_id", shopMemberHandler.RemoveShopMember)
+		api.POST("/shops/:id/invitations", shopMemberHandler.InviteShopMember)
+		api.GET("/shops/:id/invitations", shopMemberHandler.ListShopInvitations)
+		api.DELETE("/shops/:id/invitations/:invitation_id", shopMemberHandler.RevokeShopInvitation)
+		api.POST("/shop-invitations/accept", shopMemberHandler.AcceptShopInvitation)
+
 		// Product routes
 		api.GET("/products", productHandler.ListProducts)
 		api.GET("/products/search", productHandler.SearchProducts)
@@ -50,29 +122,104 @@ func SetupRouter(store *store.Store, jwtMaker *utils.JWTMaker) *gin.Engine {
 		api.GET("/shops/:id/products", productHandler.ListProductsByShop)
 
 		// Order routes
-		api.POST("/orders", orderHandler.CreateOrder)
+		api.POST("/orders", requireVerified, orderHandler.CreateOrder)
 		api.GET("/orders/:id", orderHandler.GetOrder)
+		api.GET("/orders/:id/history", orderHandler.GetOrderHistory)
+		api.POST("/orders/:id/cancel", orderHandler.CancelOrder)
+
+		// Payment routes
+		api.POST("/orders/:id/pay", paymentHandler.PayOrder)
+		api.GET("/orders/:id/payments", paymentHandler.GetOrderPayments)
+
+		// Refund routes
+		api.GET("/orders/:id/refunds", refundHandler.GetOrderRefunds)
+		api.POST("/orders/:id/refunds", middlewares.RequirePermission(models.PermOrderRefund, models.PermOrderRefundAny), requireMFA, refundHandler.CreateRefund)
+		api.POST("/orders/:id/refunds/:refund_id/resume", middlewares.RequirePermission(models.PermOrderRefund, models.PermOrderRefundAny), requireMFA, refundHandler.ResumeRefund)
 		api.GET("/orders", orderHandler.GetUserOrders)
 
-		// Seller routes (require seller role)
+		// Return routes
+		api.POST("/orders/:id/returns", returnHandler.CreateReturn)
+		api.GET("/orders/:id/returns", returnHandler.GetOrderReturns)
+		api.POST("/returns/:id/ship", returnHandler.ShipReturn)
+
+		// Cart routes
+		api.GET("/cart", cartHandler.GetCart)
+		api.POST("/cart/items", cartHandler.AddCartItem)
+		api.PUT("/cart/items/:product_id", cartHandler.UpdateCartItem)
+		api.DELETE("/cart/items/:product_id", cartHandler.RemoveCartItem)
+		api.POST("/cart/checkout", requireVerified, cartHandler.Checkout)
+
+		// Checkout routes
+		api.POST("/checkouts", requireVerified, checkoutHandler.CreateCheckout)
+		api.GET("/checkouts/:id", checkoutHandler.GetCheckout)
+
+		// Seller routes. The user role must allow the action, then handlers
+		// check that the user's shop role allows it in the shop, unless
+		// their user role lets them act on any shop.
 		seller := api.Group("/seller")
-		seller.Use(middlewares.RoleMiddleware("seller", "admin"))
+		seller.Use(requireMFA)
 		{
-			seller.POST("/products", productHandler.CreateProduct)
-			seller.PUT("/products/:id", productHandler.UpdateProduct)
-			seller.DELETE("/products/:id", productHandler.DeleteProduct)
+			writeProducts := middlewares.RequirePermission(models.PermProductWrite, models.PermProductWriteAny)
+			seller.POST("/products", writeProducts, productHandler.CreateProduct)
+			seller.PUT("/products/:id", writeProducts, productHandler.UpdateProduct)
+			seller.DELETE("/products/:id", writeProducts, productHandler.DeleteProduct)
+
+			fulfill := middlewares.RequirePermission(models.PermOrderFulfill, models.PermShopManageAny)
+
+			// Order fulfillment
+			seller.GET("/shops/:id/orders", fulfill, sellerHandler.ListShopOrders)
+			seller.GET("/shops/:id/orders/:order_id", fulfill, sellerHandler.GetShopOrder)
+			seller.POST("/shops/:id/orders/:order_id/ship", fulfill, sellerHandler.ShipOrder)
+			seller.PUT("/shops/:id/orders/:order_id/status", fulfill, sellerHandler.UpdateShopOrderStatus)
+
+			// Returns
+			seller.GET("/shops/:id/returns", fulfill, returnHandler.ListShopReturns)
+			seller.POST("/shops/:id/returns/:return_id/approve", fulfill, returnHandler.ApproveReturn)
+			seller.POST("/shops/:id/returns/:return_id/reject", fulfill, returnHandler.RejectReturn)
+			seller.POST("/shops/:id/returns/:return_id/receive", fulfill, returnHandler.ReceiveReturn)
+
+			// Shop analytics
+			seller.GET("/shops/:id/stats", fulfill, sellerHandler.GetShopStats)
 		}
 
-		// Admin routes (require admin role)
+		// Admin routes, each requiring its own permission
 		admin := api.Group("/admin")
-		admin.Use(middlewares.RoleMiddleware("admin"))
+		admin.Use(requireMFA)
 		{
-			admin.GET("/users", userHandler.ListUsers)
-			admin.POST("/users/:id/ban", userHandler.BanUser)
-			admin.POST("/users/:id/unban", userHandler.UnbanUser)
-			admin.PUT("/orders/:id/status", orderHandler.UpdateOrderStatus)
+			readUsers := middlewares.RequirePermission(models.PermUserRead)
+			banUsers := middlewares.RequirePermission(models.PermUserBan)
+			manageUsers := middlewares.RequirePermission(models.PermUserManage)
+			admin.GET("/users", readUsers, userHandler.ListUsers)
+			admin.GET("/users/:id", readUsers, userHandler.GetUser)
+			admin.GET("/users/:id/shops", readUsers, userHandler.GetUserShops)
+			admin.GET("/users/:id/orders", readUsers, userHandler.GetUserOrders)
+			admin.PUT("/users/:id/role", manageUsers, userHandler.UpdateUserRole)
+			admin.DELETE("/users/:id", manageUsers, userHandler.DeleteUser)
+			admin.POST("/users/:id/ban", banUsers, userHandler.BanUser)
+			admin.POST("/users/:id/unban", banUsers, userHandler.UnbanUser)
+
+			admin.PUT("/orders/:id/status", middlewares.RequirePermission(models.PermOrderManage), orderHandler.UpdateOrderStatus)
+
+			reviewApplications := middlewares.RequirePermission(models.PermSellerReview)
+			admin.GET("/seller-applications", reviewApplications, sellerApplicationHandler.ListSellerApplications)
+			admin.GET("/seller-applications/:id", reviewApplications, sellerApplicationHandler.GetSellerApplication)
+			admin.POST("/seller-applications/:id/approve", reviewApplications, sellerApplicationHandler.ApproveSellerApplication)
+			admin.POST("/seller-applications/:id/reject", reviewApplications, sellerApplicationHandler.RejectSellerApplication)
+
+			manageMFAPolicy := middlewares.RequirePermission(models.PermMFAPolicyManage)
+			admin.GET("/mfa-policy", manageMFAPolicy, mfaHandler.GetMFAPolicy)
+			admin.PUT("/mfa-policy", manageMFAPolicy, mfaHandler.UpdateMFAPolicy)
+
+			manageRoles := middlewares.RequirePermission(models.PermRoleManage)
+			admin.GET("/permissions", manageRoles, roleHandler.ListPermissions)
+			admin.GET("/roles", manageRoles, roleHandler.ListRoles)
+			admin.POST("/roles", manageRoles, roleHandler.CreateRole)
+			admin.PUT("/roles/:name", manageRoles, roleHandler.UpdateRole)
+			admin.DELETE("/roles/:name", manageRoles, roleHandler.DeleteRole)
+
+			admin.GET("/audit-events", middlewares.RequirePermission(models.PermAuditRead), auditHandler.ListAuditEvents)
 		}
 	}
 
-	return router
+	return router, nil
 }
@@ -22,30 +22,151 @@ func InitDatabase(db *pg.DB) error {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	// Add columns introduced after the tables were first created
+	err = addColumns(db)
+	if err != nil {
+		return fmt.Errorf("failed to add columns: %w", err)
+	}
+
+	// Index the audit log and enforce constraints CreateTable can't express
+	err = createIndexes(db)
+	if err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+
+	// Store roles as text and create the built-in roles
+	err = initRoles(db)
+	if err != nil {
+		return fmt.Errorf("failed to initialize roles: %w", err)
+	}
+
+	// Make shop owners members of their shops
+	err = initShopMembers(db)
+	if err != nil {
+		return fmt.Errorf("failed to initialize shop members: %w", err)
+	}
+
 	log.Println("Database schema initialized successfully")
 	return nil
 }
 
 // createEnumTypes creates the necessary enum types in PostgreSQL
 func createEnumTypes(db *pg.DB) error {
-	// Create user_role enum if it doesn't exist
+	// Create order_status enum if it doesn't exist
 	_, err := db.Exec(`DO $$ 
 	BEGIN 
-		IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_role') THEN
-			CREATE TYPE user_role AS ENUM ('admin', 'seller', 'buyer');
+		IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'order_status') THEN
+			CREATE TYPE order_status AS ENUM ('pending', 'paid', 'shipped', 'delivered', 'canceled', 'refunded');
 		END IF;
 	END $$;`)
 	if err != nil {
 		return err
 	}
 
-	// Create order_status enum if it doesn't exist
-	_, err = db.Exec(`DO $$ 
-	BEGIN 
-		IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'order_status') THEN
-			CREATE TYPE order_status AS ENUM ('pending', 'paid', 'shipped', 'delivered', 'canceled');
-		END IF;
-	END $$;`)
+	// Add order_status values introduced after the type was first created
+	_, err = db.Exec(`ALTER TYPE order_status ADD VALUE IF NOT EXISTS 'refunded'`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// addColumns adds columns that were introduced after a table was first
+// created. CreateTable only creates missing tables, so existing databases
+// need these statements to pick up new fields.
+func addColumns(db *pg.DB) error {
+	statements := []string{
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS checkout_id uuid`,
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS carrier text`,
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS tracking_number text`,
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipped_at timestamptz`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_revoked_at timestamptz`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at timestamptz`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamptz`,
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS refunded_amount double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE user_mfa ADD COLUMN IF NOT EXISTS failed_attempts integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE user_mfa ADD COLUMN IF NOT EXISTS locked_until timestamptz`,
+		`ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS remote_ip text`,
+		`ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS client_request_id text`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createIndexes creates indexes that CreateTable can't express
+func createIndexes(db *pg.DB) error {
+	statements := []string{
+		`CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at)`,
+		`CREATE INDEX IF NOT EXISTS audit_events_actor_idx ON audit_events (actor_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS audit_events_target_idx ON audit_events (target_type, target_id, created_at)`,
+		// A user can only have one application waiting for review
+		`CREATE UNIQUE INDEX IF NOT EXISTS seller_applications_pending_user_idx ON seller_applications (user_id) WHERE status = 'pending'`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// initRoles turns the role columns, which used to be a user_role enum, into
+// text so that custom roles can be stored, then creates the built-in roles.
+// Their default permissions are only granted when a role is first created,
+// so changes made by admins survive restarts, except that the admin role is
+// always given every permission.
+func initRoles(db *pg.DB) error {
+	statements := []string{
+		`ALTER TABLE users ALTER COLUMN role DROP DEFAULT`,
+		`ALTER TABLE users ALTER COLUMN role TYPE text`,
+		`ALTER TABLE users ALTER COLUMN role SET DEFAULT 'buyer'`,
+		`ALTER TABLE mfa_policies ALTER COLUMN role TYPE text`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []models.UserRole{models.RoleAdmin, models.RoleSeller, models.RoleBuyer, models.RoleStaff} {
+		role := &models.Role{Name: name, BuiltIn: true}
+		res, err := db.Model(role).OnConflict("(name) DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 && name != models.RoleAdmin {
+			continue
+		}
+
+		for _, perm := range models.DefaultRolePermissions[name] {
+			grant := &models.RolePermission{Role: name, Permission: perm}
+			_, err := db.Model(grant).OnConflict("DO NOTHING").Insert()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
 
+// initShopMembers gives every shop owner the owner role in their shop.
+// Shops created before shop members existed only recorded the owner in
+// shops.user_id.
+func initShopMembers(db *pg.DB) error {
+	_, err := db.Exec(`INSERT INTO shop_members (shop_id, user_id, role)
+		SELECT id, user_id, ? FROM shops
+		ON CONFLICT (shop_id, user_id) DO UPDATE SET role = EXCLUDED.role, updated_at = now()
+		WHERE shop_members.role <> EXCLUDED.role`, models.ShopRoleOwner)
 	return err
 }
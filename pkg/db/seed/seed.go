@@ -9,6 +9,7 @@ import (
 
 	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/db/store"
 	"github.com/qhh/prjEcom/pkg/models"
 	"github.com/qhh/prjEcom/pkg/utils"
 )
@@ -19,15 +20,20 @@ func SeedDatabase(db *pg.DB) error {
 	rand.Seed(time.Now().UnixNano())
 
 	ctx := context.Background()
+	shops := store.NewStore(db)
+
+	// Seeded accounts don't need to verify their email
+	verifiedAt := time.Now()
 
 	// Seed admin user
 	adminPassword, _ := utils.HashPassword("admin123")
 	adminUser := &models.User{
-		ID:           uuid.New(),
-		Username:     "admin",
-		Email:        "admin@example.com",
-		PasswordHash: adminPassword,
-		Role:         models.RoleAdmin,
+		ID:              uuid.New(),
+		Username:        "admin",
+		Email:           "admin@example.com",
+		PasswordHash:    adminPassword,
+		Role:            models.RoleAdmin,
+		EmailVerifiedAt: &verifiedAt,
 	}
 
 	_, err := db.ModelContext(ctx, adminUser).Insert()
@@ -50,11 +56,12 @@ func SeedDatabase(db *pg.DB) error {
 	for _, s := range sellers {
 		sellerPassword, _ := utils.HashPassword(s.password)
 		sellerUser := &models.User{
-			ID:           uuid.New(),
-			Username:     s.username,
-			Email:        s.email,
-			PasswordHash: sellerPassword,
-			Role:         models.RoleSeller,
+			ID:              uuid.New(),
+			Username:        s.username,
+			Email:           s.email,
+			PasswordHash:    sellerPassword,
+			Role:            models.RoleSeller,
+			EmailVerifiedAt: &verifiedAt,
 		}
 
 		_, err := db.ModelContext(ctx, sellerUser).Insert()
@@ -73,7 +80,8 @@ func SeedDatabase(db *pg.DB) error {
 			// LogoUrl:     "https://via.placeholder.com/150",
 		}
 
-		_, err = db.ModelContext(ctx, shop).Insert()
+		// CreateShop also makes the seller the shop's owner member
+		err = shops.CreateShop(ctx, shop)
 		if err != nil {
 			log.Printf("Error creating shop for %s: %v", sellerUser.Username, err)
 			continue
@@ -111,11 +119,12 @@ func SeedDatabase(db *pg.DB) error {
 	for i := 1; i <= 5; i++ {
 		buyerPassword, _ := utils.HashPassword(fmt.Sprintf("buyer%d", i))
 		buyerUser := &models.User{
-			ID:           uuid.New(),
-			Username:     fmt.Sprintf("buyer%d", i),
-			Email:        fmt.Sprintf("buyer%d@example.com", i),
-			PasswordHash: buyerPassword,
-			Role:         models.RoleBuyer,
+			ID:              uuid.New(),
+			Username:        fmt.Sprintf("buyer%d", i),
+			Email:           fmt.Sprintf("buyer%d@example.com", i),
+			PasswordHash:    buyerPassword,
+			Role:            models.RoleBuyer,
+			EmailVerifiedAt: &verifiedAt,
 		}
 
 		_, err := db.ModelContext(ctx, buyerUser).Insert()
@@ -9,6 +9,8 @@ import (
 
 	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/db/schema"
+	"github.com/qhh/prjEcom/pkg/db/store"
 	"github.com/qhh/prjEcom/pkg/models"
 	"github.com/qhh/prjEcom/pkg/utils"
 )
@@ -34,27 +36,27 @@ func main() {
 	})
 	defer db.Close()
 
-	// Create schema and enum types
-	err := createEnumTypes(db)
+	// Create the schema, built-in roles and role permissions
+	err := schema.InitDatabase(db)
 	if err != nil {
-		log.Fatalf("Failed to create enum types: %v", err)
-	}
-
-	err = models.CreateSchema(db)
-	if err != nil {
-		log.Fatalf("Failed to create schema: %v", err)
+		log.Fatalf("Failed to initialize schema: %v", err)
 	}
 
 	ctx := context.Background()
+	shops := store.NewStore(db)
+
+	// Seeded accounts don't need to verify their email
+	verifiedAt := time.Now()
 
 	// Seed admin user
 	adminPassword, _ := utils.HashPassword("admin123")
 	adminUser := &models.User{
-		ID:           uuid.New(),
-		Username:     "admin",
-		Email:        "admin@example.com",
-		PasswordHash: adminPassword,
-		Role:         models.RoleAdmin,
+		ID:              uuid.New(),
+		Username:        "admin",
+		Email:           "admin@example.com",
+		PasswordHash:    adminPassword,
+		Role:            models.RoleAdmin,
+		EmailVerifiedAt: &verifiedAt,
 	}
 
 	_, err = db.ModelContext(ctx, adminUser).Insert()
@@ -77,11 +79,12 @@ func main() {
 	for _, s := range sellers {
 		sellerPassword, _ := utils.HashPassword(s.password)
 		sellerUser := &models.User{
-			ID:           uuid.New(),
-			Username:     s.username,
-			Email:        s.email,
-			PasswordHash: sellerPassword,
-			Role:         models.RoleSeller,
+			ID:              uuid.New(),
+			Username:        s.username,
+			Email:           s.email,
+			PasswordHash:    sellerPassword,
+			Role:            models.RoleSeller,
+			EmailVerifiedAt: &verifiedAt,
 		}
 
 		_, err = db.ModelContext(ctx, sellerUser).Insert()
@@ -100,7 +103,8 @@ func main() {
 			LogoURL:     "https://via.placeholder.com/150",
 		}
 
-		_, err = db.ModelContext(ctx, shop).Insert()
+		// CreateShop also makes the seller the shop's owner member
+		err = shops.CreateShop(ctx, shop)
 		if err != nil {
 			log.Printf("Error creating shop for %s: %v", sellerUser.Username, err)
 			continue
@@ -140,11 +144,12 @@ func main() {
 	for i := 1; i <= 5; i++ {
 		buyerPassword, _ := utils.HashPassword(fmt.Sprintf("buyer%d", i))
 		buyerUser := &models.User{
-			ID:           uuid.New(),
-			Username:     fmt.Sprintf("buyer%d", i),
-			Email:        fmt.Sprintf("buyer%d@example.com", i),
-			PasswordHash: buyerPassword,
-			Role:         models.RoleBuyer,
+			ID:              uuid.New(),
+			Username:        fmt.Sprintf("buyer%d", i),
+			Email:           fmt.Sprintf("buyer%d@example.com", i),
+			PasswordHash:    buyerPassword,
+			Role:            models.RoleBuyer,
+			EmailVerifiedAt: &verifiedAt,
 		}
 
 		_, err = db.ModelContext(ctx, buyerUser).Insert()
@@ -157,27 +162,3 @@ func main() {
 
 	log.Println("Seeding completed.")
 }
-
-// createEnumTypes creates the necessary enum types in PostgreSQL
-func createEnumTypes(db *pg.DB) error {
-	// Create user_role enum if it doesn't exist
-	_, err := db.Exec(`DO $$ 
-	BEGIN 
-		IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_role') THEN
-			CREATE TYPE user_role AS ENUM ('admin', 'seller', 'buyer');
-		END IF;
-	END $$;`)
-	if err != nil {
-		return err
-	}
-
-	// Create order_status enum if it doesn't exist
-	_, err = db.Exec(`DO $$ 
-	BEGIN 
-		IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'order_status') THEN
-			CREATE TYPE order_status AS ENUM ('pending', 'paid', 'shipped', 'delivered', 'canceled');
-		END IF;
-	END $$;`)
-
-	return err
-}
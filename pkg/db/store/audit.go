@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Audit log operations
+
+// CreateAuditEventTx records an audit event in the transaction of the
+// action it describes, so the event exists exactly when the action does
+func (s *Store) CreateAuditEventTx(ctx context.Context, tx *pg.Tx, event *models.AuditEvent) error {
+	_, err := tx.ModelContext(ctx, event).Insert()
+	return err
+}
+
+type AuditFilter struct {
+	ActorID    *uuid.UUID
+	Action     models.AuditAction
+	TargetType models.AuditTargetType
+	TargetID   string
+	RequestID  string
+	From       time.Time
+	To         time.Time
+}
+
+// ListAuditEvents lists audit events matching filter, newest first
+func (s *Store) ListAuditEvents(ctx context.Context, filter AuditFilter, limit, offset int) ([]*models.AuditEvent, error) {
+	var events []*models.AuditEvent
+	query := s.db.ModelContext(ctx, &events)
+	if filter.ActorID != nil {
+		query = query.Where("actor_id = ?", *filter.ActorID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		query = query.Where("target_id = ?", filter.TargetID)
+	}
+	if filter.RequestID != "" {
+		query = query.Where("request_id = ?", filter.RequestID)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+	err := query.
+		Order("created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Select()
+	return events, err
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Cart operations
+func (s *Store) GetOrCreateCart(ctx context.Context, userID uuid.UUID) (*models.Cart, error) {
+	cart := &models.Cart{UserID: userID}
+	_, err := s.db.ModelContext(ctx, cart).
+		Where("user_id = ?user_id").
+		OnConflict("DO NOTHING").
+		SelectOrInsert()
+	if err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+func (s *Store) GetCartItems(ctx context.Context, cartID uuid.UUID) ([]*models.CartItem, error) {
+	var items []*models.CartItem
+	err := s.db.ModelContext(ctx, &items).
+		Where("cart_id = ?", cartID).
+		Order("created_at ASC").
+		Select()
+	return items, err
+}
+
+// AddCartItem adds a product to the cart, or increases its quantity if the
+// product is already in the cart
+func (s *Store) AddCartItem(ctx context.Context, cartID, productID uuid.UUID, quantity int32) (*models.CartItem, error) {
+	item := &models.CartItem{
+		CartID:    cartID,
+		ProductID: productID,
+		Quantity:  quantity,
+	}
+	_, err := s.db.ModelContext(ctx, item).
+		OnConflict("(cart_id, product_id) DO UPDATE").
+		Set("quantity = cart_item.quantity + EXCLUDED.quantity, updated_at = now()").
+		Returning("*").
+		Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.touchCart(ctx, cartID)
+	return item, err
+}
+
+func (s *Store) UpdateCartItemQuantity(ctx context.Context, cartID, productID uuid.UUID, quantity int32) (*models.CartItem, error) {
+	item := &models.CartItem{}
+	res, err := s.db.ModelContext(ctx, item).
+		Set("quantity = ?", quantity).
+		Set("updated_at = ?", time.Now()).
+		Where("cart_id = ? AND product_id = ?", cartID, productID).
+		Returning("*").
+		Update()
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		return nil, errors.New("cart item not found")
+	}
+
+	err = s.touchCart(ctx, cartID)
+	return item, err
+}
+
+func (s *Store) RemoveCartItem(ctx context.Context, cartID, productID uuid.UUID) error {
+	res, err := s.db.ModelContext(ctx, (*models.CartItem)(nil)).
+		Where("cart_id = ? AND product_id = ?", cartID, productID).
+		Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return errors.New("cart item not found")
+	}
+	return s.touchCart(ctx, cartID)
+}
+
+// ClearCartTx removes every item from a cart inside an existing transaction
+func (s *Store) ClearCartTx(ctx context.Context, tx *pg.Tx, cartID uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.CartItem)(nil)).
+		Where("cart_id = ?", cartID).
+		Delete()
+	if err != nil {
+		return err
+	}
+	_, err = tx.ModelContext(ctx, (*models.Cart)(nil)).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", cartID).
+		Update()
+	return err
+}
+
+// touchCart bumps the cart's updated_at timestamp
+func (s *Store) touchCart(ctx context.Context, cartID uuid.UUID) error {
+	_, err := s.db.ModelContext(ctx, (*models.Cart)(nil)).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", cartID).
+		Update()
+	return err
+}
@@ -0,0 +1,32 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Checkout operations
+func (s *Store) GetCheckoutByID(ctx context.Context, id uuid.UUID) (*models.Checkout, error) {
+	checkout := &models.Checkout{ID: id}
+	err := s.db.ModelContext(ctx, checkout).WherePK().Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("checkout not found")
+		}
+		return nil, err
+	}
+	return checkout, nil
+}
+
+func (s *Store) GetOrdersByCheckoutID(ctx context.Context, checkoutID uuid.UUID) ([]*models.Order, error) {
+	var orders []*models.Order
+	err := s.db.ModelContext(ctx, &orders).
+		Where("checkout_id = ?", checkoutID).
+		Order("created_at ASC").
+		Select()
+	return orders, err
+}
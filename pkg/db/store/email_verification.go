@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Email verification operations
+
+// CreateEmailVerificationToken stores a new verification token and
+// invalidates the user's earlier unused ones, so only the latest email works
+func (s *Store) CreateEmailVerificationToken(ctx context.Context, token *models.EmailVerificationToken) error {
+	return s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		_, err := tx.ModelContext(ctx, (*models.EmailVerificationToken)(nil)).
+			Set("used_at = ?", time.Now()).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).
+			Update()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ModelContext(ctx, token).Insert()
+		return err
+	})
+}
+
+// GetEmailVerificationTokenForUpdateTx loads and locks a verification token
+// by hash
+func (s *Store) GetEmailVerificationTokenForUpdateTx(ctx context.Context, tx *pg.Tx, hash string) (*models.EmailVerificationToken, error) {
+	token := &models.EmailVerificationToken{}
+	err := tx.ModelContext(ctx, token).
+		Where("token_hash = ?", hash).
+		For("UPDATE").
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("verification token not found")
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *Store) MarkEmailVerificationTokenUsedTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.EmailVerificationToken)(nil)).
+		Set("used_at = ?", time.Now()).
+		Where("id = ?", id).
+		Update()
+	return err
+}
+
+// MarkEmailVerifiedTx records that a user owns email. Nothing changes if the
+// user's email is no longer the verified address.
+func (s *Store) MarkEmailVerifiedTx(ctx context.Context, tx *pg.Tx, userID uuid.UUID, email string) (bool, error) {
+	res, err := tx.ModelContext(ctx, (*models.User)(nil)).
+		Set("email_verified_at = ?", time.Now()).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ? AND email = ?", userID, email).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
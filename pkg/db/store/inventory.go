@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Inventory operations
+
+// RestockOrderTx returns the quantity of every item of an order to its
+// product and records a stock movement for each one. Items whose product
+// has since been deleted are skipped.
+func (s *Store) RestockOrderTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID, reason models.StockMovementReason) error {
+	var items []*models.OrderItem
+	err := tx.ModelContext(ctx, &items).
+		Where("order_id = ?", orderID).
+		Select()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := s.RestockProductTx(ctx, tx, item.ProductID, &orderID, item.Quantity, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestockProductTx adds quantity to a product's stock and records the
+// movement. It does nothing if the product no longer exists.
+func (s *Store) RestockProductTx(ctx context.Context, tx *pg.Tx, productID uuid.UUID, orderID *uuid.UUID, quantity int32, reason models.StockMovementReason) error {
+	res, err := tx.ModelContext(ctx, (*models.Product)(nil)).
+		Set("stock = stock + ?", quantity).
+		Where("id = ?", productID).
+		Update()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return nil
+	}
+
+	movement := &models.StockMovement{
+		ProductID: productID,
+		OrderID:   orderID,
+		Quantity:  quantity,
+		Reason:    reason,
+	}
+	_, err = tx.ModelContext(ctx, movement).Insert()
+	return err
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// MFA operations
+
+func (s *Store) GetUserMFA(ctx context.Context, userID uuid.UUID) (*models.UserMFA, error) {
+	mfa := &models.UserMFA{}
+	err := s.db.ModelContext(ctx, mfa).Where("user_id = ?", userID).Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("mfa not found")
+		}
+		return nil, err
+	}
+	return mfa, nil
+}
+
+// GetUserMFAForUpdateTx loads and locks a user's MFA settings
+func (s *Store) GetUserMFAForUpdateTx(ctx context.Context, tx *pg.Tx, userID uuid.UUID) (*models.UserMFA, error) {
+	mfa := &models.UserMFA{}
+	err := tx.ModelContext(ctx, mfa).Where("user_id = ?", userID).For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("mfa not found")
+		}
+		return nil, err
+	}
+	return mfa, nil
+}
+
+// IsMFAEnabled reports whether a user has confirmed MFA enrollment
+func (s *Store) IsMFAEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	return s.db.ModelContext(ctx, (*models.UserMFA)(nil)).
+		Where("user_id = ? AND enabled_at IS NOT NULL", userID).
+		Exists()
+}
+
+// StartMFAEnrollment stores a new, not yet enabled secret for a user,
+// replacing an unfinished enrollment
+func (s *Store) StartMFAEnrollment(ctx context.Context, mfa *models.UserMFA) error {
+	_, err := s.db.ModelContext(ctx, mfa).
+		OnConflict("(user_id) DO UPDATE").
+		Set("secret = EXCLUDED.secret").
+		Set("enabled_at = NULL").
+		Set("last_used_step = 0").
+		Set("updated_at = now()").
+		Where("user_mfa.enabled_at IS NULL").
+		Insert()
+	return err
+}
+
+func (s *Store) UpdateUserMFATx(ctx context.Context, tx *pg.Tx, mfa *models.UserMFA) error {
+	mfa.UpdatedAt = time.Now()
+	_, err := tx.ModelContext(ctx, mfa).WherePK().Update()
+	return err
+}
+
+// DeleteUserMFATx removes a user's MFA secret and recovery codes
+func (s *Store) DeleteUserMFATx(ctx context.Context, tx *pg.Tx, userID uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.MFARecoveryCode)(nil)).
+		Where("user_id = ?", userID).
+		Delete()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ModelContext(ctx, (*models.UserMFA)(nil)).
+		Where("user_id = ?", userID).
+		Delete()
+	return err
+}
+
+// ReplaceRecoveryCodesTx discards a user's recovery codes and stores new ones
+func (s *Store) ReplaceRecoveryCodesTx(ctx context.Context, tx *pg.Tx, userID uuid.UUID, hashes []string) error {
+	_, err := tx.ModelContext(ctx, (*models.MFARecoveryCode)(nil)).
+		Where("user_id = ?", userID).
+		Delete()
+	if err != nil {
+		return err
+	}
+
+	codes := make([]*models.MFARecoveryCode, len(hashes))
+	for i, hash := range hashes {
+		codes[i] = &models.MFARecoveryCode{UserID: userID, CodeHash: hash}
+	}
+	_, err = tx.ModelContext(ctx, &codes).Insert()
+	return err
+}
+
+// UseRecoveryCodeTx marks an unused recovery code as used. It returns false
+// if the user has no such code.
+func (s *Store) UseRecoveryCodeTx(ctx context.Context, tx *pg.Tx, userID uuid.UUID, hash string) (bool, error) {
+	res, err := tx.ModelContext(ctx, (*models.MFARecoveryCode)(nil)).
+		Set("used_at = ?", time.Now()).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// CountUnusedRecoveryCodes returns how many recovery codes a user has left
+func (s *Store) CountUnusedRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error) {
+	return s.db.ModelContext(ctx, (*models.MFARecoveryCode)(nil)).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count()
+}
+
+func (s *Store) CreateMFAChallenge(ctx context.Context, challenge *models.MFAChallenge) error {
+	_, err := s.db.ModelContext(ctx, challenge).Insert()
+	return err
+}
+
+// GetMFAChallengeForUpdateTx loads and locks a login challenge by hash
+func (s *Store) GetMFAChallengeForUpdateTx(ctx context.Context, tx *pg.Tx, hash string) (*models.MFAChallenge, error) {
+	challenge := &models.MFAChallenge{}
+	err := tx.ModelContext(ctx, challenge).
+		Where("token_hash = ?", hash).
+		For("UPDATE").
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("mfa challenge not found")
+		}
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func (s *Store) UpdateMFAChallengeTx(ctx context.Context, tx *pg.Tx, challenge *models.MFAChallenge) error {
+	_, err := tx.ModelContext(ctx, challenge).WherePK().Update()
+	return err
+}
+
+// MFA policy operations
+
+func (s *Store) GetMFAPolicies(ctx context.Context) ([]*models.MFAPolicy, error) {
+	var policies []*models.MFAPolicy
+	err := s.db.ModelContext(ctx, &policies).Order("role ASC").Select()
+	return policies, err
+}
+
+// IsMFARequired reports whether users with the role must use MFA
+func (s *Store) IsMFARequired(ctx context.Context, role models.UserRole) (bool, error) {
+	return s.db.ModelContext(ctx, (*models.MFAPolicy)(nil)).
+		Where("role = ? AND required", role).
+		Exists()
+}
+
+// IsMFARequiredTx is IsMFARequired inside a transaction
+func (s *Store) IsMFARequiredTx(ctx context.Context, tx *pg.Tx, role models.UserRole) (bool, error) {
+	return tx.ModelContext(ctx, (*models.MFAPolicy)(nil)).
+		Where("role = ? AND required", role).
+		Exists()
+}
+
+// SetMFAPolicyTx records whether users with the role must use MFA
+func (s *Store) SetMFAPolicyTx(ctx context.Context, tx *pg.Tx, policy *models.MFAPolicy) error {
+	policy.UpdatedAt = time.Now()
+	_, err := tx.ModelContext(ctx, policy).
+		OnConflict("(role) DO UPDATE").
+		Set("required = EXCLUDED.required").
+		Set("updated_by = EXCLUDED.updated_by").
+		Set("updated_at = EXCLUDED.updated_at").
+		Insert()
+	return err
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Password reset operations
+
+// CreatePasswordResetToken stores a new reset token and invalidates the
+// user's earlier unused ones, so only the latest email works
+func (s *Store) CreatePasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error {
+	return s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		_, err := tx.ModelContext(ctx, (*models.PasswordResetToken)(nil)).
+			Set("used_at = ?", time.Now()).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).
+			Update()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ModelContext(ctx, token).Insert()
+		return err
+	})
+}
+
+// GetPasswordResetTokenForUpdateTx loads and locks a reset token by hash
+func (s *Store) GetPasswordResetTokenForUpdateTx(ctx context.Context, tx *pg.Tx, hash string) (*models.PasswordResetToken, error) {
+	token := &models.PasswordResetToken{}
+	err := tx.ModelContext(ctx, token).
+		Where("token_hash = ?", hash).
+		For("UPDATE").
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("password reset token not found")
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *Store) MarkPasswordResetTokenUsedTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.PasswordResetToken)(nil)).
+		Set("used_at = ?", time.Now()).
+		Where("id = ?", id).
+		Update()
+	return err
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Payment operations
+func (s *Store) CreatePayment(ctx context.Context, payment *models.Payment) error {
+	_, err := s.db.ModelContext(ctx, payment).Insert()
+	return err
+}
+
+func (s *Store) UpdatePayment(ctx context.Context, payment *models.Payment) error {
+	payment.UpdatedAt = time.Now()
+	_, err := s.db.ModelContext(ctx, payment).WherePK().Update()
+	return err
+}
+
+// CapturePayment records a successful capture and marks the order as paid
+// in a single transaction
+func (s *Store) CapturePayment(ctx context.Context, payment *models.Payment, changedBy *uuid.UUID) (*models.Order, error) {
+	var order *models.Order
+	err := s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
+		order, err = s.CapturePaymentTx(ctx, tx, payment, changedBy)
+		return err
+	})
+	return order, err
+}
+
+// CapturePaymentTx is CapturePayment inside an existing transaction. The
+// order is moved first, so nothing is written when it can't become paid.
+func (s *Store) CapturePaymentTx(ctx context.Context, tx *pg.Tx, payment *models.Payment, changedBy *uuid.UUID) (*models.Order, error) {
+	order, err := s.UpdateOrderStatusTx(ctx, tx, payment.OrderID, models.StatusPaid, changedBy, "payment captured via "+payment.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	payment.Status = models.PaymentCaptured
+	payment.UpdatedAt = time.Now()
+	if _, err := tx.ModelContext(ctx, payment).WherePK().Update(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *Store) GetPaymentByID(ctx context.Context, id uuid.UUID) (*models.Payment, error) {
+	payment := &models.Payment{ID: id}
+	err := s.db.ModelContext(ctx, payment).WherePK().Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("payment not found")
+		}
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (s *Store) GetPaymentsByOrderID(ctx context.Context, orderID uuid.UUID) ([]*models.Payment, error) {
+	var payments []*models.Payment
+	err := s.db.ModelContext(ctx, &payments).
+		Where("order_id = ?", orderID).
+		Order("created_at ASC").
+		Select()
+	return payments, err
+}
+
+// GetPaymentByAuthorizationTx loads and locks the payment a provider
+// authorization belongs to
+func (s *Store) GetPaymentByAuthorizationTx(ctx context.Context, tx *pg.Tx, provider, authorizationID string) (*models.Payment, error) {
+	payment := &models.Payment{}
+	err := tx.ModelContext(ctx, payment).
+		Where("provider = ? AND provider_authorization = ?", provider, authorizationID).
+		For("UPDATE").
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("payment not found")
+		}
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (s *Store) UpdatePaymentTx(ctx context.Context, tx *pg.Tx, payment *models.Payment) error {
+	payment.UpdatedAt = time.Now()
+	_, err := tx.ModelContext(ctx, payment).WherePK().Update()
+	return err
+}
+
+// Payment webhook operations
+
+// SaveWebhookEvent stores a provider event unless an event with the same
+// provider and event ID already exists. It returns false and loads the
+// stored event into event when it is a redelivery.
+func (s *Store) SaveWebhookEvent(ctx context.Context, event *models.PaymentWebhookEvent) (bool, error) {
+	res, err := s.db.ModelContext(ctx, event).
+		OnConflict("(provider, event_id) DO NOTHING").
+		Insert()
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() > 0 {
+		return true, nil
+	}
+
+	err = s.db.ModelContext(ctx, event).
+		Where("provider = ? AND event_id = ?", event.Provider, event.EventID).
+		Select()
+	return false, err
+}
+
+// LockWebhookEventTx reloads a stored event and locks it so concurrent
+// deliveries are processed one at a time
+func (s *Store) LockWebhookEventTx(ctx context.Context, tx *pg.Tx, event *models.PaymentWebhookEvent) error {
+	return tx.ModelContext(ctx, event).WherePK().For("UPDATE").Select()
+}
+
+func (s *Store) UpdateWebhookEvent(ctx context.Context, event *models.PaymentWebhookEvent) error {
+	_, err := s.db.ModelContext(ctx, event).WherePK().Update()
+	return err
+}
+
+func (s *Store) UpdateWebhookEventTx(ctx context.Context, tx *pg.Tx, event *models.PaymentWebhookEvent) error {
+	_, err := tx.ModelContext(ctx, event).WherePK().Update()
+	return err
+}
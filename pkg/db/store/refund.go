@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Refund operations
+
+// GetOrderForUpdateTx loads and locks an order inside a transaction
+func (s *Store) GetOrderForUpdateTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID) (*models.Order, error) {
+	order := &models.Order{ID: orderID}
+	err := tx.ModelContext(ctx, order).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("order not found")
+		}
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *Store) GetOrderItemsTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID) ([]*models.OrderItem, error) {
+	var items []*models.OrderItem
+	err := tx.ModelContext(ctx, &items).
+		Where("order_id = ?", orderID).
+		Select()
+	return items, err
+}
+
+// GetRefundedAmountTx returns the total already refunded for an order,
+// including refunds that are still being sent to the payment provider
+func (s *Store) GetRefundedAmountTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID) (float64, error) {
+	var amount float64
+	_, err := tx.QueryOneContext(ctx, pg.Scan(&amount), `
+		SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE order_id = ? AND status <> ?
+	`, orderID, models.RefundFailed)
+	return amount, err
+}
+
+// GetRefundedQuantitiesTx returns how many units of each order item have
+// already been refunded or are being refunded, keyed by order item ID
+func (s *Store) GetRefundedQuantitiesTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID) (map[uuid.UUID]int32, error) {
+	var rows []struct {
+		OrderItemID uuid.UUID `pg:"order_item_id"`
+		Quantity    int32     `pg:"quantity"`
+	}
+	_, err := tx.QueryContext(ctx, &rows, `
+		SELECT ri.order_item_id, SUM(ri.quantity) AS quantity
+		FROM refund_items ri
+		JOIN refunds r ON r.id = ri.refund_id
+		WHERE r.order_id = ? AND r.status <> ?
+		GROUP BY ri.order_item_id
+	`, orderID, models.RefundFailed)
+	if err != nil {
+		return nil, err
+	}
+
+	quantities := make(map[uuid.UUID]int32, len(rows))
+	for _, row := range rows {
+		quantities[row.OrderItemID] = row.Quantity
+	}
+	return quantities, nil
+}
+
+// GetCapturedPaymentTx returns the captured payment of an order, or nil if
+// the order was not paid through a provider
+func (s *Store) GetCapturedPaymentTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID) (*models.Payment, error) {
+	payment := &models.Payment{}
+	err := tx.ModelContext(ctx, payment).
+		Where("order_id = ?", orderID).
+		Where("status IN (?)", pg.In([]models.PaymentStatus{
+			models.PaymentCaptured,
+			models.PaymentPartiallyRefunded,
+			models.PaymentRefunded,
+		})).
+		Order("created_at DESC").
+		Limit(1).
+		For("UPDATE").
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return payment, nil
+}
+
+// GetPaymentForUpdateTx loads and locks a payment
+func (s *Store) GetPaymentForUpdateTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.Payment, error) {
+	payment := &models.Payment{ID: id}
+	err := tx.ModelContext(ctx, payment).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("payment not found")
+		}
+		return nil, err
+	}
+	return payment, nil
+}
+
+// CreateRefundTx inserts a refund with its items
+func (s *Store) CreateRefundTx(ctx context.Context, tx *pg.Tx, refund *models.Refund) error {
+	if _, err := tx.ModelContext(ctx, refund).Insert(); err != nil {
+		return err
+	}
+	for _, item := range refund.Items {
+		item.RefundID = refund.ID
+		if _, err := tx.ModelContext(ctx, item).Insert(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRefundTx loads a refund with its items. Callers lock the refund's
+// order first, which serializes changes to its refunds.
+func (s *Store) GetRefundTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.Refund, error) {
+	refund := &models.Refund{}
+	err := tx.ModelContext(ctx, refund).
+		Relation("Items").
+		Where("refund.id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("refund not found")
+		}
+		return nil, err
+	}
+	return refund, nil
+}
+
+// GetRefundByID loads a refund with its items
+func (s *Store) GetRefundByID(ctx context.Context, id uuid.UUID) (*models.Refund, error) {
+	refund := &models.Refund{}
+	err := s.db.ModelContext(ctx, refund).
+		Relation("Items").
+		Where("refund.id = ?", id).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("refund not found")
+		}
+		return nil, err
+	}
+	return refund, nil
+}
+
+// SetRefundProviderID saves the provider reference of a refund that the
+// payment provider has accepted, while it is still pending
+func (s *Store) SetRefundProviderID(ctx context.Context, refund *models.Refund) error {
+	_, err := s.db.ModelContext(ctx, (*models.Refund)(nil)).
+		Set("provider_refund_id = ?", refund.ProviderRefundID).
+		Where("id = ? AND status = ?", refund.ID, models.RefundPending).
+		Update()
+	return err
+}
+
+// UpdateRefundTx saves the status and provider reference of a refund
+func (s *Store) UpdateRefundTx(ctx context.Context, tx *pg.Tx, refund *models.Refund) error {
+	_, err := tx.ModelContext(ctx, refund).
+		Column("status", "provider_refund_id").
+		WherePK().
+		Update()
+	return err
+}
+
+// FailRefund marks a refund that the payment provider rejected as failed,
+// which releases its amount and items for another refund
+func (s *Store) FailRefund(ctx context.Context, id uuid.UUID) error {
+	_, err := s.db.ModelContext(ctx, (*models.Refund)(nil)).
+		Set("status = ?", models.RefundFailed).
+		Where("id = ? AND status = ?", id, models.RefundPending).
+		Update()
+	return err
+}
+
+// UpdateOrderRefundedAmountTx saves the refunded total of an order
+func (s *Store) UpdateOrderRefundedAmountTx(ctx context.Context, tx *pg.Tx, order *models.Order) error {
+	order.UpdatedAt = time.Now()
+	_, err := tx.ModelContext(ctx, order).
+		Column("refunded_amount", "updated_at").
+		WherePK().
+		Update()
+	return err
+}
+
+// CompleteCancellationRefundTx marks the pending refund of a canceled order
+// as completed
+func (s *Store) CompleteCancellationRefundTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.OrderCancellation)(nil)).
+		Set("refund_status = ?", models.RefundCompleted).
+		Set("updated_at = ?", time.Now()).
+		Where("order_id = ? AND refund_status = ?", orderID, models.RefundPending).
+		Update()
+	return err
+}
+
+func (s *Store) GetRefundsByOrderID(ctx context.Context, orderID uuid.UUID) ([]*models.Refund, error) {
+	var refunds []*models.Refund
+	err := s.db.ModelContext(ctx, &refunds).
+		Relation("Items").
+		Where("refund.order_id = ?", orderID).
+		Order("refund.created_at ASC").
+		Select()
+	return refunds, err
+}
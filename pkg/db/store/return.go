@@ -0,0 +1,126 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Return request operations
+
+// CreateReturnRequestTx inserts a return request with its items
+func (s *Store) CreateReturnRequestTx(ctx context.Context, tx *pg.Tx, request *models.ReturnRequest) error {
+	if _, err := tx.ModelContext(ctx, request).Insert(); err != nil {
+		return err
+	}
+	for _, item := range request.Items {
+		item.ReturnRequestID = request.ID
+		if _, err := tx.ModelContext(ctx, item).Insert(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetReturnRequestByID(ctx context.Context, id uuid.UUID) (*models.ReturnRequest, error) {
+	request := &models.ReturnRequest{ID: id}
+	err := s.db.ModelContext(ctx, request).
+		Relation("Items").
+		WherePK().
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("return request not found")
+		}
+		return nil, err
+	}
+	return request, nil
+}
+
+// GetReturnRequestForUpdateTx loads and locks a return request with its
+// items inside a transaction
+func (s *Store) GetReturnRequestForUpdateTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.ReturnRequest, error) {
+	request := &models.ReturnRequest{ID: id}
+	err := tx.ModelContext(ctx, request).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("return request not found")
+		}
+		return nil, err
+	}
+
+	err = tx.ModelContext(ctx, &request.Items).
+		Where("return_request_id = ?", id).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+func (s *Store) GetReturnRequestsByOrderID(ctx context.Context, orderID uuid.UUID) ([]*models.ReturnRequest, error) {
+	var requests []*models.ReturnRequest
+	err := s.db.ModelContext(ctx, &requests).
+		Relation("Items").
+		Where("return_request.order_id = ?", orderID).
+		Order("return_request.created_at ASC").
+		Select()
+	return requests, err
+}
+
+// GetReturnRequestsByShopID lists the return requests of a shop, newest
+// first, optionally filtered by status
+func (s *Store) GetReturnRequestsByShopID(ctx context.Context, shopID uuid.UUID, status models.ReturnStatus, limit, offset int) ([]*models.ReturnRequest, error) {
+	var requests []*models.ReturnRequest
+	query := s.db.ModelContext(ctx, &requests).
+		Relation("Items").
+		Where("return_request.shop_id = ?", shopID)
+
+	if status != "" {
+		query = query.Where("return_request.status = ?", status)
+	}
+
+	err := query.
+		Order("return_request.created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Select()
+	return requests, err
+}
+
+func (s *Store) UpdateReturnRequestTx(ctx context.Context, tx *pg.Tx, request *models.ReturnRequest) error {
+	request.UpdatedAt = time.Now()
+	_, err := tx.ModelContext(ctx, request).WherePK().Update()
+	return err
+}
+
+// GetOpenReturnQuantitiesTx returns how many units of each order item are
+// part of a return request that is still in progress, keyed by order item ID.
+// Rejected requests free their items and received ones are counted as
+// refunds instead.
+func (s *Store) GetOpenReturnQuantitiesTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID) (map[uuid.UUID]int32, error) {
+	var rows []struct {
+		OrderItemID uuid.UUID `pg:"order_item_id"`
+		Quantity    int32     `pg:"quantity"`
+	}
+	_, err := tx.QueryContext(ctx, &rows, `
+		SELECT ri.order_item_id, SUM(ri.quantity) AS quantity
+		FROM return_items ri
+		JOIN return_requests r ON r.id = ri.return_request_id
+		WHERE r.order_id = ? AND r.status NOT IN (?, ?)
+		GROUP BY ri.order_item_id
+	`, orderID, models.ReturnRejected, models.ReturnReceived)
+	if err != nil {
+		return nil, err
+	}
+
+	quantities := make(map[uuid.UUID]int32, len(rows))
+	for _, row := range rows {
+		quantities[row.OrderItemID] = row.Quantity
+	}
+	return quantities, nil
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Role operations
+
+// GetRoles lists all roles with their permissions
+func (s *Store) GetRoles(ctx context.Context) ([]*models.Role, error) {
+	var roles []*models.Role
+	err := s.db.ModelContext(ctx, &roles).Order("name ASC").Select()
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []*models.RolePermission
+	err = s.db.ModelContext(ctx, &grants).Order("permission ASC").Select()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[models.UserRole]*models.Role, len(roles))
+	for _, role := range roles {
+		role.Permissions = []models.Permission{}
+		byName[role.Name] = role
+	}
+	for _, grant := range grants {
+		if role, ok := byName[grant.Role]; ok {
+			role.Permissions = append(role.Permissions, grant.Permission)
+		}
+	}
+	return roles, nil
+}
+
+func (s *Store) GetRole(ctx context.Context, name models.UserRole) (*models.Role, error) {
+	role := &models.Role{Name: name}
+	err := s.db.ModelContext(ctx, role).WherePK().Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("role not found")
+		}
+		return nil, err
+	}
+
+	role.Permissions, err = s.GetRolePermissions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// GetRoleForUpdateTx loads and locks a role with its permissions
+func (s *Store) GetRoleForUpdateTx(ctx context.Context, tx *pg.Tx, name models.UserRole) (*models.Role, error) {
+	role := &models.Role{Name: name}
+	err := tx.ModelContext(ctx, role).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("role not found")
+		}
+		return nil, err
+	}
+
+	role.Permissions = []models.Permission{}
+	err = tx.ModelContext(ctx, (*models.RolePermission)(nil)).
+		Column("permission").
+		Where("role = ?", name).
+		Order("permission ASC").
+		Select(&role.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// GetRolePermissions returns the permissions granted to a role
+func (s *Store) GetRolePermissions(ctx context.Context, name models.UserRole) ([]models.Permission, error) {
+	permissions := []models.Permission{}
+	err := s.db.ModelContext(ctx, (*models.RolePermission)(nil)).
+		Column("permission").
+		Where("role = ?", name).
+		Order("permission ASC").
+		Select(&permissions)
+	return permissions, err
+}
+
+// CreateRoleTx inserts a custom role with its permissions
+func (s *Store) CreateRoleTx(ctx context.Context, tx *pg.Tx, role *models.Role) error {
+	res, err := tx.ModelContext(ctx, role).OnConflict("(name) DO NOTHING").Insert()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return errors.New("role already exists")
+	}
+	return s.setRolePermissionsTx(ctx, tx, role.Name, role.Permissions)
+}
+
+// UpdateRoleTx saves a role's description and replaces its permissions
+func (s *Store) UpdateRoleTx(ctx context.Context, tx *pg.Tx, role *models.Role) error {
+	role.UpdatedAt = time.Now()
+	_, err := tx.ModelContext(ctx, role).
+		Column("description", "updated_at").
+		WherePK().
+		Update()
+	if err != nil {
+		return err
+	}
+	return s.setRolePermissionsTx(ctx, tx, role.Name, role.Permissions)
+}
+
+// DeleteRoleTx removes a custom role. Roles that users still have can't be
+// deleted.
+func (s *Store) DeleteRoleTx(ctx context.Context, tx *pg.Tx, name models.UserRole) error {
+	inUse, err := tx.ModelContext(ctx, (*models.User)(nil)).
+		Where("role = ?", name).
+		Exists()
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return errors.New("role in use")
+	}
+
+	for _, model := range []interface{}{
+		(*models.RolePermission)(nil),
+		(*models.MFAPolicy)(nil),
+	} {
+		_, err := tx.ModelContext(ctx, model).Where("role = ?", name).Delete()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ModelContext(ctx, (*models.Role)(nil)).Where("name = ?", name).Delete()
+	return err
+}
+
+func (s *Store) setRolePermissionsTx(ctx context.Context, tx *pg.Tx, name models.UserRole, permissions []models.Permission) error {
+	_, err := tx.ModelContext(ctx, (*models.RolePermission)(nil)).
+		Where("role = ?", name).
+		Delete()
+	if err != nil {
+		return err
+	}
+
+	if len(permissions) == 0 {
+		return nil
+	}
+
+	grants := make([]*models.RolePermission, len(permissions))
+	for i, perm := range permissions {
+		grants[i] = &models.RolePermission{Role: name, Permission: perm}
+	}
+	_, err = tx.ModelContext(ctx, &grants).OnConflict("DO NOTHING").Insert()
+	return err
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Seller application operations
+
+// CreateSellerApplication stores a new application. A unique index allows
+// one pending application per user, so concurrent requests can't both pass
+// the HasPendingSellerApplication check.
+func (s *Store) CreateSellerApplication(ctx context.Context, application *models.SellerApplication) error {
+	_, err := s.db.ModelContext(ctx, application).Insert()
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) && pgErr.IntegrityViolation() && pgErr.Field('n') == "seller_applications_pending_user_idx" {
+		return errors.New("pending seller application exists")
+	}
+	return err
+}
+
+func (s *Store) GetSellerApplicationByID(ctx context.Context, id uuid.UUID) (*models.SellerApplication, error) {
+	application := &models.SellerApplication{ID: id}
+	err := s.db.ModelContext(ctx, application).WherePK().Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("seller application not found")
+		}
+		return nil, err
+	}
+	return application, nil
+}
+
+// GetSellerApplicationForUpdateTx loads and locks a seller application
+func (s *Store) GetSellerApplicationForUpdateTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.SellerApplication, error) {
+	application := &models.SellerApplication{ID: id}
+	err := tx.ModelContext(ctx, application).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("seller application not found")
+		}
+		return nil, err
+	}
+	return application, nil
+}
+
+// GetSellerApplicationsByUserID lists a user's applications, newest first
+func (s *Store) GetSellerApplicationsByUserID(ctx context.Context, userID uuid.UUID) ([]*models.SellerApplication, error) {
+	var applications []*models.SellerApplication
+	err := s.db.ModelContext(ctx, &applications).
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Select()
+	return applications, err
+}
+
+// HasPendingSellerApplication reports whether a user has an application
+// waiting for review
+func (s *Store) HasPendingSellerApplication(ctx context.Context, userID uuid.UUID) (bool, error) {
+	return s.db.ModelContext(ctx, (*models.SellerApplication)(nil)).
+		Where("user_id = ? AND status = ?", userID, models.ApplicationPending).
+		Exists()
+}
+
+// ListSellerApplications lists applications, oldest first so they are
+// reviewed in order, optionally filtered by status
+func (s *Store) ListSellerApplications(ctx context.Context, status models.SellerApplicationStatus, limit, offset int) ([]*models.SellerApplication, error) {
+	var applications []*models.SellerApplication
+	query := s.db.ModelContext(ctx, &applications)
+
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	err := query.
+		Order("created_at ASC").
+		Limit(limit).
+		Offset(offset).
+		Select()
+	return applications, err
+}
+
+func (s *Store) UpdateSellerApplicationTx(ctx context.Context, tx *pg.Tx, application *models.SellerApplication) error {
+	application.UpdatedAt = time.Now()
+	_, err := tx.ModelContext(ctx, application).WherePK().Update()
+	return err
+}
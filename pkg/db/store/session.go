@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Session operations
+
+func (s *Store) CreateSessionTx(ctx context.Context, tx *pg.Tx, session *models.Session) error {
+	_, err := tx.ModelContext(ctx, session).Insert()
+	return err
+}
+
+// GetSessionByTokenHashTx loads and locks the session of a refresh token
+func (s *Store) GetSessionByTokenHashTx(ctx context.Context, tx *pg.Tx, hash string) (*models.Session, error) {
+	session := &models.Session{}
+	err := tx.ModelContext(ctx, session).
+		Where("refresh_token_hash = ?", hash).
+		For("UPDATE").
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("session not found")
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// MarkSessionRotatedTx records that a session's refresh token was exchanged
+// for a new one
+func (s *Store) MarkSessionRotatedTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.Session)(nil)).
+		Set("rotated_at = ?", time.Now()).
+		Where("id = ?", id).
+		Update()
+	return err
+}
+
+// RevokeSessionFamilyTx revokes every session descending from the same login
+func (s *Store) RevokeSessionFamilyTx(ctx context.Context, tx *pg.Tx, familyID uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.Session)(nil)).
+		Set("revoked_at = ?", time.Now()).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update()
+	return err
+}
+
+// RevokeUserSessionsTx revokes all sessions of a user so none of their
+// refresh tokens can be used again
+func (s *Store) RevokeUserSessionsTx(ctx context.Context, tx *pg.Tx, userID uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.Session)(nil)).
+		Set("revoked_at = ?", time.Now()).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update()
+	return err
+}
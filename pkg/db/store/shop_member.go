@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/qhh/prjEcom/pkg/models"
+)
+
+// Shop member operations
+
+// GetShopMember returns a user's membership in a shop
+func (s *Store) GetShopMember(ctx context.Context, shopID, userID uuid.UUID) (*models.ShopMember, error) {
+	member := &models.ShopMember{}
+	err := s.db.ModelContext(ctx, member).
+		Where("shop_id = ? AND user_id = ?", shopID, userID).
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("shop member not found")
+		}
+		return nil, err
+	}
+	return member, nil
+}
+
+// GetShopMembers lists the members of a shop with their users, owner first
+func (s *Store) GetShopMembers(ctx context.Context, shopID uuid.UUID) ([]*models.ShopMember, error) {
+	var members []*models.ShopMember
+	err := s.db.ModelContext(ctx, &members).
+		Relation("User").
+		Where("shop_member.shop_id = ?", shopID).
+		OrderExpr("shop_member.role = ? DESC, shop_member.created_at ASC", models.ShopRoleOwner).
+		Select()
+	return members, err
+}
+
+// GetShopsByMemberID lists the shops a user owns or works for
+func (s *Store) GetShopsByMemberID(ctx context.Context, userID uuid.UUID) ([]*models.Shop, error) {
+	var shops []*models.Shop
+	err := s.db.ModelContext(ctx, &shops).
+		Where("id IN (SELECT shop_id FROM shop_members WHERE user_id = ?)", userID).
+		Order("created_at ASC").
+		Select()
+	return shops, err
+}
+
+// AddShopMemberTx adds a user to a shop
+func (s *Store) AddShopMemberTx(ctx context.Context, tx *pg.Tx, member *models.ShopMember) error {
+	res, err := tx.ModelContext(ctx, member).
+		OnConflict("(shop_id, user_id) DO NOTHING").
+		Insert()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return errors.New("already a shop member")
+	}
+	return nil
+}
+
+// GetShopMemberForUpdateTx loads and locks a user's membership in a shop
+func (s *Store) GetShopMemberForUpdateTx(ctx context.Context, tx *pg.Tx, shopID, userID uuid.UUID) (*models.ShopMember, error) {
+	member := &models.ShopMember{}
+	err := tx.ModelContext(ctx, member).
+		Where("shop_id = ? AND user_id = ?", shopID, userID).
+		For("UPDATE").
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("shop member not found")
+		}
+		return nil, err
+	}
+	return member, nil
+}
+
+// UpdateShopMemberRoleTx changes a member's shop role
+func (s *Store) UpdateShopMemberRoleTx(ctx context.Context, tx *pg.Tx, member *models.ShopMember) error {
+	member.UpdatedAt = time.Now()
+	_, err := tx.ModelContext(ctx, member).
+		Column("role", "updated_at").
+		WherePK().
+		Update()
+	return err
+}
+
+// DeleteShopMemberTx removes a user from a shop
+func (s *Store) DeleteShopMemberTx(ctx context.Context, tx *pg.Tx, shopID, userID uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.ShopMember)(nil)).
+		Where("shop_id = ? AND user_id = ?", shopID, userID).
+		Delete()
+	return err
+}
+
+// Shop invitation operations
+
+// CreateShopInvitationTx stores a new invitation and withdraws earlier
+// pending invitations of the same email to the shop, so only the latest
+// email works
+func (s *Store) CreateShopInvitationTx(ctx context.Context, tx *pg.Tx, invitation *models.ShopInvitation) error {
+	_, err := tx.ModelContext(ctx, (*models.ShopInvitation)(nil)).
+		Where("shop_id = ? AND lower(email) = lower(?) AND accepted_at IS NULL", invitation.ShopID, invitation.Email).
+		Delete()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ModelContext(ctx, invitation).Insert()
+	return err
+}
+
+// GetPendingShopInvitations lists a shop's invitations that can still be
+// accepted, newest first
+func (s *Store) GetPendingShopInvitations(ctx context.Context, shopID uuid.UUID) ([]*models.ShopInvitation, error) {
+	var invitations []*models.ShopInvitation
+	err := s.db.ModelContext(ctx, &invitations).
+		Where("shop_id = ? AND accepted_at IS NULL AND expires_at > ?", shopID, time.Now()).
+		Order("created_at DESC").
+		Select()
+	return invitations, err
+}
+
+// GetShopInvitationForUpdateTx loads and locks an invitation by token hash
+func (s *Store) GetShopInvitationForUpdateTx(ctx context.Context, tx *pg.Tx, hash string) (*models.ShopInvitation, error) {
+	invitation := &models.ShopInvitation{}
+	err := tx.ModelContext(ctx, invitation).
+		Where("token_hash = ?", hash).
+		For("UPDATE").
+		Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("shop invitation not found")
+		}
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (s *Store) UpdateShopInvitationTx(ctx context.Context, tx *pg.Tx, invitation *models.ShopInvitation) error {
+	_, err := tx.ModelContext(ctx, invitation).WherePK().Update()
+	return err
+}
+
+// DeleteShopInvitation withdraws a pending invitation. It returns false if
+// the shop has no such invitation.
+func (s *Store) DeleteShopInvitation(ctx context.Context, shopID, id uuid.UUID) (bool, error) {
+	res, err := s.db.ModelContext(ctx, (*models.ShopInvitation)(nil)).
+		Where("id = ? AND shop_id = ? AND accepted_at IS NULL", id, shopID).
+		Delete()
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShopOrderStatistics summarizes the orders of a shop over a date range.
+// Revenue and average order value exclude canceled orders and money
+// refunded to buyers.
+type ShopOrderStatistics struct {
+	TotalOrders       int     `pg:"total_orders" json:"total_orders"`
+	CanceledOrders    int     `pg:"canceled_orders" json:"canceled_orders"`
+	TotalRevenue      float64 `pg:"total_revenue" json:"total_revenue"`
+	AverageOrderValue float64 `pg:"average_order_value" json:"average_order_value"`
+	CancellationRate  float64 `pg:"cancellation_rate" json:"cancellation_rate"`
+}
+
+// SalesBucket holds the order statistics of a single day, week or month
+type SalesBucket struct {
+	Period time.Time `pg:"period" json:"period"`
+	ShopOrderStatistics
+}
+
+// TopProduct is a product ranked by the revenue it brought in
+type TopProduct struct {
+	ProductID uuid.UUID `pg:"product_id" json:"product_id"`
+	Name      string    `pg:"name" json:"name"`
+	Quantity  int       `pg:"quantity" json:"quantity"`
+	Revenue   float64   `pg:"revenue" json:"revenue"`
+}
+
+// orderStatisticsColumns computes ShopOrderStatistics over orderStatisticsFrom
+const orderStatisticsColumns = `
+	COUNT(*) AS total_orders,
+	COUNT(*) FILTER (WHERE status = 'canceled') AS canceled_orders,
+	COALESCE(SUM(total_amount - refunded) FILTER (WHERE status <> 'canceled'), 0) AS total_revenue,
+	COALESCE(AVG(total_amount - refunded) FILTER (WHERE status <> 'canceled'), 0) AS average_order_value,
+	COALESCE(COUNT(*) FILTER (WHERE status = 'canceled')::float8 / NULLIF(COUNT(*), 0), 0) AS cancellation_rate`
+
+// orderStatisticsFrom is the orders table with the amount of completed
+// refunds of each order
+const orderStatisticsFrom = `
+	(SELECT o.*, COALESCE(r.amount, 0) AS refunded
+	FROM orders o
+	LEFT JOIN (
+		SELECT order_id, SUM(amount) AS amount
+		FROM refunds
+		WHERE status = 'completed'
+		GROUP BY order_id
+	) r ON r.order_id = o.id) orders`
+
+// Thêm thống kê đơn hàng cho shop
+func (s *Store) GetShopOrderStatistics(ctx context.Context, shopID uuid.UUID, startDate, endDate time.Time) (*ShopOrderStatistics, error) {
+	var result ShopOrderStatistics
+	_, err := s.db.QueryOneContext(ctx, &result, `
+		SELECT `+orderStatisticsColumns+`
+		FROM `+orderStatisticsFrom+`
+		WHERE shop_id = ? AND created_at >= ? AND created_at < ?
+	`, shopID, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetShopSalesBuckets returns order statistics grouped by bucket, which must
+// be "day", "week" or "month". Periods without orders are omitted.
+func (s *Store) GetShopSalesBuckets(ctx context.Context, shopID uuid.UUID, bucket string, startDate, endDate time.Time) ([]*SalesBucket, error) {
+	var buckets []*SalesBucket
+	_, err := s.db.QueryContext(ctx, &buckets, `
+		SELECT date_trunc(?, created_at) AS period, `+orderStatisticsColumns+`
+		FROM `+orderStatisticsFrom+`
+		WHERE shop_id = ? AND created_at >= ? AND created_at < ?
+		GROUP BY period
+		ORDER BY period ASC
+	`, bucket, shopID, startDate, endDate)
+	return buckets, err
+}
+
+// GetShopTopProducts returns the best selling products of a shop by revenue,
+// ignoring canceled orders and refunded items. Refunds of an amount rather
+// than of items are not attributed to products.
+func (s *Store) GetShopTopProducts(ctx context.Context, shopID uuid.UUID, startDate, endDate time.Time, limit int) ([]*TopProduct, error) {
+	var products []*TopProduct
+	_, err := s.db.QueryContext(ctx, &products, `
+		SELECT oi.product_id, COALESCE(p.name, '') AS name,
+			SUM(oi.quantity - COALESCE(ri.quantity, 0)) AS quantity,
+			SUM(oi.quantity * oi.price_at_purchase - COALESCE(ri.amount, 0)) AS revenue
+		FROM order_items oi
+		JOIN orders o ON o.id = oi.order_id
+		LEFT JOIN products p ON p.id = oi.product_id
+		LEFT JOIN (
+			SELECT ri.order_item_id, SUM(ri.quantity) AS quantity, SUM(ri.amount) AS amount
+			FROM refund_items ri
+			JOIN refunds r ON r.id = ri.refund_id
+			WHERE r.status = 'completed'
+			GROUP BY ri.order_item_id
+		) ri ON ri.order_item_id = oi.id
+		WHERE o.shop_id = ? AND o.status <> 'canceled'
+			AND o.created_at >= ? AND o.created_at < ?
+		GROUP BY oi.product_id, p.name
+		ORDER BY revenue DESC
+		LIMIT ?
+	`, shopID, startDate, endDate, limit)
+	return products, err
+}
@@ -40,6 +40,32 @@ func (s *Store) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, er
 	return user, nil
 }
 
+// GetUserByIDTx loads a user inside a transaction
+func (s *Store) GetUserByIDTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.User, error) {
+	user := &models.User{ID: id}
+	err := tx.ModelContext(ctx, user).WherePK().Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("user not found")
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUserForUpdateTx loads and locks a user
+func (s *Store) GetUserForUpdateTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.User, error) {
+	user := &models.User{ID: id}
+	err := tx.ModelContext(ctx, user).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("user not found")
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
 func (s *Store) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	user := &models.User{}
 	err := s.db.ModelContext(ctx, user).Where("email = ?", email).Select()
@@ -64,9 +90,35 @@ func (s *Store) GetUserByUsername(ctx context.Context, username string) (*models
 	return user, nil
 }
 
-func (s *Store) ListUsers(ctx context.Context, limit, offset int) ([]*models.User, error) {
+// UserFilter narrows down user listings. Zero values are ignored, and
+// deleted users are left out unless IncludeDeleted is set.
+type UserFilter struct {
+	Email          string
+	Username       string
+	Role           models.UserRole
+	Banned         *bool
+	IncludeDeleted bool
+}
+
+func (s *Store) ListUsers(ctx context.Context, filter UserFilter, limit, offset int) ([]*models.User, error) {
 	var users []*models.User
-	err := s.db.ModelContext(ctx, &users).
+	query := s.db.ModelContext(ctx, &users)
+	if filter.Email != "" {
+		query = query.Where("email ILIKE ?", "%"+filter.Email+"%")
+	}
+	if filter.Username != "" {
+		query = query.Where("username ILIKE ?", "%"+filter.Username+"%")
+	}
+	if filter.Role != "" {
+		query = query.Where("role = ?", filter.Role)
+	}
+	if filter.Banned != nil {
+		query = query.Where("is_banned = ?", *filter.Banned)
+	}
+	if !filter.IncludeDeleted {
+		query = query.Where("deleted_at IS NULL")
+	}
+	err := query.
 		Order("created_at ASC").
 		Limit(limit).
 		Offset(offset).
@@ -74,46 +126,241 @@ func (s *Store) ListUsers(ctx context.Context, limit, offset int) ([]*models.Use
 	return users, err
 }
 
+// UpdateUserRole changes a user's role. Tokens issued before the change
+// carry the old role, so they are revoked; refreshing picks up the new one.
 func (s *Store) UpdateUserRole(ctx context.Context, id uuid.UUID, role models.UserRole) (*models.User, error) {
+	var user *models.User
+	err := s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
+		user, err = s.UpdateUserRoleTx(ctx, tx, id, role)
+		return err
+	})
+	return user, err
+}
+
+// UpdateUserRoleTx changes a user's role inside a transaction
+func (s *Store) UpdateUserRoleTx(ctx context.Context, tx *pg.Tx, id uuid.UUID, role models.UserRole) (*models.User, error) {
 	user := &models.User{ID: id}
-	err := s.db.ModelContext(ctx, user).WherePK().Select()
+	err := tx.ModelContext(ctx, user).WherePK().For("UPDATE").Select()
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now()
 	user.Role = role
-	_, err = s.db.ModelContext(ctx, user).WherePK().Update()
+	user.TokensRevokedAt = &now
+	user.UpdatedAt = now
+	_, err = tx.ModelContext(ctx, user).
+		Column("role", "tokens_revoked_at", "updated_at").
+		WherePK().
+		Update()
 	return user, err
 }
 
+// BanUser bans a user, revoking their access tokens and sessions
 func (s *Store) BanUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
-	user := &models.User{ID: id}
-	err := s.db.ModelContext(ctx, user).WherePK().Select()
+	var user *models.User
+	err := s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
+		user, err = s.BanUserTx(ctx, tx, id)
+		return err
+	})
+	return user, err
+}
+
+// BanUserTx bans a user inside a transaction
+func (s *Store) BanUserTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.User, error) {
+	user, err := s.GetUserForUpdateTx(ctx, tx, id)
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now()
 	user.IsBanned = true
-	_, err = s.db.ModelContext(ctx, user).WherePK().Update()
-	return user, err
+	user.TokensRevokedAt = &now
+	user.UpdatedAt = now
+	_, err = tx.ModelContext(ctx, user).
+		Column("is_banned", "tokens_revoked_at", "updated_at").
+		WherePK().
+		Update()
+	if err != nil {
+		return nil, err
+	}
+	return user, s.RevokeUserSessionsTx(ctx, tx, id)
+}
+
+// UpdateUserProfile saves a user's username and email. A new email is no
+// longer verified.
+func (s *Store) UpdateUserProfile(ctx context.Context, user *models.User) error {
+	user.UpdatedAt = time.Now()
+	_, err := s.db.ModelContext(ctx, user).
+		Column("username", "email", "email_verified_at", "updated_at").
+		WherePK().
+		Update()
+	return err
+}
+
+// UpdateUserPassword sets a new password hash and logs the user out
+// everywhere
+func (s *Store) UpdateUserPassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	return s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		return s.UpdateUserPasswordTx(ctx, tx, id, passwordHash)
+	})
+}
+
+// RevokeUserTokens invalidates all access tokens and sessions of a user
+func (s *Store) RevokeUserTokens(ctx context.Context, id uuid.UUID) error {
+	return s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		return s.RevokeUserTokensTx(ctx, tx, id)
+	})
+}
+
+func (s *Store) RevokeUserTokensTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) error {
+	_, err := tx.ModelContext(ctx, (*models.User)(nil)).
+		Set("tokens_revoked_at = ?", time.Now()).
+		Where("id = ?", id).
+		Update()
+	if err != nil {
+		return err
+	}
+	return s.RevokeUserSessionsTx(ctx, tx, id)
+}
+
+// UpdateUserPasswordTx sets a new password hash and logs the user out
+// everywhere
+func (s *Store) UpdateUserPasswordTx(ctx context.Context, tx *pg.Tx, id uuid.UUID, passwordHash string) error {
+	_, err := tx.ModelContext(ctx, (*models.User)(nil)).
+		Set("password_hash = ?", passwordHash).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", id).
+		Update()
+	if err != nil {
+		return err
+	}
+	return s.RevokeUserTokensTx(ctx, tx, id)
 }
 
 func (s *Store) UnbanUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
-	user := &models.User{ID: id}
-	err := s.db.ModelContext(ctx, user).WherePK().Select()
+	var user *models.User
+	err := s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
+		user, err = s.UnbanUserTx(ctx, tx, id)
+		return err
+	})
+	return user, err
+}
+
+// UnbanUserTx unbans a user inside a transaction
+func (s *Store) UnbanUserTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.User, error) {
+	user, err := s.GetUserForUpdateTx(ctx, tx, id)
 	if err != nil {
 		return nil, err
 	}
 
+	// go-pg writes false as NULL, so the column is set explicitly
 	user.IsBanned = false
-	_, err = s.db.ModelContext(ctx, user).WherePK().Update()
+	user.UpdatedAt = time.Now()
+	_, err = tx.ModelContext(ctx, user).
+		Set("is_banned = FALSE").
+		Set("updated_at = ?updated_at").
+		WherePK().
+		Update()
 	return user, err
 }
 
+// deletedPasswordHash replaces the password hash of deleted users
+const deletedPasswordHash = "!"
+
+// DeletedUserColumns are the user columns that deleting a user overwrites
+var DeletedUserColumns = []string{"username", "email", "password_hash", "email_verified_at", "tokens_revoked_at", "deleted_at", "updated_at"}
+
+// DeleteUser soft-deletes a user. The account keeps its ID for the orders
+// and shops that reference it, but its username, email and password are
+// replaced, it is logged out everywhere and its MFA settings, pending
+// tokens and staff memberships in other users' shops are removed.
+func (s *Store) DeleteUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	var user *models.User
+	err := s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
+		user, err = s.DeleteUserTx(ctx, tx, id)
+		return err
+	})
+	return user, err
+}
+
+// DeleteUserTx soft-deletes a user inside a transaction
+func (s *Store) DeleteUserTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.User, error) {
+	user, err := s.GetUserForUpdateTx(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if user.DeletedAt != nil {
+		return nil, errors.New("user already deleted")
+	}
+
+	// "!" is never produced by bcrypt, so no password matches it. The
+	// column can't be left empty because go-pg writes empty strings as
+	// NULL.
+	now := time.Now()
+	user.Username = "deleted-" + id.String()
+	user.Email = id.String() + "@deleted.invalid"
+	user.PasswordHash = deletedPasswordHash
+	user.EmailVerifiedAt = nil
+	user.TokensRevokedAt = &now
+	user.DeletedAt = &now
+	user.UpdatedAt = now
+	_, err = tx.ModelContext(ctx, user).
+		Column(DeletedUserColumns...).
+		WherePK().
+		Update()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.RevokeUserSessionsTx(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	if err := s.DeleteUserMFATx(ctx, tx, id); err != nil {
+		return nil, err
+	}
+
+	for _, model := range []interface{}{
+		(*models.PasswordResetToken)(nil),
+		(*models.EmailVerificationToken)(nil),
+		(*models.MFAChallenge)(nil),
+	} {
+		_, err := tx.ModelContext(ctx, model).Where("user_id = ?", id).Delete()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ModelContext(ctx, (*models.ShopMember)(nil)).
+		Where("user_id = ? AND role <> ?", id, models.ShopRoleOwner).
+		Delete()
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 // Shop operations
+
+// CreateShop creates a shop and makes its user the owner member
 func (s *Store) CreateShop(ctx context.Context, shop *models.Shop) error {
-	_, err := s.db.ModelContext(ctx, shop).Insert()
-	return err
+	return s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if _, err := tx.ModelContext(ctx, shop).Insert(); err != nil {
+			return err
+		}
+
+		owner := &models.ShopMember{
+			ShopID: shop.ID,
+			UserID: shop.UserID,
+			Role:   models.ShopRoleOwner,
+		}
+		_, err := tx.ModelContext(ctx, owner).Insert()
+		return err
+	})
 }
 
 func (s *Store) GetShopByID(ctx context.Context, id uuid.UUID) (*models.Shop, error) {
@@ -157,8 +404,21 @@ func (s *Store) SearchShops(ctx context.Context, query string, limit, offset int
 	return shops, err
 }
 
-func (s *Store) UpdateShop(ctx context.Context, shop *models.Shop) error {
-	_, err := s.db.ModelContext(ctx, shop).WherePK().Update()
+// GetShopForUpdateTx loads and locks a shop inside a transaction
+func (s *Store) GetShopForUpdateTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.Shop, error) {
+	shop := &models.Shop{ID: id}
+	err := tx.ModelContext(ctx, shop).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("shop not found")
+		}
+		return nil, err
+	}
+	return shop, nil
+}
+
+func (s *Store) UpdateShopTx(ctx context.Context, tx *pg.Tx, shop *models.Shop) error {
+	_, err := tx.ModelContext(ctx, shop).WherePK().Update()
 	return err
 }
 
@@ -180,6 +440,17 @@ func (s *Store) GetProductByID(ctx context.Context, id uuid.UUID) (*models.Produ
 	return product, nil
 }
 
+func (s *Store) GetProductsByIDs(ctx context.Context, ids []uuid.UUID) ([]*models.Product, error) {
+	var products []*models.Product
+	if len(ids) == 0 {
+		return products, nil
+	}
+	err := s.db.ModelContext(ctx, &products).
+		Where("id IN (?)", pg.In(ids)).
+		Select()
+	return products, err
+}
+
 func (s *Store) GetProductsByShopID(ctx context.Context, shopID uuid.UUID, limit, offset int) ([]*models.Product, error) {
 	var products []*models.Product
 	err := s.db.ModelContext(ctx, &products).
@@ -239,9 +510,22 @@ func (s *Store) UpdateProduct(ctx context.Context, product *models.Product) erro
 	return err
 }
 
-func (s *Store) DeleteProduct(ctx context.Context, id uuid.UUID) error {
+// GetProductForUpdateTx loads and locks a product inside a transaction
+func (s *Store) GetProductForUpdateTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) (*models.Product, error) {
+	product := &models.Product{ID: id}
+	err := tx.ModelContext(ctx, product).WherePK().For("UPDATE").Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("product not found")
+		}
+		return nil, err
+	}
+	return product, nil
+}
+
+func (s *Store) DeleteProductTx(ctx context.Context, tx *pg.Tx, id uuid.UUID) error {
 	product := &models.Product{ID: id}
-	_, err := s.db.ModelContext(ctx, product).WherePK().Delete()
+	_, err := tx.ModelContext(ctx, product).WherePK().Delete()
 	return err
 }
 
@@ -287,23 +571,126 @@ func (s *Store) GetOrderItems(ctx context.Context, orderID uuid.UUID) ([]*models
 	return items, err
 }
 
-func (s *Store) UpdateOrderStatus(ctx context.Context, orderID uuid.UUID, status models.OrderStatus) (*models.Order, error) {
+// UpdateOrderStatus moves an order to a new status, enforcing the allowed
+// transitions and recording the change in the status history
+func (s *Store) UpdateOrderStatus(ctx context.Context, orderID uuid.UUID, status models.OrderStatus, changedBy *uuid.UUID, note string) (*models.Order, error) {
+	var order *models.Order
+	err := s.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var err error
+		order, err = s.UpdateOrderStatusTx(ctx, tx, orderID, status, changedBy, note)
+		return err
+	})
+	return order, err
+}
+
+// UpdateOrderStatusTx is UpdateOrderStatus inside an existing transaction
+func (s *Store) UpdateOrderStatusTx(ctx context.Context, tx *pg.Tx, orderID uuid.UUID, status models.OrderStatus, changedBy *uuid.UUID, note string) (*models.Order, error) {
 	order := &models.Order{ID: orderID}
-	err := s.db.ModelContext(ctx, order).WherePK().Select()
+	err := tx.ModelContext(ctx, order).WherePK().For("UPDATE").Select()
 	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("order not found")
+		}
 		return nil, err
 	}
 
+	if err := order.Status.ValidateTransition(status); err != nil {
+		return nil, err
+	}
+
+	previousStatus := order.Status
+	history := &models.OrderStatusHistory{
+		OrderID:    order.ID,
+		FromStatus: previousStatus,
+		ToStatus:   status,
+		ChangedBy:  changedBy,
+		Note:       note,
+	}
+
 	order.Status = status
-	_, err = s.db.ModelContext(ctx, order).WherePK().Update()
-	return order, err
+	order.UpdatedAt = time.Now()
+	_, err = tx.ModelContext(ctx, order).Column("status", "updated_at").WherePK().Update()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.AddOrderStatusHistoryTx(ctx, tx, history); err != nil {
+		return nil, err
+	}
+
+	// Give the reserved stock back when an order is canceled and note
+	// whether the buyer is owed a refund
+	if status == models.StatusCanceled {
+		if err := s.RestockOrderTx(ctx, tx, order.ID, models.StockReasonOrderCanceled); err != nil {
+			return nil, err
+		}
+
+		cancellation := &models.OrderCancellation{
+			OrderID:      order.ID,
+			CanceledBy:   changedBy,
+			Reason:       note,
+			RefundStatus: models.RefundNotRequired,
+		}
+		if previousStatus == models.StatusPaid {
+			cancellation.RefundAmount = order.TotalAmount - order.RefundedAmount
+			cancellation.RefundStatus = models.RefundPending
+		}
+		if _, err := tx.ModelContext(ctx, cancellation).Insert(); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// AddOrderStatusHistoryTx records a status change inside an existing transaction
+func (s *Store) AddOrderStatusHistoryTx(ctx context.Context, tx *pg.Tx, history *models.OrderStatusHistory) error {
+	_, err := tx.ModelContext(ctx, history).Insert()
+	return err
+}
+
+func (s *Store) GetOrderCancellation(ctx context.Context, orderID uuid.UUID) (*models.OrderCancellation, error) {
+	cancellation := &models.OrderCancellation{}
+	err := s.db.ModelContext(ctx, cancellation).Where("order_id = ?", orderID).Select()
+	if err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.New("order cancellation not found")
+		}
+		return nil, err
+	}
+	return cancellation, nil
+}
+
+func (s *Store) GetOrderStatusHistory(ctx context.Context, orderID uuid.UUID) ([]*models.OrderStatusHistory, error) {
+	var history []*models.OrderStatusHistory
+	err := s.db.ModelContext(ctx, &history).
+		Where("order_id = ?", orderID).
+		Order("created_at ASC").
+		Select()
+	return history, err
+}
+
+// OrderFilter narrows down order listings. Zero values are ignored.
+type OrderFilter struct {
+	Status models.OrderStatus
+	From   time.Time
+	To     time.Time
 }
 
 // Thêm method để lấy đơn hàng theo shop
-func (s *Store) GetOrdersByShopID(ctx context.Context, shopID uuid.UUID, limit, offset int) ([]*models.Order, error) {
+func (s *Store) GetOrdersByShopID(ctx context.Context, shopID uuid.UUID, filter OrderFilter, limit, offset int) ([]*models.Order, error) {
 	var orders []*models.Order
-	err := s.db.ModelContext(ctx, &orders).
-		Where("shop_id = ?", shopID).
+	query := s.db.ModelContext(ctx, &orders).
+		Where("shop_id = ?", shopID)
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+	err := query.
 		Order("created_at DESC").
 		Limit(limit).
 		Offset(offset).
@@ -311,27 +698,18 @@ func (s *Store) GetOrdersByShopID(ctx context.Context, shopID uuid.UUID, limit,
 	return orders, err
 }
 
-// Thêm thống kê đơn hàng cho shop
-func (s *Store) GetShopOrderStatistics(ctx context.Context, shopID uuid.UUID, startDate, endDate time.Time) (map[string]interface{}, error) {
-	var result struct {
-		TotalOrders  int     `pg:"total_orders"`
-		TotalRevenue float64 `pg:"total_revenue"`
-	}
-
-	_, err := s.db.QueryOneContext(ctx, &result, `
-		SELECT COUNT(*) as total_orders, SUM(total_amount) as total_revenue
-		FROM orders
-		WHERE shop_id = ? AND created_at BETWEEN ? AND ?
-	`, shopID, startDate, endDate)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return map[string]interface{}{
-		"total_orders":  result.TotalOrders,
-		"total_revenue": result.TotalRevenue,
-	}, nil
+// SetOrderShipmentTx stores the tracking details of an order that was just
+// marked shipped
+func (s *Store) SetOrderShipmentTx(ctx context.Context, tx *pg.Tx, order *models.Order, carrier, trackingNumber string) error {
+	now := time.Now()
+	order.Carrier = carrier
+	order.TrackingNumber = trackingNumber
+	order.ShippedAt = &now
+	_, err := tx.ModelContext(ctx, order).
+		Column("carrier", "tracking_number", "shipped_at").
+		WherePK().
+		Update()
+	return err
 }
 
 // Transaction support
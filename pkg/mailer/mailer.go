@@ -0,0 +1,32 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+)
+
+// Message is an email to send
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails. Implementations wrap an email service; the local
+// ones write messages to the log or to files instead of sending them.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New creates the mailer selected by name: "log" or "file". dir is where the
+// file mailer stores messages.
+func New(name, from, dir string) (Mailer, error) {
+	switch name {
+	case "log":
+		return NewLogMailer(from), nil
+	case "file":
+		return NewFileMailer(from, dir)
+	default:
+		return nil, fmt.Errorf("unknown mailer: %s", name)
+	}
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/go-pg/pg/v10"
@@ -14,8 +17,126 @@ const (
 	RoleAdmin  UserRole = "admin"
 	RoleSeller UserRole = "seller"
 	RoleBuyer  UserRole = "buyer"
+	// RoleStaff is given to buyers who accept an invitation to work for a
+	// shop, so they can reach the seller routes
+	RoleStaff UserRole = "staff"
 )
 
+// Permission is an action a role allows. Handlers check permissions
+// instead of role names, so roles can be added without code changes.
+type Permission string
+
+const (
+	PermShopCreate Permission = "shop:create"
+	// PermShopManageAny allows managing shops the user doesn't own: editing
+	// them and handling their orders and returns
+	PermShopManageAny   Permission = "shop:manage_any"
+	PermProductWrite    Permission = "product:write"
+	PermProductWriteAny Permission = "product:write_any"
+	PermOrderFulfill    Permission = "order:fulfill"
+	PermOrderReadAny    Permission = "order:read_any"
+	PermOrderManage     Permission = "order:manage"
+	PermOrderRefund     Permission = "order:refund"
+	PermOrderRefundAny  Permission = "order:refund_any"
+	PermUserRead        Permission = "user:read"
+	PermUserBan         Permission = "user:ban"
+	PermUserManage      Permission = "user:manage"
+	PermSellerReview    Permission = "seller_application:review"
+	PermMFAPolicyManage Permission = "mfa_policy:manage"
+	PermRoleManage      Permission = "role:manage"
+	PermAuditRead       Permission = "audit:read"
+)
+
+// AllPermissions lists every permission a role can be granted
+var AllPermissions = []Permission{
+	PermShopCreate,
+	PermShopManageAny,
+	PermProductWrite,
+	PermProductWriteAny,
+	PermOrderFulfill,
+	PermOrderReadAny,
+	PermOrderManage,
+	PermOrderRefund,
+	PermOrderRefundAny,
+	PermUserRead,
+	PermUserBan,
+	PermUserManage,
+	PermSellerReview,
+	PermMFAPolicyManage,
+	PermRoleManage,
+	PermAuditRead,
+}
+
+// DefaultRolePermissions are the permissions of the built-in roles when they
+// are first created. Admins always have every permission.
+var DefaultRolePermissions = map[UserRole][]Permission{
+	RoleAdmin:  AllPermissions,
+	RoleSeller: {PermShopCreate, PermProductWrite, PermOrderFulfill, PermOrderRefund},
+	RoleBuyer:  {},
+	RoleStaff:  {PermProductWrite, PermOrderFulfill, PermOrderRefund},
+}
+
+// These permissions only exist inside a shop and are granted by a member's
+// shop role, never by a user role
+const (
+	PermShopUpdate  Permission = "shop:update"
+	PermShopMembers Permission = "shop:members"
+)
+
+// ShopPermissions lists every permission a shop role can grant. Acting on a
+// shop's products and orders takes two checks: the user role must grant
+// product:write, order:fulfill or order:refund for the route, and the shop
+// role must grant the same permission in the shop.
+var ShopPermissions = []Permission{
+	PermShopUpdate,
+	PermShopMembers,
+	PermProductWrite,
+	PermOrderFulfill,
+	PermOrderRefund,
+}
+
+// ShopRole is a user's role in a shop they work for
+type ShopRole string
+
+const (
+	ShopRoleOwner       ShopRole = "owner"
+	ShopRoleManager     ShopRole = "manager"
+	ShopRoleFulfillment ShopRole = "fulfillment"
+)
+
+// ShopRolePermissions are the shop permissions of each shop role
+var ShopRolePermissions = map[ShopRole][]Permission{
+	ShopRoleOwner:       ShopPermissions,
+	ShopRoleManager:     {PermShopUpdate, PermProductWrite, PermOrderFulfill, PermOrderRefund},
+	ShopRoleFulfillment: {PermOrderFulfill},
+}
+
+// IsValid reports whether r is a known shop role
+func (r ShopRole) IsValid() bool {
+	_, ok := ShopRolePermissions[r]
+	return ok
+}
+
+// Allows reports whether r grants perm in its shop
+func (r ShopRole) Allows(perm Permission) bool {
+	for _, p := range ShopRolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid reports whether p is a known permission
+func (p Permission) IsValid() bool {
+	for _, perm := range AllPermissions {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
+
 type OrderStatus string
 
 const (
@@ -24,22 +145,218 @@ const (
 	StatusShipped   OrderStatus = "shipped"
 	StatusDelivered OrderStatus = "delivered"
 	StatusCanceled  OrderStatus = "canceled"
+	// StatusRefunded is set by the refund flow once the whole order has
+	// been refunded. Partial refunds keep the order's fulfillment status and
+	// only raise Order.RefundedAmount.
+	StatusRefunded OrderStatus = "refunded"
 )
 
+// ErrInvalidStatusTransition is returned when an order is moved to a status
+// that cannot follow its current status
+var ErrInvalidStatusTransition = errors.New("invalid order status transition")
+
+// orderStatusTransitions lists the statuses each status can move to
+var orderStatusTransitions = map[OrderStatus][]OrderStatus{
+	StatusPending:   {StatusPaid, StatusCanceled},
+	StatusPaid:      {StatusShipped, StatusCanceled, StatusRefunded},
+	StatusShipped:   {StatusDelivered, StatusRefunded},
+	StatusDelivered: {StatusRefunded},
+}
+
+// NextStatuses returns the statuses an order can move to from s
+func (s OrderStatus) NextStatuses() []OrderStatus {
+	return orderStatusTransitions[s]
+}
+
+// CanTransitionTo reports whether an order can move from s to next
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, status := range orderStatusTransitions[s] {
+		if status == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTransition returns ErrInvalidStatusTransition if an order cannot
+// move from s to next
+func (s OrderStatus) ValidateTransition(next OrderStatus) error {
+	if !s.CanTransitionTo(next) {
+		return fmt.Errorf("%w: cannot change order status from %s to %s", ErrInvalidStatusTransition, s, next)
+	}
+	return nil
+}
+
 type User struct {
 	ID           uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
 	Username     string    `pg:"username,unique,notnull"`
 	Email        string    `pg:"email,unique,notnull"`
 	PasswordHash string    `pg:"password_hash,notnull"`
-	Role         UserRole  `pg:"role,notnull,type:user_role,default:'buyer'"`
+	Role         UserRole  `pg:"role,notnull,default:'buyer'"`
 	IsBanned     bool      `pg:"is_banned,notnull,default:false"`
-	CreatedAt    time.Time `pg:"created_at,notnull,default:now()"`
-	UpdatedAt    time.Time `pg:"updated_at,notnull,default:now()"`
+	// EmailVerifiedAt is set once the user confirms they own Email
+	EmailVerifiedAt *time.Time `pg:"email_verified_at"`
+	// TokensRevokedAt invalidates every access token issued before it
+	TokensRevokedAt *time.Time `pg:"tokens_revoked_at"`
+	// DeletedAt is set when the account is deleted. Its personal data is
+	// anonymized but the row is kept for the orders that reference it.
+	DeletedAt *time.Time `pg:"deleted_at"`
+	CreatedAt time.Time  `pg:"created_at,notnull,default:now()"`
+	UpdatedAt time.Time  `pg:"updated_at,notnull,default:now()"`
 	// Relations
 	Shops  []*Shop  `pg:"rel:has-many"`
 	Orders []*Order `pg:"rel:has-many"`
 }
 
+// Session is a login that can be renewed with a refresh token. Refreshing
+// rotates the token: the used session is marked rotated and a new one in the
+// same family replaces it, so presenting an old token again reveals theft.
+type Session struct {
+	ID               uuid.UUID  `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	FamilyID         uuid.UUID  `pg:"family_id,type:uuid,notnull"`
+	UserID           uuid.UUID  `pg:"user_id,type:uuid,notnull"`
+	RefreshTokenHash string     `pg:"refresh_token_hash,unique,notnull"`
+	UserAgent        string     `pg:"user_agent"`
+	ClientIP         string     `pg:"client_ip"`
+	ExpiresAt        time.Time  `pg:"expires_at,notnull"`
+	RotatedAt        *time.Time `pg:"rotated_at"`
+	RevokedAt        *time.Time `pg:"revoked_at"`
+	CreatedAt        time.Time  `pg:"created_at,notnull,default:now()"`
+	// Relations
+	User *User `pg:"rel:belongs-to"`
+}
+
+// PasswordResetToken lets a user who forgot their password set a new one.
+// Only a hash of the token is stored, and it works once before it expires.
+type PasswordResetToken struct {
+	ID        uuid.UUID  `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	UserID    uuid.UUID  `pg:"user_id,type:uuid,notnull"`
+	TokenHash string     `pg:"token_hash,unique,notnull"`
+	ExpiresAt time.Time  `pg:"expires_at,notnull"`
+	UsedAt    *time.Time `pg:"used_at"`
+	CreatedAt time.Time  `pg:"created_at,notnull,default:now()"`
+	// Relations
+	User *User `pg:"rel:belongs-to"`
+}
+
+// EmailVerificationToken confirms that a user owns an email address. Only a
+// hash of the token is stored, and it works once before it expires.
+type EmailVerificationToken struct {
+	ID        uuid.UUID  `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	UserID    uuid.UUID  `pg:"user_id,type:uuid,notnull"`
+	Email     string     `pg:"email,notnull"`
+	TokenHash string     `pg:"token_hash,unique,notnull"`
+	ExpiresAt time.Time  `pg:"expires_at,notnull"`
+	UsedAt    *time.Time `pg:"used_at"`
+	CreatedAt time.Time  `pg:"created_at,notnull,default:now()"`
+	// Relations
+	User *User `pg:"rel:belongs-to"`
+}
+
+// UserMFA is a user's TOTP second factor. It is only enforced once the user
+// has confirmed a code from their authenticator app.
+type UserMFA struct {
+	tableName struct{} `pg:"user_mfa"`
+
+	ID        uuid.UUID  `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	UserID    uuid.UUID  `pg:"user_id,type:uuid,unique,notnull"`
+	Secret    string     `pg:"secret,notnull"`
+	EnabledAt *time.Time `pg:"enabled_at"`
+	// LastUsedStep is the time step of the last accepted code, so a code
+	// can't be used twice
+	LastUsedStep int64 `pg:"last_used_step,notnull,use_zero"`
+	// FailedAttempts counts wrong codes since the last correct one or the
+	// last lockout; LockedUntil refuses every code until it passes
+	FailedAttempts int32      `pg:"failed_attempts,notnull,use_zero"`
+	LockedUntil    *time.Time `pg:"locked_until"`
+	CreatedAt      time.Time  `pg:"created_at,notnull,default:now()"`
+	UpdatedAt      time.Time  `pg:"updated_at,notnull,default:now()"`
+	// Relations
+	User *User `pg:"rel:belongs-to"`
+}
+
+// MFARecoveryCode is a one-time code that replaces a TOTP code when the
+// user has lost their authenticator
+type MFARecoveryCode struct {
+	tableName struct{} `pg:"mfa_recovery_codes"`
+
+	ID        uuid.UUID  `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	UserID    uuid.UUID  `pg:"user_id,type:uuid,notnull"`
+	CodeHash  string     `pg:"code_hash,notnull"`
+	UsedAt    *time.Time `pg:"used_at"`
+	CreatedAt time.Time  `pg:"created_at,notnull,default:now()"`
+}
+
+// MFAChallenge is issued by the first login step to a user with MFA and
+// exchanged for tokens together with a valid code
+type MFAChallenge struct {
+	tableName struct{} `pg:"mfa_challenges"`
+
+	ID        uuid.UUID  `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	UserID    uuid.UUID  `pg:"user_id,type:uuid,notnull"`
+	TokenHash string     `pg:"token_hash,unique,notnull"`
+	Attempts  int32      `pg:"attempts,notnull,use_zero"`
+	ExpiresAt time.Time  `pg:"expires_at,notnull"`
+	UsedAt    *time.Time `pg:"used_at"`
+	CreatedAt time.Time  `pg:"created_at,notnull,default:now()"`
+}
+
+// MFAPolicy records whether users with a role must use MFA
+type MFAPolicy struct {
+	tableName struct{} `pg:"mfa_policies"`
+
+	Role      UserRole   `pg:"role,pk"`
+	Required  bool       `pg:"required,notnull,use_zero"`
+	UpdatedBy *uuid.UUID `pg:"updated_by,type:uuid"`
+	UpdatedAt time.Time  `pg:"updated_at,notnull,default:now()"`
+}
+
+// Role is a named set of permissions. The built-in roles can't be deleted,
+// and the admin role always has every permission.
+type Role struct {
+	Name        UserRole  `pg:"name,pk"`
+	Description string    `pg:"description"`
+	BuiltIn     bool      `pg:"built_in,notnull,use_zero"`
+	CreatedAt   time.Time `pg:"created_at,notnull,default:now()"`
+	UpdatedAt   time.Time `pg:"updated_at,notnull,default:now()"`
+	// Permissions is loaded from role_permissions
+	Permissions []Permission `pg:"-"`
+}
+
+// RolePermission grants a permission to a role
+type RolePermission struct {
+	Role       UserRole   `pg:"role,pk"`
+	Permission Permission `pg:"permission,pk"`
+}
+
+type SellerApplicationStatus string
+
+const (
+	ApplicationPending  SellerApplicationStatus = "pending"
+	ApplicationApproved SellerApplicationStatus = "approved"
+	ApplicationRejected SellerApplicationStatus = "rejected"
+)
+
+// SellerApplication is a buyer's request to become a seller. An admin
+// reviews it, and approving it upgrades the user's role.
+type SellerApplication struct {
+	ID           uuid.UUID               `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	UserID       uuid.UUID               `pg:"user_id,type:uuid,notnull"`
+	BusinessName string                  `pg:"business_name,notnull"`
+	TaxID        string                  `pg:"tax_id,notnull"`
+	ContactName  string                  `pg:"contact_name,notnull"`
+	ContactEmail string                  `pg:"contact_email,notnull"`
+	ContactPhone string                  `pg:"contact_phone"`
+	Status       SellerApplicationStatus `pg:"status,notnull"`
+	ReviewNote   string                  `pg:"review_note"`
+	ReviewedBy   *uuid.UUID              `pg:"reviewed_by,type:uuid"`
+	ReviewedAt   *time.Time              `pg:"reviewed_at"`
+	CreatedAt    time.Time               `pg:"created_at,notnull,default:now()"`
+	UpdatedAt    time.Time               `pg:"updated_at,notnull,default:now()"`
+	// Relations
+	User *User `pg:"rel:belongs-to"`
+}
+
 type Shop struct {
 	ID          uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
 	UserID      uuid.UUID `pg:"user_id,type:uuid,notnull"`
@@ -53,6 +370,37 @@ type Shop struct {
 	Products []*Product `pg:"rel:has-many"`
 }
 
+// ShopMember lets a user work for a shop with a shop role. The shop's
+// UserID always has the owner role.
+type ShopMember struct {
+	ID        uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	ShopID    uuid.UUID `pg:"shop_id,type:uuid,notnull,unique:shop_user"`
+	UserID    uuid.UUID `pg:"user_id,type:uuid,notnull,unique:shop_user"`
+	Role      ShopRole  `pg:"role,notnull"`
+	CreatedAt time.Time `pg:"created_at,notnull,default:now()"`
+	UpdatedAt time.Time `pg:"updated_at,notnull,default:now()"`
+	// Relations
+	Shop *Shop `pg:"rel:belongs-to"`
+	User *User `pg:"rel:belongs-to"`
+}
+
+// ShopInvitation invites whoever owns an email address to join a shop.
+// Only a hash of the token is stored, and it works once before it expires.
+type ShopInvitation struct {
+	ID         uuid.UUID  `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	ShopID     uuid.UUID  `pg:"shop_id,type:uuid,notnull"`
+	Email      string     `pg:"email,notnull"`
+	Role       ShopRole   `pg:"role,notnull"`
+	TokenHash  string     `pg:"token_hash,unique,notnull"`
+	InvitedBy  uuid.UUID  `pg:"invited_by,type:uuid,notnull"`
+	ExpiresAt  time.Time  `pg:"expires_at,notnull"`
+	AcceptedBy *uuid.UUID `pg:"accepted_by,type:uuid"`
+	AcceptedAt *time.Time `pg:"accepted_at"`
+	CreatedAt  time.Time  `pg:"created_at,notnull,default:now()"`
+	// Relations
+	Shop *Shop `pg:"rel:belongs-to"`
+}
+
 type Product struct {
 	ID          uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
 	ShopID      uuid.UUID `pg:"shop_id,type:uuid,notnull"`
@@ -76,14 +424,221 @@ type Order struct {
 	TotalAmount     float64     `pg:"total_amount,notnull"`
 	Status          OrderStatus `pg:"status,notnull,type:order_status,default:'pending'"`
 	ShippingAddress string      `pg:"shipping_address,notnull"`
+	CheckoutID      *uuid.UUID  `pg:"checkout_id,type:uuid"`
+	Carrier         string      `pg:"carrier"`
+	TrackingNumber  string      `pg:"tracking_number"`
+	ShippedAt       *time.Time  `pg:"shipped_at"`
+	RefundedAmount  float64     `pg:"refunded_amount,notnull,use_zero,default:0"` // Total of completed refunds
 	CreatedAt       time.Time   `pg:"created_at,notnull,default:now()"`
 	UpdatedAt       time.Time   `pg:"updated_at,notnull,default:now()"`
 	// Relations
 	User       *User        `pg:"rel:belongs-to"`
 	Shop       *Shop        `pg:"rel:belongs-to"` // Thêm quan hệ với Shop
+	Checkout   *Checkout    `pg:"rel:belongs-to"`
 	OrderItems []*OrderItem `pg:"rel:has-many"`
 }
 
+// OrderStatusHistory records every status change of an order
+type OrderStatusHistory struct {
+	tableName struct{} `pg:"order_status_history"`
+
+	ID         uuid.UUID   `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	OrderID    uuid.UUID   `pg:"order_id,type:uuid,notnull"`
+	FromStatus OrderStatus `pg:"from_status,type:order_status"`
+	ToStatus   OrderStatus `pg:"to_status,notnull,type:order_status"`
+	ChangedBy  *uuid.UUID  `pg:"changed_by,type:uuid"`
+	Note       string      `pg:"note"`
+	CreatedAt  time.Time   `pg:"created_at,notnull,default:now()"`
+	// Relations
+	Order *Order `pg:"rel:belongs-to"`
+}
+
+type PaymentStatus string
+
+const (
+	PaymentAuthorized        PaymentStatus = "authorized"
+	PaymentCaptured          PaymentStatus = "captured"
+	PaymentFailed            PaymentStatus = "failed"
+	PaymentPartiallyRefunded PaymentStatus = "partially_refunded"
+	PaymentRefunded          PaymentStatus = "refunded"
+)
+
+type Payment struct {
+	ID                    uuid.UUID     `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	OrderID               uuid.UUID     `pg:"order_id,type:uuid,notnull"`
+	UserID                uuid.UUID     `pg:"user_id,type:uuid,notnull"`
+	Provider              string        `pg:"provider,notnull"`
+	ProviderAuthorization string        `pg:"provider_authorization"`
+	ProviderCapture       string        `pg:"provider_capture"`
+	Amount                float64       `pg:"amount,notnull"`
+	Currency              string        `pg:"currency,notnull"`
+	Status                PaymentStatus `pg:"status,notnull"`
+	FailureReason         string        `pg:"failure_reason"`
+	CreatedAt             time.Time     `pg:"created_at,notnull,default:now()"`
+	UpdatedAt             time.Time     `pg:"updated_at,notnull,default:now()"`
+	// Relations
+	Order *Order `pg:"rel:belongs-to"`
+	User  *User  `pg:"rel:belongs-to"`
+}
+
+type WebhookEventStatus string
+
+const (
+	WebhookReceived  WebhookEventStatus = "received"
+	WebhookProcessed WebhookEventStatus = "processed"
+	WebhookIgnored   WebhookEventStatus = "ignored"
+	WebhookFailed    WebhookEventStatus = "failed"
+)
+
+// PaymentWebhookEvent stores every event pushed by a payment provider.
+// EventID is unique per provider so redelivered events are detected.
+type PaymentWebhookEvent struct {
+	ID          uuid.UUID          `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	Provider    string             `pg:"provider,notnull,unique:provider_event"`
+	EventID     string             `pg:"event_id,notnull,unique:provider_event"`
+	EventType   string             `pg:"event_type,notnull"`
+	Payload     string             `pg:"payload,type:jsonb,notnull"`
+	Status      WebhookEventStatus `pg:"status,notnull"`
+	Error       string             `pg:"error"`
+	ProcessedAt *time.Time         `pg:"processed_at"`
+	CreatedAt   time.Time          `pg:"created_at,notnull,default:now()"`
+}
+
+type RefundStatus string
+
+const (
+	RefundNotRequired RefundStatus = "not_required"
+	RefundPending     RefundStatus = "pending"
+	RefundCompleted   RefundStatus = "completed"
+	RefundFailed      RefundStatus = "failed"
+)
+
+// OrderCancellation records why an order was canceled and whether money
+// has to be returned to the buyer
+type OrderCancellation struct {
+	ID           uuid.UUID    `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	OrderID      uuid.UUID    `pg:"order_id,type:uuid,unique,notnull"`
+	CanceledBy   *uuid.UUID   `pg:"canceled_by,type:uuid"`
+	Reason       string       `pg:"reason"`
+	RefundAmount float64      `pg:"refund_amount,notnull,use_zero"`
+	RefundStatus RefundStatus `pg:"refund_status,notnull"`
+	CreatedAt    time.Time    `pg:"created_at,notnull,default:now()"`
+	UpdatedAt    time.Time    `pg:"updated_at,notnull,default:now()"`
+	// Relations
+	Order *Order `pg:"rel:belongs-to"`
+}
+
+// Refund records money returned to the buyer for an order, either for
+// specific items or as a lump sum
+type Refund struct {
+	ID               uuid.UUID    `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	OrderID          uuid.UUID    `pg:"order_id,type:uuid,notnull"`
+	PaymentID        *uuid.UUID   `pg:"payment_id,type:uuid"`
+	Amount           float64      `pg:"amount,notnull"`
+	Reason           string       `pg:"reason"`
+	Status           RefundStatus `pg:"status,notnull"`
+	ProviderRefundID string       `pg:"provider_refund_id"`
+	CreatedBy        *uuid.UUID   `pg:"created_by,type:uuid"`
+	CreatedAt        time.Time    `pg:"created_at,notnull,default:now()"`
+	// Relations
+	Order   *Order        `pg:"rel:belongs-to"`
+	Payment *Payment      `pg:"rel:belongs-to"`
+	Items   []*RefundItem `pg:"rel:has-many"`
+}
+
+// RefundItem is the part of a refund that applies to one order item
+type RefundItem struct {
+	ID          uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	RefundID    uuid.UUID `pg:"refund_id,type:uuid,notnull"`
+	OrderItemID uuid.UUID `pg:"order_item_id,type:uuid,notnull"`
+	Quantity    int32     `pg:"quantity,notnull"`
+	Amount      float64   `pg:"amount,notnull,use_zero"`
+	Restocked   bool      `pg:"restocked,notnull,use_zero"`
+	// Relations
+	Refund    *Refund    `pg:"rel:belongs-to"`
+	OrderItem *OrderItem `pg:"rel:belongs-to"`
+}
+
+type ReturnStatus string
+
+const (
+	ReturnRequested ReturnStatus = "requested"
+	ReturnApproved  ReturnStatus = "approved"
+	ReturnRejected  ReturnStatus = "rejected"
+	ReturnInTransit ReturnStatus = "in_transit"
+	ReturnReceived  ReturnStatus = "received"
+)
+
+// ReturnRequest is a buyer's request to send back items of a delivered
+// order. Once the seller receives the items the order is refunded.
+type ReturnRequest struct {
+	ID             uuid.UUID    `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	OrderID        uuid.UUID    `pg:"order_id,type:uuid,notnull"`
+	UserID         uuid.UUID    `pg:"user_id,type:uuid,notnull"`
+	ShopID         uuid.UUID    `pg:"shop_id,type:uuid,notnull"`
+	Reason         string       `pg:"reason,notnull"`
+	PhotoURLs      []string     `pg:"photo_urls,array"`
+	Status         ReturnStatus `pg:"status,notnull"`
+	SellerNote     string       `pg:"seller_note"`
+	Carrier        string       `pg:"carrier"`
+	TrackingNumber string       `pg:"tracking_number"`
+	RefundID       *uuid.UUID   `pg:"refund_id,type:uuid"`
+	ShippedAt      *time.Time   `pg:"shipped_at"`
+	ResolvedAt     *time.Time   `pg:"resolved_at"`
+	CreatedAt      time.Time    `pg:"created_at,notnull,default:now()"`
+	UpdatedAt      time.Time    `pg:"updated_at,notnull,default:now()"`
+	// Relations
+	Order  *Order        `pg:"rel:belongs-to"`
+	User   *User         `pg:"rel:belongs-to"`
+	Shop   *Shop         `pg:"rel:belongs-to"`
+	Refund *Refund       `pg:"rel:belongs-to"`
+	Items  []*ReturnItem `pg:"rel:has-many"`
+}
+
+// ReturnItem is the quantity of one order item a return request covers
+type ReturnItem struct {
+	ID              uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	ReturnRequestID uuid.UUID `pg:"return_request_id,type:uuid,notnull"`
+	OrderItemID     uuid.UUID `pg:"order_item_id,type:uuid,notnull"`
+	Quantity        int32     `pg:"quantity,notnull"`
+	// Relations
+	ReturnRequest *ReturnRequest `pg:"rel:belongs-to"`
+	OrderItem     *OrderItem     `pg:"rel:belongs-to"`
+}
+
+type StockMovementReason string
+
+const (
+	StockReasonOrderCanceled StockMovementReason = "order_canceled"
+	StockReasonRefund        StockMovementReason = "refund"
+)
+
+// StockMovement records a change to a product's stock that was not made by
+// editing the product directly, such as a restock after a cancellation
+type StockMovement struct {
+	ID        uuid.UUID           `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	ProductID uuid.UUID           `pg:"product_id,type:uuid,notnull"`
+	OrderID   *uuid.UUID          `pg:"order_id,type:uuid"`
+	Quantity  int32               `pg:"quantity,notnull"`
+	Reason    StockMovementReason `pg:"reason,notnull"`
+	CreatedAt time.Time           `pg:"created_at,notnull,default:now()"`
+	// Relations
+	Product *Product `pg:"rel:belongs-to"`
+	Order   *Order   `pg:"rel:belongs-to"`
+}
+
+// Checkout groups the per-shop orders created by a single purchase
+type Checkout struct {
+	ID              uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	UserID          uuid.UUID `pg:"user_id,type:uuid,notnull"`
+	TotalAmount     float64   `pg:"total_amount,notnull,use_zero"`
+	ShippingAddress string    `pg:"shipping_address,notnull"`
+	CreatedAt       time.Time `pg:"created_at,notnull,default:now()"`
+	// Relations
+	User   *User    `pg:"rel:belongs-to"`
+	Orders []*Order `pg:"rel:has-many"`
+}
+
 type OrderItem struct {
 	ID              uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
 	OrderID         uuid.UUID `pg:"order_id,type:uuid,notnull"`
@@ -96,14 +651,120 @@ type OrderItem struct {
 	Product *Product `pg:"rel:belongs-to"`
 }
 
+type Cart struct {
+	ID        uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	UserID    uuid.UUID `pg:"user_id,type:uuid,unique,notnull"`
+	CreatedAt time.Time `pg:"created_at,notnull,default:now()"`
+	UpdatedAt time.Time `pg:"updated_at,notnull,default:now()"`
+	// Relations
+	User      *User       `pg:"rel:belongs-to"`
+	CartItems []*CartItem `pg:"rel:has-many"`
+}
+
+type CartItem struct {
+	ID        uuid.UUID `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	CartID    uuid.UUID `pg:"cart_id,type:uuid,notnull,unique:cart_product"`
+	ProductID uuid.UUID `pg:"product_id,type:uuid,notnull,unique:cart_product"`
+	Quantity  int32     `pg:"quantity,notnull"`
+	CreatedAt time.Time `pg:"created_at,notnull,default:now()"`
+	UpdatedAt time.Time `pg:"updated_at,notnull,default:now()"`
+	// Relations
+	Cart    *Cart    `pg:"rel:belongs-to"`
+	Product *Product `pg:"rel:belongs-to"`
+}
+
+// AuditAction names a privileged action recorded in the audit log
+type AuditAction string
+
+const (
+	AuditUserBan                  AuditAction = "user.ban"
+	AuditUserUnban                AuditAction = "user.unban"
+	AuditUserRoleChange           AuditAction = "user.role_change"
+	AuditUserDelete               AuditAction = "user.delete"
+	AuditOrderStatusChange        AuditAction = "order.status_change"
+	AuditOrderRefund              AuditAction = "order.refund"
+	AuditReturnApprove            AuditAction = "return.approve"
+	AuditReturnReject             AuditAction = "return.reject"
+	AuditReturnReceive            AuditAction = "return.receive"
+	AuditProductDelete            AuditAction = "product.delete"
+	AuditShopUpdate               AuditAction = "shop.update"
+	AuditShopMemberInvite         AuditAction = "shop_member.invite"
+	AuditShopMemberRoleChange     AuditAction = "shop_member.role_change"
+	AuditShopMemberRemove         AuditAction = "shop_member.remove"
+	AuditSellerApplicationApprove AuditAction = "seller_application.approve"
+	AuditSellerApplicationReject  AuditAction = "seller_application.reject"
+	AuditRoleCreate               AuditAction = "role.create"
+	AuditRoleUpdate               AuditAction = "role.update"
+	AuditRoleDelete               AuditAction = "role.delete"
+	AuditMFAPolicyUpdate          AuditAction = "mfa_policy.update"
+)
+
+// AuditTargetType is the kind of resource an audited action acted on
+type AuditTargetType string
+
+const (
+	AuditTargetUser              AuditTargetType = "user"
+	AuditTargetOrder             AuditTargetType = "order"
+	AuditTargetReturn            AuditTargetType = "return"
+	AuditTargetProduct           AuditTargetType = "product"
+	AuditTargetShop              AuditTargetType = "shop"
+	AuditTargetSellerApplication AuditTargetType = "seller_application"
+	AuditTargetRole              AuditTargetType = "role"
+)
+
+// AuditEvent records who performed a privileged action, on what, and what
+// the target looked like before and after. Events are never changed.
+type AuditEvent struct {
+	ID         uuid.UUID       `pg:"id,type:uuid,pk,default:gen_random_uuid()"`
+	ActorID    uuid.UUID       `pg:"actor_id,type:uuid,notnull"`
+	ActorRole  UserRole        `pg:"actor_role,notnull"`
+	Action     AuditAction     `pg:"action,notnull"`
+	TargetType AuditTargetType `pg:"target_type,notnull"`
+	TargetID   string          `pg:"target_id,notnull"`
+	Before     json.RawMessage `pg:"before,type:jsonb"`
+	After      json.RawMessage `pg:"after,type:jsonb"`
+	IP         string          `pg:"ip"`        // From X-Forwarded-For only behind a trusted proxy
+	RemoteIP   string          `pg:"remote_ip"` // Address of the connection itself
+	RequestID  string          `pg:"request_id"`
+	// ClientRequestID is the X-Request-ID the client sent. Clients choose
+	// it, so it is kept apart from RequestID.
+	ClientRequestID string    `pg:"client_request_id"`
+	CreatedAt       time.Time `pg:"created_at,notnull,default:now()"`
+}
+
 // CreateSchema creates database schema for all models
 func CreateSchema(db *pg.DB) error {
 	models := []interface{}{
+		(*Role)(nil),
+		(*RolePermission)(nil),
 		(*User)(nil),
+		(*Session)(nil),
+		(*PasswordResetToken)(nil),
+		(*EmailVerificationToken)(nil),
+		(*UserMFA)(nil),
+		(*MFARecoveryCode)(nil),
+		(*MFAChallenge)(nil),
+		(*MFAPolicy)(nil),
+		(*SellerApplication)(nil),
 		(*Shop)(nil),
+		(*ShopMember)(nil),
+		(*ShopInvitation)(nil),
 		(*Product)(nil),
 		(*Order)(nil),
 		(*OrderItem)(nil),
+		(*Cart)(nil),
+		(*CartItem)(nil),
+		(*Checkout)(nil),
+		(*OrderStatusHistory)(nil),
+		(*StockMovement)(nil),
+		(*OrderCancellation)(nil),
+		(*Payment)(nil),
+		(*PaymentWebhookEvent)(nil),
+		(*Refund)(nil),
+		(*RefundItem)(nil),
+		(*ReturnRequest)(nil),
+		(*ReturnItem)(nil),
+		(*AuditEvent)(nil),
 	}
 
 	for _, model := range models {
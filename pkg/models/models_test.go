@@ -0,0 +1,113 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOrderStatusTransitions(t *testing.T) {
+	statuses := []OrderStatus{StatusPending, StatusPaid, StatusShipped, StatusDelivered, StatusCanceled, StatusRefunded}
+	allowed := map[OrderStatus]map[OrderStatus]bool{
+		StatusPending:   {StatusPaid: true, StatusCanceled: true},
+		StatusPaid:      {StatusShipped: true, StatusCanceled: true, StatusRefunded: true},
+		StatusShipped:   {StatusDelivered: true, StatusRefunded: true},
+		StatusDelivered: {StatusRefunded: true},
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[from][to]
+			if got := from.CanTransitionTo(to); got != want {
+				t.Errorf("%s -> %s allowed = %v, want %v", from, to, got, want)
+			}
+
+			err := from.ValidateTransition(to)
+			if want && err != nil {
+				t.Errorf("ValidateTransition(%s -> %s) = %v", from, to, err)
+			}
+			if !want && !errors.Is(err, ErrInvalidStatusTransition) {
+				t.Errorf("ValidateTransition(%s -> %s) = %v, want ErrInvalidStatusTransition", from, to, err)
+			}
+		}
+	}
+
+	// Canceled and refunded orders are final
+	for _, status := range []OrderStatus{StatusCanceled, StatusRefunded} {
+		if next := status.NextStatuses(); len(next) != 0 {
+			t.Errorf("%s can move to %v, want nothing", status, next)
+		}
+	}
+}
+
+func TestShopRolePermissions(t *testing.T) {
+	tests := []struct {
+		role  ShopRole
+		perms map[Permission]bool
+	}{
+		{ShopRoleOwner, map[Permission]bool{PermShopUpdate: true, PermShopMembers: true, PermProductWrite: true, PermOrderFulfill: true, PermOrderRefund: true}},
+		{ShopRoleManager, map[Permission]bool{PermShopUpdate: true, PermProductWrite: true, PermOrderFulfill: true, PermOrderRefund: true}},
+		{ShopRoleFulfillment, map[Permission]bool{PermOrderFulfill: true}},
+		{ShopRole("cashier"), map[Permission]bool{}},
+	}
+
+	for _, tt := range tests {
+		if got, want := tt.role.IsValid(), len(tt.perms) > 0; got != want {
+			t.Errorf("%s.IsValid() = %v, want %v", tt.role, got, want)
+		}
+		for _, perm := range ShopPermissions {
+			if got := tt.role.Allows(perm); got != tt.perms[perm] {
+				t.Errorf("%s.Allows(%s) = %v, want %v", tt.role, perm, got, tt.perms[perm])
+			}
+		}
+		// Shop roles never grant permissions on other shops
+		for _, perm := range []Permission{PermShopManageAny, PermProductWriteAny, PermOrderRefundAny} {
+			if tt.role.Allows(perm) {
+				t.Errorf("%s.Allows(%s) = true", tt.role, perm)
+			}
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	for _, perm := range AllPermissions {
+		if !perm.IsValid() {
+			t.Errorf("%s is not valid", perm)
+		}
+	}
+
+	// Shop-only permissions can't be granted to user roles
+	for _, perm := range []Permission{PermShopUpdate, PermShopMembers, Permission("order:steal")} {
+		if perm.IsValid() {
+			t.Errorf("%s is valid for user roles", perm)
+		}
+	}
+
+	// Built-in roles only get known permissions, and the shop permissions
+	// that routes check are granted to sellers and staff
+	for role, perms := range DefaultRolePermissions {
+		for _, perm := range perms {
+			if !perm.IsValid() {
+				t.Errorf("default permission %s of %s is not valid", perm, role)
+			}
+		}
+	}
+	for _, role := range []UserRole{RoleSeller, RoleStaff} {
+		for _, perm := range []Permission{PermProductWrite, PermOrderFulfill, PermOrderRefund} {
+			if !hasPermission(DefaultRolePermissions[role], perm) {
+				t.Errorf("%s is missing %s", role, perm)
+			}
+		}
+	}
+	if len(DefaultRolePermissions[RoleBuyer]) != 0 {
+		t.Errorf("buyers have permissions %v", DefaultRolePermissions[RoleBuyer])
+	}
+}
+
+func hasPermission(perms []Permission, perm Permission) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// FakeProviderName is the name of the built-in fake provider
+const FakeProviderName = "fake"
+
+// FakeDeclineToken makes the fake provider decline an authorization
+const FakeDeclineToken = "tok_decline"
+
+// FakeSignatureHeader carries the HMAC signature of fake webhook events
+const FakeSignatureHeader = "X-Fake-Signature"
+
+// FakeProvider is a payment provider for local development and testing.
+// It approves every payment except those made with FakeDeclineToken.
+type FakeProvider struct {
+	webhookSecret string
+
+	mu      sync.Mutex
+	refunds map[string]*Result // by idempotency key
+}
+
+// NewFakeProvider creates a new FakeProvider. Webhooks are rejected when
+// webhookSecret is empty.
+func NewFakeProvider(webhookSecret string) *FakeProvider {
+	return &FakeProvider{
+		webhookSecret: webhookSecret,
+		refunds:       make(map[string]*Result),
+	}
+}
+
+// fakeWebhookBody is the JSON body of a fake webhook event
+type fakeWebhookBody struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		TransactionID string  `json:"transaction_id"`
+		Amount        float64 `json:"amount"`
+		Reason        string  `json:"reason"`
+	} `json:"data"`
+}
+
+func (p *FakeProvider) Name() string {
+	return FakeProviderName
+}
+
+func (p *FakeProvider) Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error) {
+	if req.PaymentMethod == FakeDeclineToken {
+		return nil, ErrPaymentDeclined
+	}
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("invalid amount: %.2f", req.Amount)
+	}
+	return &Result{TransactionID: "fake_auth_" + uuid.NewString(), Status: "authorized"}, nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, authorizationID string, amount float64) (*Result, error) {
+	return &Result{TransactionID: "fake_cap_" + uuid.NewString(), Status: "captured"}, nil
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, captureID string, amount float64, idempotencyKey string) (*Result, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid amount: %.2f", amount)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if result, ok := p.refunds[idempotencyKey]; ok {
+		return result, nil
+	}
+	result := &Result{TransactionID: "fake_ref_" + uuid.NewString(), Status: "refunded"}
+	p.refunds[idempotencyKey] = result
+	return result, nil
+}
+
+// ParseWebhook verifies the signature in FakeSignatureHeader and decodes the event
+func (p *FakeProvider) ParseWebhook(header http.Header, body []byte) (*WebhookEvent, error) {
+	if err := VerifySignature(p.webhookSecret, body, header.Get(FakeSignatureHeader)); err != nil {
+		return nil, err
+	}
+
+	var event fakeWebhookBody
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook body: %w", err)
+	}
+	if event.ID == "" || event.Type == "" {
+		return nil, errors.New("invalid webhook body: missing id or type")
+	}
+
+	return &WebhookEvent{
+		ID:            event.ID,
+		Type:          event.Type,
+		TransactionID: event.Data.TransactionID,
+		Amount:        event.Data.Amount,
+		Reason:        event.Data.Reason,
+	}, nil
+}
@@ -0,0 +1,90 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrPaymentDeclined is returned by a provider when it refuses a payment
+var ErrPaymentDeclined = errors.New("payment declined")
+
+// ErrPaymentsDisabled is returned when no payment provider is configured
+var ErrPaymentsDisabled = errors.New("payments are not configured")
+
+// AuthorizeRequest describes a payment to be authorized
+type AuthorizeRequest struct {
+	OrderID       string
+	Amount        float64
+	Currency      string
+	PaymentMethod string // opaque token from the client, e.g. a card token
+}
+
+// Result is the outcome of a provider operation
+type Result struct {
+	TransactionID string
+	Status        string
+}
+
+// PaymentProvider is implemented by every payment gateway integration.
+// Amounts are in the currency's major unit.
+type PaymentProvider interface {
+	// Name returns the identifier used to select the provider
+	Name() string
+	// Authorize reserves the amount on the buyer's payment method
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error)
+	// Capture collects a previously authorized amount
+	Capture(ctx context.Context, authorizationID string, amount float64) (*Result, error)
+	// Refund returns part or all of a captured amount to the buyer.
+	// Calls with the same idempotencyKey must return the money only once,
+	// so a refund whose outcome is unknown can safely be sent again.
+	Refund(ctx context.Context, captureID string, amount float64, idempotencyKey string) (*Result, error)
+}
+
+// Registry holds the configured payment providers
+type Registry struct {
+	providers       map[string]PaymentProvider
+	defaultProvider string
+}
+
+// NewRegistry creates a Registry with the given providers. defaultProvider
+// must be the name of one of them, or empty to disable payments.
+func NewRegistry(defaultProvider string, providers ...PaymentProvider) (*Registry, error) {
+	registry := &Registry{
+		providers:       make(map[string]PaymentProvider, len(providers)),
+		defaultProvider: defaultProvider,
+	}
+	for _, provider := range providers {
+		registry.providers[provider.Name()] = provider
+	}
+
+	if defaultProvider == "" {
+		return registry, nil
+	}
+	if _, ok := registry.providers[defaultProvider]; !ok {
+		return nil, fmt.Errorf("unknown default payment provider: %s", defaultProvider)
+	}
+	return registry, nil
+}
+
+// Default returns the provider that charges buyers, or
+// ErrPaymentsDisabled if there is none
+func (r *Registry) Default() (PaymentProvider, error) {
+	if r.defaultProvider == "" {
+		return nil, ErrPaymentsDisabled
+	}
+	return r.providers[r.defaultProvider], nil
+}
+
+// Get returns the provider with the given name, or the default provider if
+// name is empty
+func (r *Registry) Get(name string) (PaymentProvider, error) {
+	if name == "" {
+		return r.Default()
+	}
+	provider, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown payment provider: %s", name)
+	}
+	return provider, nil
+}
@@ -0,0 +1,38 @@
+package payment
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	fake := NewFakeProvider("secret")
+
+	registry, err := NewRegistry(FakeProviderName, fake)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	if provider, err := registry.Default(); err != nil || provider != fake {
+		t.Errorf("Default() = %v, %v, want the fake provider", provider, err)
+	}
+	if _, err := registry.Get("stripe"); err == nil {
+		t.Error("Get returned an unknown provider")
+	}
+
+	if _, err := NewRegistry(FakeProviderName); err == nil {
+		t.Error("NewRegistry accepted a default provider that isn't registered")
+	}
+}
+
+func TestRegistryWithoutProvider(t *testing.T) {
+	registry, err := NewRegistry("")
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	if _, err := registry.Default(); !errors.Is(err, ErrPaymentsDisabled) {
+		t.Errorf("Default() error = %v, want ErrPaymentsDisabled", err)
+	}
+	if _, err := registry.Get(""); !errors.Is(err, ErrPaymentsDisabled) {
+		t.Errorf("Get(\"\") error = %v, want ErrPaymentsDisabled", err)
+	}
+}
@@ -0,0 +1,58 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// ErrInvalidSignature is returned when a webhook signature does not match
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Webhook event types understood by the API
+const (
+	EventPaymentCaptured = "payment.captured"
+	EventPaymentFailed   = "payment.failed"
+)
+
+// WebhookEvent is a provider event normalized for processing
+type WebhookEvent struct {
+	ID            string
+	Type          string
+	TransactionID string // the authorization the event refers to
+	Amount        float64
+	Reason        string
+}
+
+// WebhookParser is implemented by providers that push asynchronous events.
+// ParseWebhook must verify the request signature before trusting the body.
+type WebhookParser interface {
+	ParseWebhook(header http.Header, body []byte) (*WebhookEvent, error)
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body using secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks a hex encoded HMAC-SHA256 signature of body in
+// constant time
+func VerifySignature(secret string, body []byte, signature string) error {
+	if secret == "" || signature == "" {
+		return ErrInvalidSignature
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
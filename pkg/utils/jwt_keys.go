@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Supported JWT signing algorithms
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+const rsaKeySize = 2048
+
+// SigningKey is a private key used to sign tokens, identified in the token
+// header by its key ID
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	CreatedAt  time.Time
+}
+
+// JWTKeyOptions configures a JWTMaker that signs with asymmetric keys
+type JWTKeyOptions struct {
+	// Algorithm is RS256 or EdDSA
+	Algorithm string
+	// KeysDir holds the keys as PKCS#8 PEM files named <kid>.pem. When empty,
+	// keys only live in memory and change on every restart.
+	KeysDir string
+	// RotateEvery is how often a new signing key is generated; zero disables
+	// rotation
+	RotateEvery time.Duration
+	// RetainFor is how long a replaced key is still accepted, which should be
+	// at least the lifetime of a token
+	RetainFor time.Duration
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKSet is a JSON Web Key Set
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// generateSigningKey creates a new key for the algorithm with a random ID
+func generateSigningKey(algorithm string) (*SigningKey, error) {
+	var signer crypto.Signer
+	switch algorithm {
+	case AlgorithmRS256:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+		}
+		signer = key
+	case AlgorithmEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+		}
+		signer = key
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", algorithm)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate key ID: %w", err)
+	}
+
+	return &SigningKey{
+		ID:         hex.EncodeToString(id),
+		Algorithm:  algorithm,
+		PrivateKey: signer,
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+// loadSigningKeys reads the keys for the algorithm from dir, oldest first.
+// Keys of other types are skipped so a directory can be shared while
+// switching algorithms.
+func loadSigningKeys(dir, algorithm string) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*SigningKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", path, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid PEM in key %s", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", path, err)
+		}
+
+		var signer crypto.Signer
+		switch key := parsed.(type) {
+		case *rsa.PrivateKey:
+			if algorithm != AlgorithmRS256 {
+				continue
+			}
+			signer = key
+		case ed25519.PrivateKey:
+			if algorithm != AlgorithmEdDSA {
+				continue
+			}
+			signer = key
+		default:
+			continue
+		}
+
+		keys = append(keys, &SigningKey{
+			ID:         strings.TrimSuffix(filepath.Base(path), ".pem"),
+			Algorithm:  algorithm,
+			PrivateKey: signer,
+			CreatedAt:  info.ModTime(),
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// saveSigningKey writes a key to dir as <kid>.pem
+func saveSigningKey(dir string, key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return os.WriteFile(filepath.Join(dir, key.ID+".pem"), data, 0o600)
+}
+
+// publicJWK returns the public part of a key in JSON Web Key format
+func publicJWK(key *SigningKey) (JWK, error) {
+	jwk := JWK{
+		KeyID:     key.ID,
+		Use:       "sig",
+		Algorithm: key.Algorithm,
+	}
+
+	switch pub := key.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return JWK{}, errors.New("unsupported public key type")
+	}
+
+	return jwk, nil
+}
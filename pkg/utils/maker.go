@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TokenMaker creates and verifies access tokens
+type TokenMaker interface {
+	// CreateToken creates a new token for a user
+	CreateToken(userID uuid.UUID, username string, role string, duration time.Duration) (string, error)
+	// VerifyToken checks if the token is valid and returns its payload
+	VerifyToken(token string) (*Payload, error)
+}
+
+// KeySetPublisher is implemented by token makers whose tokens can be
+// verified with published public keys
+type KeySetPublisher interface {
+	JWKS() (*JWKSet, error)
+}
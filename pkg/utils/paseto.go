@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	pasetoKeySize   = 32
+	pasetoNonceSize = 32
+	pasetoTagSize   = 32
+	pasetoV4Local   = "v4.local."
+)
+
+// PasetoMaker is a PASETO v4.local token maker. Tokens are encrypted and
+// authenticated with a symmetric key, and the version fixes the algorithms,
+// so there is no algorithm header to tamper with.
+type PasetoMaker struct {
+	symmetricKey []byte
+}
+
+// NewPasetoMaker creates a new PasetoMaker from a 32 byte key
+func NewPasetoMaker(symmetricKey []byte) (*PasetoMaker, error) {
+	if len(symmetricKey) != pasetoKeySize {
+		return nil, fmt.Errorf("invalid key size: must be exactly %d bytes", pasetoKeySize)
+	}
+	key := make([]byte, pasetoKeySize)
+	copy(key, symmetricKey)
+	return &PasetoMaker{symmetricKey: key}, nil
+}
+
+// CreateToken creates a new token for a user
+func (maker *PasetoMaker) CreateToken(userID uuid.UUID, username string, role string, duration time.Duration) (string, error) {
+	payload := &Payload{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Username:  username,
+		Role:      role,
+		IssuedAt:  time.Now(),
+		ExpiredAt: time.Now().Add(duration),
+	}
+
+	message, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	nonce := make([]byte, pasetoNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return maker.encrypt(message, nonce)
+}
+
+// VerifyToken checks if the token is valid
+func (maker *PasetoMaker) VerifyToken(token string) (*Payload, error) {
+	message, err := maker.decrypt(token)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &Payload{}
+	if err := json.Unmarshal(message, payload); err != nil {
+		return nil, errors.New("invalid token")
+	}
+
+	// Check if the token has expired
+	if time.Now().After(payload.ExpiredAt) {
+		return nil, errors.New("token has expired")
+	}
+
+	return payload, nil
+}
+
+// encrypt seals message into a v4.local token with the given nonce
+func (maker *PasetoMaker) encrypt(message, nonce []byte) (string, error) {
+	encKey, counterNonce, authKey, err := maker.splitKeys(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := make([]byte, len(message))
+	cipher, err := chacha20.NewUnauthenticatedCipher(encKey, counterNonce)
+	if err != nil {
+		return "", err
+	}
+	cipher.XORKeyStream(ciphertext, message)
+
+	tag, err := pasetoTag(authKey, nonce, ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	body := make([]byte, 0, len(nonce)+len(ciphertext)+len(tag))
+	body = append(body, nonce...)
+	body = append(body, ciphertext...)
+	body = append(body, tag...)
+	return pasetoV4Local + base64.RawURLEncoding.EncodeToString(body), nil
+}
+
+// decrypt authenticates a v4.local token and returns its message
+func (maker *PasetoMaker) decrypt(token string) ([]byte, error) {
+	if !strings.HasPrefix(token, pasetoV4Local) {
+		return nil, errors.New("invalid token")
+	}
+
+	// Footers are not used
+	encoded := strings.TrimPrefix(token, pasetoV4Local)
+	if strings.Contains(encoded, ".") {
+		return nil, errors.New("invalid token")
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(body) < pasetoNonceSize+pasetoTagSize {
+		return nil, errors.New("invalid token")
+	}
+
+	nonce := body[:pasetoNonceSize]
+	ciphertext := body[pasetoNonceSize : len(body)-pasetoTagSize]
+	tag := body[len(body)-pasetoTagSize:]
+
+	encKey, counterNonce, authKey, err := maker.splitKeys(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedTag, err := pasetoTag(authKey, nonce, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(tag, expectedTag) != 1 {
+		return nil, errors.New("invalid token")
+	}
+
+	message := make([]byte, len(ciphertext))
+	cipher, err := chacha20.NewUnauthenticatedCipher(encKey, counterNonce)
+	if err != nil {
+		return nil, err
+	}
+	cipher.XORKeyStream(message, ciphertext)
+	return message, nil
+}
+
+// splitKeys derives the encryption key, the XChaCha20 nonce and the
+// authentication key for a token nonce
+func (maker *PasetoMaker) splitKeys(nonce []byte) (encKey, counterNonce, authKey []byte, err error) {
+	h, err := blake2b.New(56, maker.symmetricKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(nonce)
+	tmp := h.Sum(nil)
+
+	h, err = blake2b.New(32, maker.symmetricKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-auth-key-for-aead"))
+	h.Write(nonce)
+
+	return tmp[:32], tmp[32:], h.Sum(nil), nil
+}
+
+// pasetoTag computes the authentication tag over the header, nonce and
+// ciphertext with empty footer and implicit assertion
+func pasetoTag(authKey, nonce, ciphertext []byte) ([]byte, error) {
+	h, err := blake2b.New(pasetoTagSize, authKey)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(preAuthEncode([]byte(pasetoV4Local), nonce, ciphertext, nil, nil))
+	return h.Sum(nil), nil
+}
+
+// preAuthEncode is PASETO's PAE: the piece count followed by each piece
+// prefixed with its length, all as little-endian 64-bit integers
+func preAuthEncode(pieces ...[]byte) []byte {
+	size := 8
+	for _, piece := range pieces {
+		size += 8 + len(piece)
+	}
+
+	out := make([]byte, 0, size)
+	out = binary.LittleEndian.AppendUint64(out, uint64(len(pieces)))
+	for _, piece := range pieces {
+		out = binary.LittleEndian.AppendUint64(out, uint64(len(piece)))
+		out = append(out, piece...)
+	}
+	return out
+}
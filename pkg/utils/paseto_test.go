@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// pasetoTestKey is the symmetric key of the official v4.local test vectors
+const pasetoTestKey = "707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f"
+
+var _ TokenMaker = (*PasetoMaker)(nil)
+
+func newTestPasetoMaker(t *testing.T, keyHex string) *PasetoMaker {
+	t.Helper()
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maker, err := NewPasetoMaker(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return maker
+}
+
+// TestPasetoV4LocalVectors checks the official vectors without a footer or
+// implicit assertion, which are the only ones this maker produces
+func TestPasetoV4LocalVectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		nonce   string
+		payload string
+		token   string
+	}{
+		{
+			name:    "4-E-1",
+			nonce:   "0000000000000000000000000000000000000000000000000000000000000000",
+			payload: `{"data":"this is a secret message","exp":"2022-01-01T00:00:00+00:00"}`,
+			token:   "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvSwscFlAl1pk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XJ5hOb_4v9RmDkneN0S92dx0OW4pgy7omxgf3S8c3LlQg",
+		},
+		{
+			name:    "4-E-2",
+			nonce:   "0000000000000000000000000000000000000000000000000000000000000000",
+			payload: `{"data":"this is a hidden message","exp":"2022-01-01T00:00:00+00:00"}`,
+			token:   "v4.local.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAQAr68PS4AXe7If_ZgesdkUMvS2csCgglvpk5HC0e8kApeaqMfGo_7OpBnwJOAbY9V7WU6abu74MmcUE8YWAiaArVI8XIemu9chy3WVKvRBfg6t8wwYHK0ArLxxfZP73W_vfwt5A",
+		},
+	}
+
+	maker := newTestPasetoMaker(t, pasetoTestKey)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce, err := hex.DecodeString(tt.nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := maker.encrypt([]byte(tt.payload), nonce)
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			if token != tt.token {
+				t.Errorf("encrypt = %s, want %s", token, tt.token)
+			}
+
+			message, err := maker.decrypt(tt.token)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if string(message) != tt.payload {
+				t.Errorf("decrypt = %s, want %s", message, tt.payload)
+			}
+		})
+	}
+}
+
+func TestPasetoMakerRoundTrip(t *testing.T) {
+	maker := newTestPasetoMaker(t, pasetoTestKey)
+	userID := uuid.New()
+
+	token, err := maker.CreateToken(userID, "alice", "seller", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if !strings.HasPrefix(token, "v4.local.") {
+		t.Fatalf("token %q is not a v4.local token", token)
+	}
+
+	payload, err := maker.VerifyToken(token)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if payload.UserID != userID || payload.Username != "alice" || payload.Role != "seller" {
+		t.Errorf("payload = %+v, want user %s alice seller", payload, userID)
+	}
+	if d := payload.ExpiredAt.Sub(payload.IssuedAt); d < time.Minute-time.Second || d > time.Minute+time.Second {
+		t.Errorf("token lifetime = %s, want 1m", d)
+	}
+
+	// Every token gets a fresh nonce
+	other, err := maker.CreateToken(userID, "alice", "seller", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if other == token {
+		t.Error("two tokens for the same payload are identical")
+	}
+}
+
+func TestPasetoMakerRejectsTamperedTokens(t *testing.T) {
+	maker := newTestPasetoMaker(t, pasetoTestKey)
+	token, err := maker.CreateToken(uuid.New(), "alice", "buyer", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, pasetoV4Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip one bit in the nonce, the ciphertext and the tag
+	for name, offset := range map[string]int{
+		"nonce":      0,
+		"ciphertext": pasetoNonceSize,
+		"tag":        len(body) - 1,
+	} {
+		t.Run(name, func(t *testing.T) {
+			tampered := bytes.Clone(body)
+			tampered[offset] ^= 1
+			_, err := maker.VerifyToken(pasetoV4Local + base64.RawURLEncoding.EncodeToString(tampered))
+			if err == nil || err.Error() != "invalid token" {
+				t.Errorf("VerifyToken error = %v, want invalid token", err)
+			}
+		})
+	}
+
+	malformed := map[string]string{
+		"truncated":     pasetoV4Local + base64.RawURLEncoding.EncodeToString(body[:pasetoNonceSize+pasetoTagSize-1]),
+		"other version": "v3.local." + strings.TrimPrefix(token, pasetoV4Local),
+		"public":        "v4.public." + strings.TrimPrefix(token, pasetoV4Local),
+		"footer":        token + ".e30",
+		"bad base64":    token + "!",
+		"empty":         "",
+	}
+	for name, bad := range malformed {
+		t.Run(name, func(t *testing.T) {
+			if _, err := maker.VerifyToken(bad); err == nil {
+				t.Error("VerifyToken accepted a malformed token")
+			}
+		})
+	}
+}
+
+func TestPasetoMakerRejectsWrongKey(t *testing.T) {
+	maker := newTestPasetoMaker(t, pasetoTestKey)
+	other := newTestPasetoMaker(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+
+	token, err := maker.CreateToken(uuid.New(), "alice", "buyer", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.VerifyToken(token); err == nil || err.Error() != "invalid token" {
+		t.Errorf("VerifyToken error = %v, want invalid token", err)
+	}
+}
+
+func TestPasetoMakerRejectsExpiredTokens(t *testing.T) {
+	maker := newTestPasetoMaker(t, pasetoTestKey)
+
+	token, err := maker.CreateToken(uuid.New(), "alice", "buyer", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maker.VerifyToken(token); err == nil || err.Error() != "token has expired" {
+		t.Errorf("VerifyToken error = %v, want token has expired", err)
+	}
+}
+
+func TestNewPasetoMakerKeySize(t *testing.T) {
+	for _, size := range []int{0, 16, 31, 33, 64} {
+		if _, err := NewPasetoMaker(make([]byte, size)); err == nil {
+			t.Errorf("NewPasetoMaker accepted a %d byte key", size)
+		}
+	}
+}
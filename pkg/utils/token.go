@@ -1,8 +1,12 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -11,9 +15,23 @@ import (
 
 const minSecretKeySize = 32
 
-// JWTMaker is a JSON Web Token maker
+// keyRotationCheckInterval is how often StartKeyRotation checks whether the
+// signing key is due for rotation
+const keyRotationCheckInterval = time.Minute
+
+// JWTMaker is a JSON Web Token maker. It signs either with a shared HS256
+// secret or with a set of RS256/EdDSA keys identified by the kid header.
 type JWTMaker struct {
 	secretKey string
+
+	// Asymmetric signing
+	options JWTKeyOptions
+	mu      sync.RWMutex
+	keys    map[string]*SigningKey
+	// current is the key new tokens are signed with
+	current *SigningKey
+	// retiredAt records when a key stopped being the current one
+	retiredAt map[string]time.Time
 }
 
 // Payload contains the payload data of the JWT
@@ -31,7 +49,38 @@ func NewJWTMaker(secretKey string) (*JWTMaker, error) {
 	if len(secretKey) < minSecretKeySize {
 		return nil, fmt.Errorf("invalid key size: must be at least %d characters", minSecretKeySize)
 	}
-	return &JWTMaker{secretKey}, nil
+	return &JWTMaker{secretKey: secretKey}, nil
+}
+
+// NewAsymmetricJWTMaker creates a JWTMaker that signs with RS256 or EdDSA
+// keys. Existing keys are loaded from options.KeysDir; if there are none, a
+// key is generated.
+func NewAsymmetricJWTMaker(options JWTKeyOptions) (*JWTMaker, error) {
+	if options.Algorithm != AlgorithmRS256 && options.Algorithm != AlgorithmEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", options.Algorithm)
+	}
+
+	maker := &JWTMaker{
+		options:   options,
+		keys:      make(map[string]*SigningKey),
+		retiredAt: make(map[string]time.Time),
+	}
+
+	if err := maker.reloadKeys(); err != nil {
+		return nil, err
+	}
+	if maker.current == nil {
+		if _, err := maker.RotateKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	return maker, nil
+}
+
+// isAsymmetric reports whether the maker signs with key pairs
+func (maker *JWTMaker) isAsymmetric() bool {
+	return maker.options.Algorithm != ""
 }
 
 // CreateToken creates a new token for a user
@@ -45,21 +94,35 @@ func (maker *JWTMaker) CreateToken(userID uuid.UUID, username string, role strin
 		ExpiredAt: time.Now().Add(duration),
 	}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	claims := jwt.MapClaims{
 		"id":         payload.ID.String(),
 		"user_id":    payload.UserID.String(),
 		"username":   payload.Username,
 		"role":       payload.Role,
 		"issued_at":  payload.IssuedAt.Unix(),
 		"expired_at": payload.ExpiredAt.Unix(),
-	})
+	}
 
-	return jwtToken.SignedString([]byte(maker.secretKey))
+	if !maker.isAsymmetric() {
+		jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return jwtToken.SignedString([]byte(maker.secretKey))
+	}
+
+	maker.mu.RLock()
+	key := maker.current
+	maker.mu.RUnlock()
+
+	jwtToken := jwt.NewWithClaims(signingMethod(key.Algorithm), claims)
+	jwtToken.Header["kid"] = key.ID
+	return jwtToken.SignedString(key.PrivateKey)
 }
 
 // VerifyToken checks if the token is valid
 func (maker *JWTMaker) VerifyToken(token string) (*Payload, error) {
 	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		if maker.isAsymmetric() {
+			return maker.verificationKey(token)
+		}
 		_, ok := token.Method.(*jwt.SigningMethodHMAC)
 		if !ok {
 			return nil, errors.New("invalid token signing method")
@@ -111,3 +174,188 @@ func (maker *JWTMaker) VerifyToken(token string) (*Payload, error) {
 
 	return payload, nil
 }
+
+// verificationKey returns the public key for the kid in the token header.
+// The algorithm is fixed by the maker, never taken from the token.
+func (maker *JWTMaker) verificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != maker.options.Algorithm {
+		return nil, errors.New("invalid token signing method")
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	maker.mu.RLock()
+	key, ok := maker.keys[kid]
+	maker.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+
+	return key.PrivateKey.Public(), nil
+}
+
+// RotateKey generates a new signing key and makes it the current one. The
+// previous key keeps verifying tokens for options.RetainFor.
+func (maker *JWTMaker) RotateKey() (*SigningKey, error) {
+	if !maker.isAsymmetric() {
+		return nil, errors.New("key rotation requires an asymmetric signing algorithm")
+	}
+
+	key, err := generateSigningKey(maker.options.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if maker.options.KeysDir != "" {
+		if err := saveSigningKey(maker.options.KeysDir, key); err != nil {
+			return nil, fmt.Errorf("failed to save signing key: %w", err)
+		}
+	}
+
+	maker.mu.Lock()
+	defer maker.mu.Unlock()
+	maker.keys[key.ID] = key
+	maker.setCurrent(key)
+	maker.pruneKeys()
+	return key, nil
+}
+
+// StartKeyRotation rotates the signing key every options.RotateEvery until
+// ctx is done. Servers sharing options.KeysDir also pick up keys rotated by
+// each other.
+func (maker *JWTMaker) StartKeyRotation(ctx context.Context) {
+	if !maker.isAsymmetric() || maker.options.RotateEvery <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(keyRotationCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if maker.options.KeysDir != "" {
+				if err := maker.reloadKeys(); err != nil {
+					log.Printf("Failed to reload signing keys: %v", err)
+				}
+			}
+
+			maker.mu.RLock()
+			due := time.Since(maker.current.CreatedAt) >= maker.options.RotateEvery
+			maker.mu.RUnlock()
+
+			if due {
+				key, err := maker.RotateKey()
+				if err != nil {
+					log.Printf("Failed to rotate signing key: %v", err)
+					continue
+				}
+				log.Printf("Rotated JWT signing key, new key ID %s", key.ID)
+			}
+		}
+	}()
+}
+
+// JWKS returns the public keys that currently verify tokens
+func (maker *JWTMaker) JWKS() (*JWKSet, error) {
+	set := &JWKSet{Keys: []JWK{}}
+	if !maker.isAsymmetric() {
+		return set, nil
+	}
+
+	maker.mu.RLock()
+	defer maker.mu.RUnlock()
+	for _, key := range maker.keys {
+		jwk, err := publicJWK(key)
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	// Newest key first
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return maker.keys[set.Keys[i].KeyID].CreatedAt.After(maker.keys[set.Keys[j].KeyID].CreatedAt)
+	})
+	return set, nil
+}
+
+// reloadKeys merges the keys found in options.KeysDir into the key set
+func (maker *JWTMaker) reloadKeys() error {
+	if maker.options.KeysDir == "" {
+		return nil
+	}
+
+	keys, err := loadSigningKeys(maker.options.KeysDir, maker.options.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	maker.mu.Lock()
+	defer maker.mu.Unlock()
+	var newest *SigningKey
+	for _, key := range keys {
+		if _, ok := maker.keys[key.ID]; ok {
+			continue
+		}
+		maker.keys[key.ID] = key
+		newest = key
+	}
+	if newest != nil && (maker.current == nil || newest.CreatedAt.After(maker.current.CreatedAt)) {
+		maker.setCurrent(newest)
+	}
+	maker.pruneKeys()
+	return nil
+}
+
+// setCurrent makes key the signing key. Callers must hold maker.mu.
+func (maker *JWTMaker) setCurrent(key *SigningKey) {
+	if maker.current != nil {
+		maker.retiredAt[maker.current.ID] = time.Now()
+	}
+	maker.current = key
+}
+
+// pruneKeys drops keys that were replaced more than options.RetainFor ago.
+// Keys loaded from disk that were never current here are retired based on
+// the creation time of the key that replaced them. Callers must hold maker.mu.
+func (maker *JWTMaker) pruneKeys() {
+	for id, key := range maker.keys {
+		if key == maker.current {
+			continue
+		}
+
+		retiredAt, ok := maker.retiredAt[id]
+		if !ok {
+			retiredAt = maker.successorCreatedAt(key)
+		}
+		if time.Since(retiredAt) > maker.options.RetainFor {
+			delete(maker.keys, id)
+			delete(maker.retiredAt, id)
+		}
+	}
+}
+
+// successorCreatedAt returns when the first key newer than key was created.
+// Callers must hold maker.mu.
+func (maker *JWTMaker) successorCreatedAt(key *SigningKey) time.Time {
+	successor := maker.current.CreatedAt
+	for _, other := range maker.keys {
+		if other.CreatedAt.After(key.CreatedAt) && other.CreatedAt.Before(successor) {
+			successor = other.CreatedAt
+		}
+	}
+	return successor
+}
+
+// signingMethod returns the jwt signing method for an algorithm name
+func signingMethod(algorithm string) jwt.SigningMethod {
+	if algorithm == AlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
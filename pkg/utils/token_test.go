@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+var (
+	_ TokenMaker      = (*JWTMaker)(nil)
+	_ KeySetPublisher = (*JWTMaker)(nil)
+)
+
+func TestJWTMakerRoundTrip(t *testing.T) {
+	hs256, err := NewJWTMaker(testJWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makers := map[string]*JWTMaker{
+		AlgorithmHS256: hs256,
+		AlgorithmRS256: newTestAsymmetricMaker(t, JWTKeyOptions{Algorithm: AlgorithmRS256, RetainFor: time.Hour}),
+		AlgorithmEdDSA: newTestAsymmetricMaker(t, JWTKeyOptions{Algorithm: AlgorithmEdDSA, RetainFor: time.Hour}),
+	}
+
+	for alg, maker := range makers {
+		t.Run(alg, func(t *testing.T) {
+			userID := uuid.New()
+			token, err := maker.CreateToken(userID, "alice", "seller", time.Minute)
+			if err != nil {
+				t.Fatalf("CreateToken: %v", err)
+			}
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Method.Alg() != alg {
+				t.Errorf("token alg = %s, want %s", parsed.Method.Alg(), alg)
+			}
+
+			payload, err := maker.VerifyToken(token)
+			if err != nil {
+				t.Fatalf("VerifyToken: %v", err)
+			}
+			if payload.UserID != userID || payload.Username != "alice" || payload.Role != "seller" {
+				t.Errorf("payload = %+v, want user %s alice seller", payload, userID)
+			}
+		})
+	}
+}
+
+func TestNewJWTMakerKeySize(t *testing.T) {
+	if _, err := NewJWTMaker(testJWTSecret[:minSecretKeySize-1]); err == nil {
+		t.Error("NewJWTMaker accepted a short secret")
+	}
+	if _, err := NewAsymmetricJWTMaker(JWTKeyOptions{Algorithm: AlgorithmHS256}); err == nil {
+		t.Error("NewAsymmetricJWTMaker accepted HS256")
+	}
+}
+
+func TestJWTMakerRejectsInvalidTokens(t *testing.T) {
+	maker, err := NewJWTMaker(testJWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewJWTMaker(strings.Repeat("x", minSecretKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := maker.CreateToken(uuid.New(), "alice", "buyer", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := maker.CreateToken(uuid.New(), "alice", "buyer", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An unsigned token claiming to be an admin
+	claims := jwt.MapClaims{
+		"id":         uuid.NewString(),
+		"user_id":    uuid.NewString(),
+		"username":   "mallory",
+		"role":       "admin",
+		"issued_at":  time.Now().Unix(),
+		"expired_at": time.Now().Add(time.Hour).Unix(),
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + parts[1] + "." + flipFirstChar(parts[2])
+
+	tests := map[string]struct {
+		maker *JWTMaker
+		token string
+	}{
+		"expired":      {maker, expired},
+		"wrong secret": {other, token},
+		"alg none":     {maker, unsigned},
+		"tampered":     {maker, tampered},
+		"malformed":    {maker, "not-a-token"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := tt.maker.VerifyToken(tt.token); err == nil {
+				t.Error("VerifyToken accepted the token")
+			}
+		})
+	}
+
+	if _, err := maker.VerifyToken(expired); err == nil || err.Error() != "token has expired" {
+		t.Errorf("VerifyToken error = %v, want token has expired", err)
+	}
+}
+
+func TestAsymmetricJWTMakerRejectsOtherAlgorithms(t *testing.T) {
+	maker := newTestAsymmetricMaker(t, JWTKeyOptions{Algorithm: AlgorithmEdDSA, RetainFor: time.Hour})
+
+	// A token signed with the shared secret must not pass as an EdDSA one
+	hs256, err := NewJWTMaker(testJWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := hs256.CreateToken(uuid.New(), "mallory", "admin", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maker.VerifyToken(token); err == nil {
+		t.Error("EdDSA maker accepted an HS256 token")
+	}
+
+	// Nor one signed by another EdDSA maker
+	other := newTestAsymmetricMaker(t, JWTKeyOptions{Algorithm: AlgorithmEdDSA, RetainFor: time.Hour})
+	token, err = other.CreateToken(uuid.New(), "mallory", "admin", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maker.VerifyToken(token); err == nil {
+		t.Error("maker accepted a token signed with an unknown key")
+	}
+}
+
+func TestJWTMakerKeyRotation(t *testing.T) {
+	maker := newTestAsymmetricMaker(t, JWTKeyOptions{Algorithm: AlgorithmEdDSA, RetainFor: time.Hour})
+
+	old, err := maker.CreateToken(uuid.New(), "alice", "buyer", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maker.RotateKey(); err != nil {
+		t.Fatalf("RotateKey: %v", err)
+	}
+	current, err := maker.CreateToken(uuid.New(), "alice", "buyer", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens signed with the replaced key keep working for RetainFor
+	for name, token := range map[string]string{"old": old, "current": current} {
+		if _, err := maker.VerifyToken(token); err != nil {
+			t.Errorf("VerifyToken(%s): %v", name, err)
+		}
+	}
+	set, err := maker.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want 2", len(set.Keys))
+	}
+	if kid := tokenKeyID(t, current); set.Keys[0].KeyID != kid {
+		t.Errorf("first JWKS key = %s, want the current key %s", set.Keys[0].KeyID, kid)
+	}
+
+	// Without a retention period the replaced key goes at the next rotation
+	maker.options.RetainFor = 0
+	if _, err := maker.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maker.VerifyToken(old); err == nil {
+		t.Error("VerifyToken accepted a token signed with a pruned key")
+	}
+}
+
+func TestJWTMakerSharesKeysDir(t *testing.T) {
+	options := JWTKeyOptions{Algorithm: AlgorithmEdDSA, KeysDir: t.TempDir(), RetainFor: time.Hour}
+	first := newTestAsymmetricMaker(t, options)
+	token, err := first.CreateToken(uuid.New(), "alice", "buyer", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another server loads the same key and verifies the token
+	second := newTestAsymmetricMaker(t, options)
+	if _, err := second.VerifyToken(token); err != nil {
+		t.Errorf("VerifyToken on a maker sharing the keys: %v", err)
+	}
+	if tokenKeyID(t, token) != second.current.ID {
+		t.Error("second maker did not adopt the existing key")
+	}
+}
+
+func newTestAsymmetricMaker(t *testing.T, options JWTKeyOptions) *JWTMaker {
+	t.Helper()
+	maker, err := NewAsymmetricJWTMaker(options)
+	if err != nil {
+		t.Fatalf("NewAsymmetricJWTMaker: %v", err)
+	}
+	return maker
+}
+
+func tokenKeyID(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+// flipFirstChar changes the first character of a base64url string, which
+// unlike the last one never falls on padding bits
+func flipFirstChar(s string) string {
+	replacement := "A"
+	if s[0] == 'A' {
+		replacement = "B"
+	}
+	return replacement + s[1:]
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 4226 and RFC 6238 test vectors,
+// "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestHOTPVectors checks the RFC 4226 Appendix D values
+func TestHOTPVectors(t *testing.T) {
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	key := []byte("12345678901234567890")
+	for counter, code := range want {
+		if got := hotp(key, uint64(counter)); got != code {
+			t.Errorf("hotp(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+// TestValidateTOTPVectors checks the SHA-1 values of RFC 6238 Appendix B.
+// The RFC uses 8 digits; a 6 digit code is the last 6 of them.
+func TestValidateTOTPVectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0).UTC()
+		code := tt.code[len(tt.code)-totpDigits:]
+
+		step, ok := ValidateTOTP(rfcSecret, code, at)
+		if !ok {
+			t.Errorf("ValidateTOTP(%s, %s) rejected the RFC code", code, at)
+			continue
+		}
+		if want := tt.unix / totpPeriod; step != want {
+			t.Errorf("ValidateTOTP(%s, %s) step = %d, want %d", code, at, step, want)
+		}
+	}
+}
+
+func TestValidateTOTPSkewWindow(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code := hotp(key, uint64(step+offset))
+		got, ok := ValidateTOTP(rfcSecret, code, now)
+
+		inWindow := offset >= -totpSkew && offset <= totpSkew
+		if ok != inWindow {
+			t.Errorf("code from %+d periods: accepted = %v, want %v", offset, ok, inWindow)
+		}
+		if ok && got != step+offset {
+			t.Errorf("code from %+d periods: step = %d, want %d", offset, got, step+offset)
+		}
+	}
+}
+
+func TestValidateTOTPRejectsMalformedInput(t *testing.T) {
+	now := time.Unix(59, 0)
+	tests := map[string]struct {
+		secret string
+		code   string
+	}{
+		"8 digit code":   {rfcSecret, "94287082"},
+		"short code":     {rfcSecret, "28708"},
+		"empty code":     {rfcSecret, ""},
+		"invalid secret": {"not base32!", "287082"},
+		"wrong code":     {rfcSecret, "000000"},
+	}
+
+	for name, tt := range tests {
+		if _, ok := ValidateTOTP(tt.secret, tt.code, now); ok {
+			t.Errorf("%s: ValidateTOTP accepted %q", name, tt.code)
+		}
+	}
+
+	// Secrets are accepted in lower case, as some apps display them
+	if _, ok := ValidateTOTP(strings.ToLower(rfcSecret), "287082", now); !ok {
+		t.Error("ValidateTOTP rejected a lower case secret")
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret %q is not base32: %v", secret, err)
+	}
+	if len(key) != totpSecretSize {
+		t.Errorf("secret has %d bytes, want %d", len(key), totpSecretSize)
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := map[string]string{
+		"abcde-fghij":  "abcde-fghij",
+		"ABCDE-FGHIJ":  "abcde-fghij",
+		" abcdefghij ": "abcde-fghij",
+		"abcde fghij":  "abcde-fghij",
+		"abcdefghijk":  "abcdefghijk",
+	}
+	for in, want := range tests {
+		if got := NormalizeRecoveryCode(in); got != want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}